@@ -0,0 +1,503 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "os"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+/* ===== Audit log: AUDIT_SINKS = file, stdout, webhook; /api/audit ===== */
+
+// auditEntry is one mutating operation. Prefix operations list the prefix
+// in Keys and the number of objects in Count; a rename lists src then dst.
+type auditEntry struct {
+        Time       time.Time `json:"time"`
+        User       string    `json:"user"`
+        AuthMethod string    `json:"authMethod,omitempty"`
+        ClientIP   string    `json:"clientIp,omitempty"`
+        Op         string    `json:"op"` // put, delete, rename, delete-prefix, multipart-complete, multipart-abort, trash, restore, purge, extract
+        Bucket     string    `json:"bucket"`
+        Keys       []string  `json:"keys,omitempty"`
+        Count      int       `json:"count,omitempty"`
+        Job        string    `json:"job,omitempty"`    // the request started a job, or this is its outcome
+        Result     string    `json:"result"`           // ok | accepted | denied | error | canceled
+        Status     int       `json:"status,omitempty"` // HTTP status, not set on job outcomes
+        Error      string    `json:"error,omitempty"`
+        Bytes      int64     `json:"bytes,omitempty"` // request body of a PUT
+        DurationMs int64     `json:"durationMs"`
+        RequestID  string    `json:"requestId,omitempty"`
+}
+
+// auditSink receives each entry as one JSON line.
+type auditSink interface {
+        write(line []byte)
+}
+
+// auditLog fans entries out to the sinks and keeps the last AUDIT_MEMORY of
+// them for /api/audit.
+type auditLog struct {
+        sinks []auditSink
+
+        mu   sync.Mutex
+        ring []auditEntry
+        next int
+        full bool
+}
+
+func newAuditLog(c cfg) *auditLog {
+        a := &auditLog{ring: make([]auditEntry, c.AuditMemory)}
+        for _, name := range c.AuditSinks {
+                switch name {
+                case "none":
+                case "stdout":
+                        a.sinks = append(a.sinks, stdoutSink{})
+                case "file":
+                        file := c.AuditFile
+                        if file == "" && c.StateDir != "" {
+                                file = filepath.Join(c.StateDir, "audit.log")
+                        }
+                        if file == "" {
+                                log.Printf("audit: no AUDIT_FILE nor STATE_DIR, file sink disabled")
+                                continue
+                        }
+                        s, err := newAuditFileSink(file, int64(c.AuditMaxSizeMB)<<20, c.AuditMaxFiles)
+                        if err != nil {
+                                log.Fatalf("audit: %v", err)
+                        }
+                        a.sinks = append(a.sinks, s)
+                        a.preload(file)
+                case "webhook":
+                        if c.AuditWebhookURL == "" {
+                                log.Fatalf("missing env: AUDIT_WEBHOOK_URL (AUDIT_SINKS=webhook)")
+                        }
+                        a.sinks = append(a.sinks, newWebhookSink(c.AuditWebhookURL, c.AuditWebhookToken))
+                default:
+                        log.Fatalf("invalid env AUDIT_SINKS: unknown sink %q (file, stdout, webhook or none)", name)
+                }
+        }
+        return a
+}
+
+// preload fills the memory with the tail of the current audit file, so that
+// /api/audit still knows what happened before a restart.
+func (a *auditLog) preload(file string) {
+        f, err := os.Open(file)
+        if err != nil {
+                return
+        }
+        defer f.Close()
+        sc := bufio.NewScanner(f)
+        sc.Buffer(make([]byte, 64<<10), 1<<20)
+        for sc.Scan() {
+                var e auditEntry
+                if json.Unmarshal(sc.Bytes(), &e) == nil {
+                        a.remember(e)
+                }
+        }
+}
+
+func (a *auditLog) remember(e auditEntry) {
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        if len(a.ring) == 0 {
+                return
+        }
+        a.ring[a.next] = e
+        a.next = (a.next + 1) % len(a.ring)
+        if a.next == 0 {
+                a.full = true
+        }
+}
+
+func (a *auditLog) record(e *auditEntry) {
+        if e.Time.IsZero() {
+                e.Time = time.Now().UTC()
+        }
+        a.remember(*e)
+        b, err := json.Marshal(e)
+        if err != nil {
+                log.Printf("audit: %v", err)
+                return
+        }
+        b = append(b, '\n')
+        for _, s := range a.sinks {
+                s.write(b)
+        }
+}
+
+// recent returns up to limit entries accepted by match, newest first, and
+// whether older matches were left out.
+func (a *auditLog) recent(match func(e *auditEntry) bool, limit int) ([]auditEntry, bool) {
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        n := a.next
+        if a.full {
+                n = len(a.ring)
+        }
+        out := []auditEntry{}
+        for i := 1; i <= n; i++ {
+                e := &a.ring[(a.next-i+len(a.ring))%len(a.ring)]
+                if !match(e) {
+                        continue
+                }
+                if len(out) == limit {
+                        return out, true
+                }
+                out = append(out, *e)
+        }
+        return out, false
+}
+
+/* ----- sinks ----- */
+
+type stdoutSink struct{}
+
+func (stdoutSink) write(line []byte) { _, _ = os.Stdout.Write(line) }
+
+// auditFileSink appends to a JSON lines file, rotated to file.1 … file.N
+// once it reaches maxSize.
+type auditFileSink struct {
+        path    string
+        maxSize int64
+        keep    int
+
+        mu   sync.Mutex
+        f    *os.File
+        size int64
+}
+
+func newAuditFileSink(path string, maxSize int64, keep int) (*auditFileSink, error) {
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+                return nil, err
+        }
+        s := &auditFileSink{path: path, maxSize: maxSize, keep: keep}
+        return s, s.open()
+}
+
+func (s *auditFileSink) open() error {
+        f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+        if err != nil {
+                return err
+        }
+        st, err := f.Stat()
+        if err != nil {
+                f.Close()
+                return err
+        }
+        s.f, s.size = f, st.Size()
+        return nil
+}
+
+func (s *auditFileSink) write(line []byte) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if s.f != nil && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+                if err := s.rotate(); err != nil {
+                        log.Printf("audit: rotate %s: %v", s.path, err)
+                }
+        }
+        if s.f == nil {
+                // a failed rotation, try again
+                if err := s.open(); err != nil {
+                        log.Printf("audit: %v", err)
+                        return
+                }
+        }
+        n, err := s.f.Write(line)
+        s.size += int64(n)
+        if err != nil {
+                log.Printf("audit: %s: %v", s.path, err)
+        }
+}
+
+// rotate shifts file.i to file.i+1, dropping the oldest. Caller holds s.mu.
+func (s *auditFileSink) rotate() error {
+        s.f.Close()
+        s.f = nil
+        for i := s.keep - 1; i >= 1; i-- {
+                _ = os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+        }
+        if s.keep > 0 {
+                if err := os.Rename(s.path, s.path+".1"); err != nil {
+                        return err
+                }
+        } else if err := os.Remove(s.path); err != nil {
+                return err
+        }
+        return s.open()
+}
+
+// webhookSink POSTs each entry from a background goroutine; entries are
+// dropped rather than slowing requests down when the receiver lags.
+type webhookSink struct {
+        url, token string
+        client     *http.Client
+        queue      chan []byte
+}
+
+func newWebhookSink(url, token string) *webhookSink {
+        s := &webhookSink{url: url, token: token, client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan []byte, 1024)}
+        go s.loop()
+        return s
+}
+
+func (s *webhookSink) write(line []byte) {
+        select {
+        case s.queue <- line:
+        default:
+                log.Printf("audit: webhook queue full, entry dropped")
+        }
+}
+
+func (s *webhookSink) loop() {
+        for line := range s.queue {
+                if err := s.post(line); err != nil {
+                        log.Printf("audit: webhook: %v", err)
+                }
+        }
+}
+
+func (s *webhookSink) post(line []byte) error {
+        req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(line))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        if s.token != "" {
+                req.Header.Set("Authorization", "Bearer "+s.token)
+        }
+        resp, err := s.client.Do(req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        _, _ = io.Copy(io.Discard, resp.Body)
+        if resp.StatusCode/100 != 2 {
+                return fmt.Errorf("%s: %s", s.url, resp.Status)
+        }
+        return nil
+}
+
+/* ----- recording requests ----- */
+
+type auditCtxKey struct{}
+
+// auditFrom returns the entry withAudit fills for r (a throwaway one for
+// requests it does not wrap).
+func auditFrom(r *http.Request) *auditEntry {
+        if e, ok := r.Context().Value(auditCtxKey{}).(*auditEntry); ok {
+                return e
+        }
+        return &auditEntry{}
+}
+
+// auditOp names the operation r performs. withAudit records it once the
+// handler returns; the handler may fill in Count or Job on the result.
+func auditOp(r *http.Request, op, bucket string, keys ...string) *auditEntry {
+        e := auditFrom(r)
+        e.Op, e.Bucket, e.Keys = op, bucket, keys
+        return e
+}
+
+// auditWriter keeps the status and the start of an error body.
+type auditWriter struct {
+        http.ResponseWriter
+        status int
+        body   []byte
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+        if w.status == 0 {
+                w.status = code
+        }
+        w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+        if w.status == 0 {
+                w.status = http.StatusOK
+        }
+        if w.status >= 400 && len(w.body) < 256 {
+                w.body = append(w.body, b[:min(len(b), 256-len(w.body))]...)
+        }
+        return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withAudit records the PUT, POST and DELETE requests whose handler called
+// auditOp. It runs after withAuth, which provides the principal.
+func (p *proxy) withAudit(h http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                switch r.Method {
+                case http.MethodPut, http.MethodPost, http.MethodDelete:
+                default:
+                        h.ServeHTTP(w, r)
+                        return
+                }
+                start := time.Now()
+                pr := principalFrom(r)
+                e := &auditEntry{User: pr.User, AuthMethod: pr.Method, ClientIP: p.clientIP(r), RequestID: requestID(r.Context())}
+                aw := &auditWriter{ResponseWriter: w}
+                h.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, e)))
+                if e.Op == "" {
+                        return
+                }
+                e.Time = start.UTC()
+                e.Status = aw.status
+                if e.Status == 0 {
+                        e.Status = http.StatusOK
+                }
+                switch {
+                case e.Status == http.StatusAccepted:
+                        e.Result = "accepted"
+                case e.Status/100 == 2:
+                        e.Result = "ok"
+                case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+                        e.Result = "denied"
+                default:
+                        e.Result = "error"
+                }
+                if e.Status >= 400 {
+                        e.Error = strings.TrimSpace(string(aw.body))
+                }
+                if r.Method == http.MethodPut {
+                        e.Bytes = requestInfoFrom(r.Context()).bytesIn()
+                }
+                e.DurationMs = time.Since(start).Milliseconds()
+                p.audit.record(e)
+        })
+}
+
+// clientIP is the peer address, or the first X-Forwarded-For hop when the
+// peer is one of AUTH_TRUSTED_PROXIES.
+func (p *proxy) clientIP(r *http.Request) string {
+        host := remoteHost(r)
+        if xff := r.Header.Get("X-Forwarded-For"); xff != "" && ipInNets(p.trusted, host) {
+                first, _, _ := strings.Cut(xff, ",")
+                return strings.TrimSpace(first)
+        }
+        return host
+}
+
+// auditJob records the outcome of a job that changed objects.
+func (p *proxy) auditJob(j *job) {
+        e := &auditEntry{User: j.User, Op: j.Type, Bucket: j.Bucket, Job: j.ID, Count: j.Done - j.FailedCount, Error: j.Error}
+        switch j.Type {
+        case jobRename:
+                e.Keys = []string{normPrefix(j.Src), normPrefix(j.Dst)}
+        case jobExtract:
+                e.Keys = []string{j.Src, normPrefix(j.Dst)}
+        case jobDeletePrefix:
+                e.Keys = []string{normPrefix(j.Prefix)}
+        default:
+                return
+        }
+        switch j.Status {
+        case jobDone:
+                e.Result = "ok"
+                if j.FailedCount > 0 {
+                        e.Result = "error"
+                        e.Error = fmt.Sprintf("%d keys failed", j.FailedCount)
+                }
+        case jobCanceled:
+                e.Result = "canceled"
+        default:
+                e.Result = "error"
+        }
+        if j.StartedAt != nil && j.FinishedAt != nil {
+                e.DurationMs = j.FinishedAt.Sub(*j.StartedAt).Milliseconds()
+        }
+        p.audit.record(e)
+}
+
+/* ----- /api/audit ----- */
+
+const (
+        auditDefaultLimit = 200
+        auditMaxLimit     = 5000
+)
+
+type auditResponse struct {
+        Items     []auditEntry `json:"items"`
+        Truncated bool         `json:"truncated"`
+}
+
+// handleAudit returns recent entries, newest first. Filters combine with AND:
+//
+//	prefix=  one of the keys starts with it
+//	user=    exact user
+//	bucket=  op=
+//	since=   RFC 3339 or YYYY-MM-DD
+//
+// Under a policy, entries are only shown to those who may read their keys.
+func (p *proxy) handleAudit(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        q := r.URL.Query()
+        prefix := strings.TrimLeft(q.Get("prefix"), "/")
+        user, bucket, op := q.Get("user"), q.Get("bucket"), q.Get("op")
+        var since time.Time
+        if s := q.Get("since"); s != "" {
+                var err error
+                if since, err = parseSearchTime(s); err != nil {
+                        httpError(w, "bad since", http.StatusBadRequest)
+                        return
+                }
+        }
+        limit := auditDefaultLimit
+        if s := q.Get("limit"); s != "" {
+                if v, err := strconv.Atoi(s); err == nil && v > 0 {
+                        limit = min(v, auditMaxLimit)
+                }
+        }
+
+        acls := map[string]*access{}
+        items, truncated := p.audit.recent(func(e *auditEntry) bool {
+                if user != "" && e.User != user || bucket != "" && e.Bucket != bucket || op != "" && e.Op != op {
+                        return false
+                }
+                if !since.IsZero() && e.Time.Before(since) {
+                        return false
+                }
+                if prefix != "" && !anyHasPrefix(e.Keys, prefix) {
+                        return false
+                }
+                acl, ok := acls[e.Bucket]
+                if !ok {
+                        acl = p.access(r, e.Bucket)
+                        acls[e.Bucket] = acl
+                }
+                for _, k := range e.Keys {
+                        if !acl.canSee(k) {
+                                return false
+                        }
+                }
+                return true
+        }, limit)
+
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(auditResponse{Items: items, Truncated: truncated})
+}
+
+func anyHasPrefix(keys []string, prefix string) bool {
+        for _, k := range keys {
+                if strings.HasPrefix(k, prefix) {
+                        return true
+                }
+        }
+        return false
+}
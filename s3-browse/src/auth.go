@@ -0,0 +1,739 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "crypto/md5"
+        "crypto/rand"
+        "crypto/sha1"
+        "crypto/sha256"
+        "crypto/subtle"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net"
+        "net/http"
+        "net/url"
+        "os"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/coreos/go-oidc/v3/oidc"
+        "golang.org/x/crypto/bcrypt"
+        "golang.org/x/oauth2"
+)
+
+/* ===== Authentication: AUTH_MODE = none | htpasswd | oidc | forward ===== */
+
+// principal is who a request runs as. withAuth puts one in the context of
+// every request that reaches a handler.
+type principal struct {
+        User   string   `json:"user"`
+        Email  string   `json:"email,omitempty"`
+        Groups []string `json:"groups,omitempty"`
+        Method string   `json:"method"` // none | htpasswd | oidc | forward | share
+}
+
+type principalCtxKey struct{}
+
+func withPrincipal(ctx context.Context, pr *principal) context.Context {
+        return context.WithValue(ctx, principalCtxKey{}, pr)
+}
+
+// principalFrom returns the principal of r; requests that did not go through
+// withAuth (jobs, tests) run as anonymous.
+func principalFrom(r *http.Request) *principal {
+        if pr, ok := r.Context().Value(principalCtxKey{}).(*principal); ok {
+                return pr
+        }
+        return &principal{User: "anonymous", Method: "none"}
+}
+
+// authenticator is one authentication backend.
+type authenticator interface {
+        // authenticate returns the principal of r, nil when r has no valid credentials.
+        authenticate(r *http.Request) *principal
+        // challenge answers a request that authenticate rejected.
+        challenge(w http.ResponseWriter, r *http.Request)
+        // routes registers the endpoints the backend needs under /auth/.
+        routes(mux *http.ServeMux)
+}
+
+func newAuthenticator(c cfg) authenticator {
+        switch c.AuthMode {
+        case "none":
+                log.Printf("AUTH_MODE=none: anyone reaching the proxy has full access to the buckets")
+                return noAuth{}
+        case "htpasswd":
+                if c.AuthHtpasswdFile == "" {
+                        log.Fatalf("missing env: AUTH_HTPASSWD_FILE")
+                }
+                a := &htpasswdAuth{file: c.AuthHtpasswdFile}
+                if err := a.load(); err != nil {
+                        log.Fatalf("htpasswd: %v", err)
+                }
+                return a
+        case "oidc":
+                return newOIDCAuth(c)
+        case "forward":
+                return newForwardAuth(c)
+        }
+        log.Fatalf("invalid env AUTH_MODE: %q (none, htpasswd, oidc or forward)", c.AuthMode)
+        return nil
+}
+
+// withAuth rejects unauthenticated requests. /healthz, /metrics (see
+// METRICS_TOKEN), the /auth/ endpoints and share links (checked by
+// withShareToken) stay public.
+func (p *proxy) withAuth(h http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Path == "/healthz" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/auth/") {
+                        h.ServeHTTP(w, r)
+                        return
+                }
+                if isShareRequest(r) {
+                        pr := &principal{User: "share-link", Method: "share"}
+                        if ri := requestInfoFrom(r.Context()); ri != nil {
+                                ri.User = pr.User
+                        }
+                        h.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), pr)))
+                        return
+                }
+                pr := p.auth.authenticate(r)
+                if pr == nil {
+                        p.auth.challenge(w, r)
+                        return
+                }
+                if ri := requestInfoFrom(r.Context()); ri != nil {
+                        ri.User = pr.User
+                }
+                h.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), pr)))
+        })
+}
+
+// isShareRequest matches the requests withShareToken verifies: GET, HEAD or
+// PUT of a single object carrying a share signature.
+func isShareRequest(r *http.Request) bool {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodPut:
+        default:
+                return false
+        }
+        return strings.HasPrefix(r.URL.Path, "/s3/") && r.URL.Query().Get(shareSignatureParam) != ""
+}
+
+type whoamiResponse struct {
+        *principal
+        LogoutURL        string   `json:"logoutUrl,omitempty"`
+        DisabledFeatures []string `json:"disabledFeatures,omitempty"`
+}
+
+func (p *proxy) handleWhoami(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        out := whoamiResponse{principal: principalFrom(r), DisabledFeatures: p.cfg.FeaturesDisabled}
+        if _, ok := p.auth.(*oidcAuth); ok {
+                out.LogoutURL = prefixed(r, "/auth/logout")
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+/* ----- none ----- */
+
+type noAuth struct{}
+
+func (noAuth) authenticate(*http.Request) *principal {
+        return &principal{User: "anonymous", Method: "none"}
+}
+func (noAuth) challenge(http.ResponseWriter, *http.Request) {}
+func (noAuth) routes(*http.ServeMux)                        {}
+
+/* ----- htpasswd (HTTP Basic) ----- */
+
+// htpasswdAuth checks Basic credentials against an htpasswd file (bcrypt,
+// apr1 or {SHA} hashes), reloaded when its mtime changes. Good credentials
+// are remembered for a few minutes so bcrypt does not run on every request.
+type htpasswdAuth struct {
+        file string
+
+        mu    sync.Mutex
+        mtime time.Time
+        users map[string]string
+        seen  map[[32]byte]time.Time
+}
+
+const htpasswdCacheTTL = 5 * time.Minute
+
+func (a *htpasswdAuth) load() error {
+        st, err := os.Stat(a.file)
+        if err != nil {
+                return err
+        }
+        if st.ModTime().Equal(a.mtime) {
+                return nil
+        }
+        b, err := os.ReadFile(a.file)
+        if err != nil {
+                return err
+        }
+        users := map[string]string{}
+        for i, line := range strings.Split(string(b), "\n") {
+                line = strings.TrimSpace(line)
+                if line == "" || strings.HasPrefix(line, "#") {
+                        continue
+                }
+                user, hash, ok := strings.Cut(line, ":")
+                if !ok || user == "" {
+                        log.Printf("htpasswd %s:%d: malformed line", a.file, i+1)
+                        continue
+                }
+                switch {
+                case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"),
+                        strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{SHA}"):
+                        users[user] = hash
+                default:
+                        log.Printf("htpasswd %s:%d: unsupported hash for %q (use bcrypt, apr1 or SHA)", a.file, i+1, user)
+                }
+        }
+        a.users, a.mtime, a.seen = users, st.ModTime(), map[[32]byte]time.Time{}
+        return nil
+}
+
+func (a *htpasswdAuth) authenticate(r *http.Request) *principal {
+        user, pass, ok := r.BasicAuth()
+        if !ok {
+                return nil
+        }
+        a.mu.Lock()
+        if err := a.load(); err != nil {
+                // keep serving with the users loaded last
+                log.Printf("htpasswd: %v", err)
+        }
+        hash, known := a.users[user]
+        sum := sha256.Sum256([]byte(user + "\x00" + pass))
+        exp, cached := a.seen[sum]
+        a.mu.Unlock()
+
+        if !known {
+                return nil
+        }
+        if !cached || time.Now().After(exp) {
+                if !checkHtpasswd(hash, pass) {
+                        return nil
+                }
+                a.mu.Lock()
+                if a.seen != nil {
+                        a.seen[sum] = time.Now().Add(htpasswdCacheTTL)
+                }
+                a.mu.Unlock()
+        }
+        return &principal{User: user, Method: "htpasswd"}
+}
+
+func (a *htpasswdAuth) challenge(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("WWW-Authenticate", `Basic realm="s3-browse", charset="UTF-8"`)
+        httpError(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func (a *htpasswdAuth) routes(*http.ServeMux) {}
+
+func checkHtpasswd(hash, pass string) bool {
+        switch {
+        case strings.HasPrefix(hash, "$apr1$"):
+                parts := strings.SplitN(hash, "$", 4) // "", "apr1", salt, sum
+                if len(parts) != 4 {
+                        return false
+                }
+                return subtle.ConstantTimeCompare([]byte(apr1(pass, parts[2])), []byte(hash)) == 1
+        case strings.HasPrefix(hash, "{SHA}"):
+                sum := sha1.Sum([]byte(pass))
+                want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+                return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1
+        default:
+                return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+        }
+}
+
+// apr1 is Apache's MD5 crypt, the default of `htpasswd` without -B.
+func apr1(password, salt string) string {
+        const magic = "$apr1$"
+        const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+        if len(salt) > 8 {
+                salt = salt[:8]
+        }
+        pw, s := []byte(password), []byte(salt)
+
+        h := md5.New()
+        h.Write(pw)
+        h.Write(s)
+        h.Write(pw)
+        alt := h.Sum(nil)
+
+        h = md5.New()
+        h.Write(pw)
+        h.Write([]byte(magic))
+        h.Write(s)
+        for i := len(pw); i > 0; i -= 16 {
+                h.Write(alt[:min(i, 16)])
+        }
+        for i := len(pw); i > 0; i >>= 1 {
+                if i&1 == 1 {
+                        h.Write([]byte{0})
+                } else {
+                        h.Write(pw[:1])
+                }
+        }
+        sum := h.Sum(nil)
+
+        for i := 0; i < 1000; i++ {
+                h = md5.New()
+                if i&1 == 1 {
+                        h.Write(pw)
+                } else {
+                        h.Write(sum)
+                }
+                if i%3 != 0 {
+                        h.Write(s)
+                }
+                if i%7 != 0 {
+                        h.Write(pw)
+                }
+                if i&1 == 1 {
+                        h.Write(sum)
+                } else {
+                        h.Write(pw)
+                }
+                sum = h.Sum(nil)
+        }
+
+        var out []byte
+        enc := func(a, b, c byte, n int) {
+                v := uint(a)<<16 | uint(b)<<8 | uint(c)
+                for ; n > 0; n-- {
+                        out = append(out, itoa64[v&0x3f])
+                        v >>= 6
+                }
+        }
+        enc(sum[0], sum[6], sum[12], 4)
+        enc(sum[1], sum[7], sum[13], 4)
+        enc(sum[2], sum[8], sum[14], 4)
+        enc(sum[3], sum[9], sum[15], 4)
+        enc(sum[4], sum[10], sum[5], 4)
+        enc(0, 0, sum[11], 2)
+        return magic + salt + "$" + string(out)
+}
+
+/* ----- forward auth (Traefik forwardAuth, oauth2-proxy...) ----- */
+
+// forwardAuth trusts identity headers set by a reverse proxy, but only on
+// connections coming from AUTH_TRUSTED_PROXIES.
+type forwardAuth struct {
+        trusted                               []*net.IPNet
+        userHeader, emailHeader, groupsHeader string
+}
+
+func newForwardAuth(c cfg) *forwardAuth {
+        if len(c.AuthTrustedProxies) == 0 {
+                log.Fatalf("missing env: AUTH_TRUSTED_PROXIES (AUTH_MODE=forward)")
+        }
+        return &forwardAuth{
+                trusted:      parseTrustedProxies(c.AuthTrustedProxies),
+                userHeader:   c.AuthUserHeader,
+                emailHeader:  c.AuthEmailHeader,
+                groupsHeader: c.AuthGroupsHeader,
+        }
+}
+
+// parseTrustedProxies parses AUTH_TRUSTED_PROXIES; a bare address is one host.
+func parseTrustedProxies(list []string) []*net.IPNet {
+        var out []*net.IPNet
+        for _, s := range list {
+                if !strings.Contains(s, "/") {
+                        if strings.Contains(s, ":") {
+                                s += "/128"
+                        } else {
+                                s += "/32"
+                        }
+                }
+                _, n, err := net.ParseCIDR(s)
+                if err != nil {
+                        log.Fatalf("invalid env AUTH_TRUSTED_PROXIES: %v", err)
+                }
+                out = append(out, n)
+        }
+        return out
+}
+
+// remoteHost is the address of the peer, without the port.
+func remoteHost(r *http.Request) string {
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                return r.RemoteAddr
+        }
+        return host
+}
+
+func ipInNets(nets []*net.IPNet, host string) bool {
+        ip := net.ParseIP(host)
+        if ip == nil {
+                return false
+        }
+        for _, n := range nets {
+                if n.Contains(ip) {
+                        return true
+                }
+        }
+        return false
+}
+
+func (a *forwardAuth) fromTrusted(r *http.Request) bool {
+        return ipInNets(a.trusted, remoteHost(r))
+}
+
+func (a *forwardAuth) authenticate(r *http.Request) *principal {
+        user := strings.TrimSpace(r.Header.Get(a.userHeader))
+        if user == "" {
+                return nil
+        }
+        if !a.fromTrusted(r) {
+                log.Printf("auth: ignoring %s from untrusted %s", a.userHeader, r.RemoteAddr)
+                return nil
+        }
+        return &principal{
+                User:   user,
+                Email:  strings.TrimSpace(r.Header.Get(a.emailHeader)),
+                Groups: splitList(r.Header.Get(a.groupsHeader)),
+                Method: "forward",
+        }
+}
+
+func (a *forwardAuth) challenge(w http.ResponseWriter, r *http.Request) {
+        httpError(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func (a *forwardAuth) routes(*http.ServeMux) {}
+
+/* ----- OIDC (authorization code + PKCE, session cookie) ----- */
+
+const (
+        sessionCookie   = "s3b_session"
+        oidcStateCookie = "s3b_oidc"
+        oidcStateTTL    = 10 * time.Minute
+)
+
+// oidcAuth logs users in against an OpenID Connect provider and keeps them in
+// an HMAC-signed session cookie; nothing is stored server-side. Discovery runs
+// on first use, so the proxy starts even when the IdP is down.
+type oidcAuth struct {
+        issuer      string
+        oauth       oauth2.Config
+        userClaim   string
+        groupsClaim string
+        ttl         time.Duration
+        cookies     cookieSigner
+
+        mu         sync.Mutex
+        verifier   *oidc.IDTokenVerifier
+        endSession string
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+        principal
+        Exp int64 `json:"exp"`
+}
+
+// oidcState is the content of the cookie that carries a login attempt from
+// /auth/login to /auth/callback.
+type oidcState struct {
+        State    string `json:"state"`
+        Nonce    string `json:"nonce"`
+        Verifier string `json:"verifier"`
+        Next     string `json:"next"`
+        Exp      int64  `json:"exp"`
+}
+
+func newOIDCAuth(c cfg) *oidcAuth {
+        for k, v := range map[string]string{
+                "OIDC_ISSUER":       c.OIDCIssuer,
+                "OIDC_CLIENT_ID":    c.OIDCClientID,
+                "OIDC_REDIRECT_URL": c.OIDCRedirectURL,
+        } {
+                if v == "" {
+                        log.Fatalf("missing env: %s (AUTH_MODE=oidc)", k)
+                }
+        }
+        return &oidcAuth{
+                issuer: c.OIDCIssuer,
+                oauth: oauth2.Config{
+                        ClientID:     c.OIDCClientID,
+                        ClientSecret: c.OIDCClientSecret,
+                        RedirectURL:  c.OIDCRedirectURL,
+                        Scopes:       c.OIDCScopes,
+                },
+                userClaim:   c.OIDCUserClaim,
+                groupsClaim: c.OIDCGroupsClaim,
+                ttl:         c.SessionTTL,
+                cookies:     cookieSigner{key: loadSessionKey(c.SessionSecret)},
+        }
+}
+
+// loadSessionKey returns the HMAC key of the session cookies. Without
+// SESSION_SECRET a random key is used and everyone logs in again after a
+// restart.
+func loadSessionKey(secret string) []byte {
+        if secret != "" {
+                return []byte(secret)
+        }
+        b := make([]byte, 32)
+        if _, err := rand.Read(b); err != nil {
+                log.Fatalf("session key: %v", err)
+        }
+        log.Printf("SESSION_SECRET not set: sessions will not survive a restart")
+        return b
+}
+
+// setup runs discovery once it succeeds.
+func (a *oidcAuth) setup(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        if a.verifier != nil {
+                return a.verifier, nil
+        }
+        ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+        defer cancel()
+        prov, err := oidc.NewProvider(ctx, a.issuer)
+        if err != nil {
+                return nil, fmt.Errorf("oidc discovery: %w", err)
+        }
+        var extra struct {
+                EndSession string `json:"end_session_endpoint"`
+        }
+        _ = prov.Claims(&extra)
+        a.oauth.Endpoint = prov.Endpoint()
+        a.endSession = extra.EndSession
+        a.verifier = prov.Verifier(&oidc.Config{ClientID: a.oauth.ClientID})
+        return a.verifier, nil
+}
+
+func (a *oidcAuth) authenticate(r *http.Request) *principal {
+        c, err := r.Cookie(sessionCookie)
+        if err != nil {
+                return nil
+        }
+        var s oidcSession
+        if !a.cookies.decode(c.Value, &s) || time.Now().Unix() > s.Exp {
+                return nil
+        }
+        return &s.principal
+}
+
+// challenge sends browsers to the IdP and answers 401 to API calls.
+func (a *oidcAuth) challenge(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+                http.Redirect(w, r, prefixed(r, "/auth/login?next="+url.QueryEscape(prefixed(r, r.URL.RequestURI()))), http.StatusFound)
+                return
+        }
+        httpError(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func (a *oidcAuth) routes(mux *http.ServeMux) {
+        mux.HandleFunc("/auth/login", a.handleLogin)
+        mux.HandleFunc("/auth/callback", a.handleCallback)
+        mux.HandleFunc("/auth/logout", a.handleLogout)
+}
+
+func (a *oidcAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+        if _, err := a.setup(r.Context()); err != nil {
+                httpError(w, err.Error(), http.StatusBadGateway)
+                return
+        }
+        st := oidcState{
+                State:    randomToken(),
+                Nonce:    randomToken(),
+                Verifier: oauth2.GenerateVerifier(),
+                Next:     safeNext(r, r.URL.Query().Get("next")),
+                Exp:      time.Now().Add(oidcStateTTL).Unix(),
+        }
+        v, err := a.cookies.encode(st)
+        if err != nil {
+                httpError(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        setCookie(w, r, oidcStateCookie, v, oidcStateTTL)
+        http.Redirect(w, r, a.oauth.AuthCodeURL(st.State, oidc.Nonce(st.Nonce), oauth2.S256ChallengeOption(st.Verifier)), http.StatusFound)
+}
+
+func (a *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+        ctx := r.Context()
+        verifier, err := a.setup(ctx)
+        if err != nil {
+                httpError(w, err.Error(), http.StatusBadGateway)
+                return
+        }
+        q := r.URL.Query()
+        if e := q.Get("error"); e != "" {
+                httpError(w, "login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+                return
+        }
+        var st oidcState
+        c, err := r.Cookie(oidcStateCookie)
+        if err != nil || !a.cookies.decode(c.Value, &st) || time.Now().Unix() > st.Exp ||
+                !hmac.Equal([]byte(st.State), []byte(q.Get("state"))) {
+                httpError(w, "bad login state, please retry", http.StatusBadRequest)
+                return
+        }
+        setCookie(w, r, oidcStateCookie, "", -1)
+
+        tok, err := a.oauth.Exchange(ctx, q.Get("code"), oauth2.VerifierOption(st.Verifier))
+        if err != nil {
+                httpError(w, fmt.Sprintf("token exchange: %v", err), http.StatusBadGateway)
+                return
+        }
+        raw, _ := tok.Extra("id_token").(string)
+        if raw == "" {
+                httpError(w, "no id_token in token response", http.StatusBadGateway)
+                return
+        }
+        idt, err := verifier.Verify(ctx, raw)
+        if err != nil {
+                httpError(w, fmt.Sprintf("id_token: %v", err), http.StatusUnauthorized)
+                return
+        }
+        if !hmac.Equal([]byte(idt.Nonce), []byte(st.Nonce)) {
+                httpError(w, "id_token: bad nonce", http.StatusUnauthorized)
+                return
+        }
+        var claims map[string]any
+        if err := idt.Claims(&claims); err != nil {
+                httpError(w, fmt.Sprintf("id_token: %v", err), http.StatusUnauthorized)
+                return
+        }
+
+        s := oidcSession{principal: a.principal(idt.Subject, claims), Exp: time.Now().Add(a.ttl).Unix()}
+        v, err := a.cookies.encode(s)
+        if err != nil {
+                httpError(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        setCookie(w, r, sessionCookie, v, a.ttl)
+        http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+// principal maps the ID token claims: OIDC_USER_CLAIM, then email, then sub.
+func (a *oidcAuth) principal(sub string, claims map[string]any) principal {
+        str := func(k string) string {
+                s, _ := claims[k].(string)
+                return s
+        }
+        pr := principal{User: str(a.userClaim), Email: str("email"), Method: "oidc"}
+        if pr.User == "" {
+                pr.User = pr.Email
+        }
+        if pr.User == "" {
+                pr.User = sub
+        }
+        switch g := claims[a.groupsClaim].(type) {
+        case []any:
+                for _, v := range g {
+                        if s, ok := v.(string); ok {
+                                pr.Groups = append(pr.Groups, s)
+                        }
+                }
+        case string:
+                pr.Groups = splitList(g)
+        }
+        return pr
+}
+
+func (a *oidcAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+        setCookie(w, r, sessionCookie, "", -1)
+        a.mu.Lock()
+        end := a.endSession
+        a.mu.Unlock()
+        if end == "" {
+                http.Redirect(w, r, prefixed(r, "/"), http.StatusFound)
+                return
+        }
+        u, err := url.Parse(end)
+        if err != nil {
+                http.Redirect(w, r, prefixed(r, "/"), http.StatusFound)
+                return
+        }
+        q := u.Query()
+        q.Set("client_id", a.oauth.ClientID)
+        if base, err := url.Parse(a.oauth.RedirectURL); err == nil {
+                q.Set("post_logout_redirect_uri", base.Scheme+"://"+base.Host+prefixed(r, "/"))
+        }
+        u.RawQuery = q.Encode()
+        http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// safeNext only lets a login come back to a path of this site.
+func safeNext(r *http.Request, next string) string {
+        if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+                return prefixed(r, "/")
+        }
+        return next
+}
+
+/* ----- signed cookies ----- */
+
+// cookieSigner packs a JSON value as base64(json).base64(hmac-sha256).
+type cookieSigner struct{ key []byte }
+
+func (c cookieSigner) sign(payload string) string {
+        m := hmac.New(sha256.New, c.key)
+        m.Write([]byte(payload))
+        return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (c cookieSigner) encode(v any) (string, error) {
+        b, err := json.Marshal(v)
+        if err != nil {
+                return "", err
+        }
+        payload := base64.RawURLEncoding.EncodeToString(b)
+        return payload + "." + c.sign(payload), nil
+}
+
+func (c cookieSigner) decode(s string, v any) bool {
+        payload, sig, ok := strings.Cut(s, ".")
+        if !ok || !hmac.Equal([]byte(sig), []byte(c.sign(payload))) {
+                return false
+        }
+        b, err := base64.RawURLEncoding.DecodeString(payload)
+        return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// setCookie sets (ttl > 0) or clears (ttl < 0) an HttpOnly cookie; Secure
+// whenever the browser talks HTTPS, even through a reverse proxy.
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, ttl time.Duration) {
+        c := &http.Cookie{
+                Name:     name,
+                Value:    value,
+                Path:     "/",
+                HttpOnly: true,
+                SameSite: http.SameSiteLaxMode,
+                Secure:   r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"),
+        }
+        if ttl < 0 {
+                c.MaxAge = -1
+        } else {
+                c.MaxAge = int(ttl / time.Second)
+        }
+        http.SetCookie(w, c)
+}
+
+func randomToken() string {
+        b := make([]byte, 24)
+        if _, err := rand.Read(b); err != nil {
+                log.Fatalf("rand: %v", err)
+        }
+        return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+        "crypto"
+        "crypto/rand"
+        "crypto/rsa"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "math/big"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+
+        "golang.org/x/crypto/bcrypt"
+)
+
+/* ----- htpasswd ----- */
+
+func TestCheckHtpasswd(t *testing.T) {
+        bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+        if err != nil {
+                t.Fatal(err)
+        }
+        tests := []struct {
+                name, hash, pass string
+                want             bool
+        }{
+                {"bcrypt", string(bc), "secret", true},
+                {"bcrypt wrong", string(bc), "Secret", false},
+                // openssl passwd -apr1 -salt saltsalt secret
+                {"apr1", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+                {"apr1 wrong", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret2", false},
+                {"apr1 other salt", "$apr1$saltsalx$LrttParrLPdxvgutaSXWJ0", "secret", false},
+                {"apr1 malformed", "$apr1$saltsalt", "secret", false},
+                // printf secret | openssl dgst -sha1 -binary | base64
+                {"sha", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+                {"sha wrong", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "", false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := checkHtpasswd(tt.hash, tt.pass); got != tt.want {
+                                t.Errorf("checkHtpasswd(%q, %q) = %v, want %v", tt.hash, tt.pass, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+        bc, err := bcrypt.GenerateFromPassword([]byte("pw-bcrypt"), bcrypt.MinCost)
+        if err != nil {
+                t.Fatal(err)
+        }
+        file := filepath.Join(t.TempDir(), "htpasswd")
+        lines := []string{
+                "# users",
+                "ann:" + string(bc),
+                "bob:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+                "cid:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+                "dan:abJnggxhB/yWI", // crypt(3): not supported, so dan cannot log in
+                "malformed",
+        }
+        if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+                t.Fatal(err)
+        }
+        a := &htpasswdAuth{file: file}
+        if err := a.load(); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                user, pass string
+                ok         bool
+        }{
+                {"ann", "pw-bcrypt", true},
+                {"ann", "pw-bcrypt", true}, // from the cache
+                {"ann", "nope", false},
+                {"bob", "secret", true},
+                {"cid", "secret", true},
+                {"cid", "nope", false},
+                {"dan", "secret", false},
+                {"eve", "secret", false},
+        }
+        for _, tt := range tests {
+                r := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+                r.SetBasicAuth(tt.user, tt.pass)
+                pr := a.authenticate(r)
+                if (pr != nil) != tt.ok {
+                        t.Errorf("%s:%s: authenticated = %v, want %v", tt.user, tt.pass, pr != nil, tt.ok)
+                }
+                if pr != nil && (pr.User != tt.user || pr.Method != "htpasswd") {
+                        t.Errorf("%s: principal = %+v", tt.user, pr)
+                }
+        }
+        if pr := a.authenticate(httptest.NewRequest(http.MethodGet, "/", nil)); pr != nil {
+                t.Errorf("no credentials: principal = %+v", pr)
+        }
+}
+
+/* ----- forward auth ----- */
+
+func TestForwardAuth(t *testing.T) {
+        a := newForwardAuth(cfg{
+                AuthTrustedProxies: []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1"},
+                AuthUserHeader:     "X-Forwarded-User",
+                AuthEmailHeader:    "X-Forwarded-Email",
+                AuthGroupsHeader:   "X-Forwarded-Groups",
+        })
+        tests := []struct {
+                name   string
+                remote string
+                user   string
+                ok     bool
+        }{
+                {"trusted network", "10.1.2.3:4000", "ann", true},
+                {"trusted host", "192.0.2.7:4000", "ann", true},
+                {"trusted ipv6 host", "[2001:db8::1]:4000", "ann", true},
+                {"untrusted host", "192.0.2.8:4000", "ann", false},
+                {"untrusted ipv6 host", "[2001:db8::2]:4000", "ann", false},
+                {"garbage address", "nowhere", "ann", false},
+                {"no user", "10.1.2.3:4000", "", false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+                        r.RemoteAddr = tt.remote
+                        r.Header.Set("X-Forwarded-User", tt.user)
+                        r.Header.Set("X-Forwarded-Email", "ann@example.org")
+                        r.Header.Set("X-Forwarded-Groups", "staff, ops")
+                        pr := a.authenticate(r)
+                        if (pr != nil) != tt.ok {
+                                t.Fatalf("authenticated = %v, want %v", pr != nil, tt.ok)
+                        }
+                        if pr == nil {
+                                return
+                        }
+                        if pr.User != "ann" || pr.Email != "ann@example.org" || strings.Join(pr.Groups, ",") != "staff,ops" || pr.Method != "forward" {
+                                t.Errorf("principal = %+v", pr)
+                        }
+                })
+        }
+}
+
+/* ----- OIDC ----- */
+
+// testIdP is an OpenID provider with discovery, JWKS and a token endpoint
+// that checks the PKCE verifier of each code.
+type testIdP struct {
+        *httptest.Server
+        key *rsa.PrivateKey
+
+        mu    sync.Mutex
+        codes map[string]idpGrant
+}
+
+// idpGrant is what the authorization endpoint would have remembered of a code.
+type idpGrant struct {
+        challenge, nonce string
+        claims           map[string]any
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+        key, err := rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+                t.Fatal(err)
+        }
+        idp := &testIdP{key: key, codes: map[string]idpGrant{}}
+        mux := http.NewServeMux()
+        mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+                writeJSON(w, map[string]any{
+                        "issuer":                                idp.URL,
+                        "authorization_endpoint":                idp.URL + "/authorize",
+                        "token_endpoint":                        idp.URL + "/token",
+                        "jwks_uri":                              idp.URL + "/jwks",
+                        "end_session_endpoint":                  idp.URL + "/logout",
+                        "id_token_signing_alg_values_supported": []string{"RS256"},
+                })
+        })
+        mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+                b64 := base64.RawURLEncoding.EncodeToString
+                writeJSON(w, map[string]any{"keys": []any{map[string]any{
+                        "kty": "RSA", "use": "sig", "alg": "RS256", "kid": "k1",
+                        "n": b64(key.N.Bytes()),
+                        "e": b64(big.NewInt(int64(key.E)).Bytes()),
+                }}})
+        })
+        mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+                idp.mu.Lock()
+                g, ok := idp.codes[r.FormValue("code")]
+                delete(idp.codes, r.FormValue("code"))
+                idp.mu.Unlock()
+                sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+                if !ok || r.FormValue("grant_type") != "authorization_code" ||
+                        base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+                        w.Header().Set("Content-Type", "application/json")
+                        w.WriteHeader(http.StatusBadRequest)
+                        w.Write([]byte(`{"error":"invalid_grant"}`))
+                        return
+                }
+                claims := map[string]any{
+                        "iss":   idp.URL,
+                        "aud":   "s3-browse",
+                        "sub":   "u-1",
+                        "iat":   time.Now().Unix(),
+                        "exp":   time.Now().Add(time.Hour).Unix(),
+                        "nonce": g.nonce,
+                }
+                for k, v := range g.claims {
+                        claims[k] = v
+                }
+                writeJSON(w, map[string]any{
+                        "access_token": "at",
+                        "token_type":   "Bearer",
+                        "expires_in":   3600,
+                        "id_token":     idp.sign(t, claims),
+                })
+        })
+        idp.Server = httptest.NewServer(mux)
+        t.Cleanup(idp.Close)
+        return idp
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(v)
+}
+
+// sign makes an RS256 JWT. It runs in the IdP's handler, so it reports
+// with t.Error.
+func (idp *testIdP) sign(t *testing.T, claims map[string]any) string {
+        enc := func(v any) string {
+                b, err := json.Marshal(v)
+                if err != nil {
+                        t.Error(err)
+                }
+                return base64.RawURLEncoding.EncodeToString(b)
+        }
+        in := enc(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "k1"}) + "." + enc(claims)
+        sum := sha256.Sum256([]byte(in))
+        sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+        if err != nil {
+                t.Error(err)
+        }
+        return in + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize plays the user at the IdP: it reads the authorization URL the
+// proxy redirected to and hands out a code for it.
+func (idp *testIdP) authorize(t *testing.T, location, code string, claims map[string]any) (state string) {
+        u, err := url.Parse(location)
+        if err != nil {
+                t.Fatal(err)
+        }
+        q := u.Query()
+        if !strings.HasPrefix(location, idp.URL+"/authorize?") || q.Get("code_challenge_method") != "S256" ||
+                q.Get("client_id") != "s3-browse" || q.Get("code_challenge") == "" {
+                t.Fatalf("authorization URL: %s", location)
+        }
+        idp.mu.Lock()
+        idp.codes[code] = idpGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+        idp.mu.Unlock()
+        return q.Get("state")
+}
+
+func newTestOIDC(t *testing.T, idp *testIdP) (*oidcAuth, http.Handler) {
+        a := newOIDCAuth(cfg{
+                OIDCIssuer:      idp.URL,
+                OIDCClientID:    "s3-browse",
+                OIDCRedirectURL: "https://files.example.org/auth/callback",
+                OIDCScopes:      []string{"openid", "email"},
+                OIDCUserClaim:   "preferred_username",
+                OIDCGroupsClaim: "groups",
+                SessionTTL:      time.Hour,
+                SessionSecret:   "session-secret",
+        })
+        mux := http.NewServeMux()
+        a.routes(mux)
+        return a, mux
+}
+
+func cookieOf(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+        t.Helper()
+        for _, c := range w.Result().Cookies() {
+                if c.Name == name && c.MaxAge >= 0 {
+                        return c
+                }
+        }
+        t.Fatalf("no %s cookie in %v", name, w.Header()["Set-Cookie"])
+        return nil
+}
+
+// login runs /auth/login, then the IdP, then returns the /auth/callback
+// request for code.
+func login(t *testing.T, idp *testIdP, h http.Handler, code string, claims map[string]any) *http.Request {
+        t.Helper()
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/login?next=/browse/photos/", nil))
+        if w.Code != http.StatusFound {
+                t.Fatalf("login: %d %s", w.Code, w.Body)
+        }
+        state := idp.authorize(t, w.Header().Get("Location"), code, claims)
+        r := httptest.NewRequest(http.MethodGet, "/auth/callback?code="+code+"&state="+url.QueryEscape(state), nil)
+        r.AddCookie(cookieOf(t, w, oidcStateCookie))
+        return r
+}
+
+func TestOIDCLogin(t *testing.T) {
+        idp := newTestIdP(t)
+        a, h := newTestOIDC(t, idp)
+
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, login(t, idp, h, "c1", map[string]any{
+                "preferred_username": "ann",
+                "email":              "ann@example.org",
+                "groups":             []string{"staff", "ops"},
+        }))
+        if w.Code != http.StatusFound || w.Header().Get("Location") != "/browse/photos/" {
+                t.Fatalf("callback: %d %s %s", w.Code, w.Header().Get("Location"), w.Body)
+        }
+        session := cookieOf(t, w, sessionCookie)
+
+        r := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+        r.AddCookie(session)
+        pr := a.authenticate(r)
+        if pr == nil || pr.User != "ann" || pr.Email != "ann@example.org" || strings.Join(pr.Groups, ",") != "staff,ops" || pr.Method != "oidc" {
+                t.Fatalf("principal = %+v", pr)
+        }
+
+        w = httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/logout", nil))
+        if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, idp.URL+"/logout?") {
+                t.Errorf("logout: Location = %q", loc)
+        }
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+        idp := newTestIdP(t)
+        _, h := newTestOIDC(t, idp)
+
+        tests := []struct {
+                name   string
+                status int
+                req    func(t *testing.T) *http.Request
+        }{
+                {"state mismatch", http.StatusBadRequest, func(t *testing.T) *http.Request {
+                        r := login(t, idp, h, "c2", nil)
+                        q := r.URL.Query()
+                        q.Set("state", "forged")
+                        r.URL.RawQuery = q.Encode()
+                        return r
+                }},
+                {"no state cookie", http.StatusBadRequest, func(t *testing.T) *http.Request {
+                        r := login(t, idp, h, "c3", nil)
+                        r.Header.Del("Cookie")
+                        return r
+                }},
+                {"PKCE verifier of another login", http.StatusBadGateway, func(t *testing.T) *http.Request {
+                        // the code and state of one login, the verifier of another
+                        first, second := login(t, idp, h, "c4", nil), login(t, idp, h, "c5", nil)
+                        signer := cookieSigner{key: []byte("session-secret")}
+                        var st1, st2 oidcState
+                        c1, _ := first.Cookie(oidcStateCookie)
+                        c2, _ := second.Cookie(oidcStateCookie)
+                        if !signer.decode(c1.Value, &st1) || !signer.decode(c2.Value, &st2) {
+                                t.Fatal("state cookies do not decode")
+                        }
+                        st2.Verifier = st1.Verifier
+                        v, _ := signer.encode(st2)
+                        second.Header.Del("Cookie")
+                        second.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: v})
+                        return second
+                }},
+                {"bad nonce", http.StatusUnauthorized, func(t *testing.T) *http.Request {
+                        return login(t, idp, h, "c6", map[string]any{"nonce": "replayed"})
+                }},
+                {"wrong audience", http.StatusUnauthorized, func(t *testing.T) *http.Request {
+                        return login(t, idp, h, "c7", map[string]any{"aud": "someone-else"})
+                }},
+                {"IdP error", http.StatusUnauthorized, func(t *testing.T) *http.Request {
+                        return httptest.NewRequest(http.MethodGet, "/auth/callback?error=access_denied", nil)
+                }},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        w := httptest.NewRecorder()
+                        h.ServeHTTP(w, tt.req(t))
+                        if w.Code != tt.status {
+                                t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+                        }
+                        for _, c := range w.Result().Cookies() {
+                                if c.Name == sessionCookie {
+                                        t.Errorf("session cookie set")
+                                }
+                        }
+                })
+        }
+}
+
+func TestSessionCookie(t *testing.T) {
+        a := &oidcAuth{cookies: cookieSigner{key: []byte("k1")}}
+        other := cookieSigner{key: []byte("k2")}
+        valid, _ := a.cookies.encode(oidcSession{principal: principal{User: "ann", Method: "oidc"}, Exp: time.Now().Add(time.Hour).Unix()})
+        expired, _ := a.cookies.encode(oidcSession{principal: principal{User: "ann", Method: "oidc"}, Exp: time.Now().Add(-time.Second).Unix()})
+        foreign, _ := other.encode(oidcSession{principal: principal{User: "ann", Method: "oidc"}, Exp: time.Now().Add(time.Hour).Unix()})
+        payload, sig, _ := strings.Cut(valid, ".")
+        forged := base64.RawURLEncoding.EncodeToString([]byte(`{"user":"root","method":"oidc","exp":9999999999}`))
+
+        tests := []struct {
+                name, value string
+                ok          bool
+        }{
+                {"valid", valid, true},
+                {"expired", expired, false},
+                {"other key", foreign, false},
+                {"forged payload", forged + "." + sig, false},
+                {"no signature", payload, false},
+                {"empty signature", payload + ".", false},
+                {"garbage", "a.b", false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(http.MethodGet, "/", nil)
+                        r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+                        pr := a.authenticate(r)
+                        if (pr != nil) != tt.ok {
+                                t.Fatalf("authenticated = %v, want %v", pr != nil, tt.ok)
+                        }
+                        if pr != nil && pr.User != "ann" {
+                                t.Errorf("user = %q", pr.User)
+                        }
+                })
+        }
+}
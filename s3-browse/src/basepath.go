@@ -0,0 +1,88 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "strings"
+)
+
+/* ===== Base path: BASE_PATH and X-Forwarded-Prefix ===== */
+
+// The proxy can live below a path, two ways that add up:
+//
+//   - BASE_PATH=/files: routes are served below /files, the reverse proxy
+//     passes the path through;
+//   - X-Forwarded-Prefix: /files, sent by a reverse proxy that strips the
+//     prefix itself (Traefik's stripPrefix).
+//
+// Handlers see paths without the prefix; the URLs they hand out (redirects,
+// Location, share links) and the UI's (assets/js/env.js) get it back.
+
+// forwardedPrefix returns X-Forwarded-Prefix when it is a sane path and comes
+// from AUTH_TRUSTED_PROXIES, or from anyone with TRUST_FORWARDED_PREFIX=1.
+// Otherwise any client could make the UI load its API, and the share links
+// point, below a prefix of its choosing.
+func (p *proxy) forwardedPrefix(r *http.Request) string {
+        v := strings.TrimRight(strings.TrimSpace(r.Header.Get("X-Forwarded-Prefix")), "/")
+        if v == "" || !p.cfg.TrustPrefix && !ipInNets(p.trusted, remoteHost(r)) {
+                return ""
+        }
+        if !strings.HasPrefix(v, "/") || strings.Contains(v, "//") || strings.Contains(v, "/..") {
+                return ""
+        }
+        for _, c := range v {
+                switch {
+                case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("/-_.~", c):
+                default:
+                        return ""
+                }
+        }
+        return v
+}
+
+// withBasePath strips BASE_PATH and records the public prefix of the request.
+// /healthz stays reachable at the root for container health checks.
+func (p *proxy) withBasePath(h http.Handler) http.Handler {
+        base := p.cfg.BasePath
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                prefix := p.forwardedPrefix(r) + base
+                if ri := requestInfoFrom(r.Context()); ri != nil {
+                        ri.Prefix = prefix
+                }
+                switch {
+                case base == "" || r.URL.Path == "/healthz":
+                        h.ServeHTTP(w, r)
+                case r.URL.Path == base:
+                        http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+                case strings.HasPrefix(r.URL.Path, base+"/"):
+                        http.StripPrefix(base, h).ServeHTTP(w, r)
+                default:
+                        httpError(w, "not found", http.StatusNotFound)
+                }
+        })
+}
+
+// prefixed turns a path of the proxy ("/api/jobs?id=…") into the one the
+// client must use.
+func prefixed(r *http.Request, path string) string {
+        if ri := requestInfoFrom(r.Context()); ri != nil {
+                return ri.Prefix + path
+        }
+        return path
+}
+
+// handleUIEnv serves assets/js/env.js, loaded first by the pages: it tells
+// the UI where the API lives (BB.base), from which BB.cfg.bucketUrl and the
+// /api URLs derive.
+func (p *proxy) handleUIEnv(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        base, _ := json.Marshal(prefixed(r, ""))
+        w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Vary", "X-Forwarded-Prefix")
+        fmt.Fprintf(w, "window.BB = window.BB || {};\nBB.base = %s;\n", base)
+}
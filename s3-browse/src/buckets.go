@@ -0,0 +1,121 @@
+package main
+
+import (
+        "encoding/json"
+        "encoding/xml"
+        "errors"
+        "fmt"
+        "net/http"
+        "path"
+        "sort"
+        "time"
+)
+
+/* ===== Buckets: /api/buckets, ?bucket= and /s3/{bucket}/... ===== */
+
+var (
+        errNoBucket         = errors.New("missing bucket")
+        errNoKey            = errors.New("missing key")
+        errBucketNotAllowed = errors.New("bucket not allowed")
+)
+
+type listAllMyBucketsResult struct {
+        XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+        Buckets []struct {
+                Name         string    `xml:"Name"`
+                CreationDate time.Time `xml:"CreationDate"`
+        } `xml:"Buckets>Bucket"`
+}
+
+type bucketJSON struct {
+        Name         string     `json:"name"`
+        CreationDate *time.Time `json:"creationDate,omitempty"`
+}
+
+type bucketsResponse struct {
+        Default string       `json:"default"`
+        Buckets []bucketJSON `json:"buckets"`
+}
+
+// bucketAllowed reports whether name is exposed by S3_BUCKETS (or is S3_BUCKET).
+func (p *proxy) bucketAllowed(name string) bool {
+        if name == "" {
+                return false
+        }
+        if name == p.cfg.Bucket {
+                return true
+        }
+        for _, pat := range p.cfg.Buckets {
+                if ok, _ := path.Match(pat, name); ok {
+                        return true
+                }
+        }
+        return false
+}
+
+// queryBucket resolves ?bucket= on /api/* endpoints, defaulting to S3_BUCKET.
+func (p *proxy) queryBucket(r *http.Request) (string, error) {
+        b := r.URL.Query().Get("bucket")
+        if b == "" {
+                return p.cfg.Bucket, nil
+        }
+        if !p.bucketAllowed(b) {
+                return "", errBucketNotAllowed
+        }
+        return b, nil
+}
+
+// pathError answers a request whose bucket or key could not be resolved.
+func pathError(w http.ResponseWriter, err error) {
+        switch {
+        case errors.Is(err, errBucketNotAllowed), errors.Is(err, errNoBucket), errors.Is(err, errNoKey):
+                writeError(w, asAPIError("", err))
+        default:
+                httpError(w, "bad path", http.StatusBadRequest)
+        }
+}
+
+func (p *proxy) handleBuckets(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+
+        u := *p.origin
+        u.Path = "/"
+        u.RawPath = ""
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+        if err != nil {
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                upstreamError(w, "upstream", err)
+                return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                s3Failed(w, "list buckets", resp)
+                return
+        }
+        var lb listAllMyBucketsResult
+        if err := xml.NewDecoder(resp.Body).Decode(&lb); err != nil {
+                upstreamError(w, "xml", err)
+                return
+        }
+
+        out := bucketsResponse{Default: p.cfg.Bucket, Buckets: []bucketJSON{}}
+        for _, b := range lb.Buckets {
+                if !p.bucketAllowed(b.Name) || !p.access(r, b.Name).canSee("") {
+                        continue
+                }
+                t := b.CreationDate
+                out.Buckets = append(out.Buckets, bucketJSON{Name: b.Name, CreationDate: &t})
+        }
+        sort.Slice(out.Buckets, func(i, j int) bool { return out.Buckets[i].Name < out.Buckets[j].Name })
+
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
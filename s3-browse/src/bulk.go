@@ -0,0 +1,193 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/md5"
+        "encoding/base64"
+        "encoding/xml"
+        "io"
+        "net/http"
+        "sync"
+)
+
+/* ===== Bulk helpers: worker pool & multi-object delete ===== */
+
+// S3 DeleteObjects accepts at most 1000 keys per call.
+const deleteBatchSize = 1000
+
+type keyFailure struct {
+        Key   string `json:"key"`
+        Error string `json:"error"`
+}
+
+type deleteObjectsRequest struct {
+        XMLName xml.Name `xml:"Delete"`
+        Quiet   bool     `xml:"Quiet"`
+        Objects []struct {
+                Key string `xml:"Key"`
+        } `xml:"Object"`
+}
+
+type deleteObjectsResult struct {
+        XMLName xml.Name `xml:"DeleteResult"`
+        Deleted []struct {
+                Key string `xml:"Key"`
+        } `xml:"Deleted"`
+        Errors []struct {
+                Key     string `xml:"Key"`
+                Code    string `xml:"Code"`
+                Message string `xml:"Message"`
+        } `xml:"Error"`
+}
+
+// forEachKey runs fn over keys with at most n concurrent calls and collects
+// the keys that failed. Once ctx is done, remaining keys fail with ctx.Err().
+func forEachKey(ctx context.Context, n int, keys []string, fn func(ctx context.Context, key string) error) []keyFailure {
+        if n < 1 {
+                n = 1
+        }
+        if n > len(keys) {
+                n = len(keys)
+        }
+        var (
+                mu       sync.Mutex
+                failures []keyFailure
+                wg       sync.WaitGroup
+        )
+        next := make(chan string)
+        for i := 0; i < n; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for k := range next {
+                                err := ctx.Err()
+                                if err == nil {
+                                        err = fn(ctx, k)
+                                }
+                                if err != nil {
+                                        mu.Lock()
+                                        failures = append(failures, keyFailure{Key: k, Error: err.Error()})
+                                        mu.Unlock()
+                                }
+                        }
+                }()
+        }
+        for _, k := range keys {
+                next <- k
+        }
+        close(next)
+        wg.Wait()
+        return failures
+}
+
+// succeededKeys returns keys minus the ones listed in failures, keeping order.
+func succeededKeys(keys []string, failures []keyFailure) []string {
+        if len(failures) == 0 {
+                return keys
+        }
+        failed := make(map[string]struct{}, len(failures))
+        for _, f := range failures {
+                failed[f.Key] = struct{}{}
+        }
+        out := make([]string, 0, len(keys)-len(failures))
+        for _, k := range keys {
+                if _, ok := failed[k]; !ok {
+                        out = append(out, k)
+                }
+        }
+        return out
+}
+
+// deleteObjects removes up to 1000 keys in one DeleteObjects call and returns
+// the keys S3 refused. A transport or protocol error fails the whole batch.
+func (p *proxy) deleteObjects(ctx context.Context, bucket string, keys []string) ([]keyFailure, error) {
+        var body deleteObjectsRequest
+        body.Quiet = true
+        body.Objects = make([]struct {
+                Key string `xml:"Key"`
+        }, len(keys))
+        for i, k := range keys {
+                body.Objects[i].Key = k
+        }
+        payload, err := xml.Marshal(body)
+        if err != nil {
+                return nil, err
+        }
+        sum := md5.Sum(payload)
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.buildBucketURL(bucket, nil)+"?delete", bytes.NewReader(payload))
+        if err != nil {
+                return nil, err
+        }
+        req.Header.Set("Content-Type", "application/xml")
+        req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        b, err := io.ReadAll(resp.Body)
+        if err != nil {
+                return nil, err
+        }
+        if resp.StatusCode != http.StatusOK {
+                return nil, s3ErrorFromBody("delete objects", resp.StatusCode, b)
+        }
+        var res deleteObjectsResult
+        if err := xml.Unmarshal(b, &res); err != nil {
+                return nil, err
+        }
+        failures := make([]keyFailure, 0, len(res.Errors))
+        for _, e := range res.Errors {
+                failures = append(failures, keyFailure{Key: e.Key, Error: e.Code + ": " + e.Message})
+        }
+        return failures, nil
+}
+
+// deleteKeys deletes keys in DeleteObjects batches, BULK_CONCURRENCY batches
+// at a time, and returns how many were deleted along with per-key failures.
+// onBatch (optional) is called with the size of each finished batch.
+func (p *proxy) deleteKeys(ctx context.Context, bucket string, keys []string, onBatch func(n int)) (int, []keyFailure) {
+        var batches [][]string
+        for rest := keys; len(rest) > 0; {
+                n := min(len(rest), deleteBatchSize)
+                batches = append(batches, rest[:n])
+                rest = rest[n:]
+        }
+
+        var (
+                mu       sync.Mutex
+                deleted  int
+                failures []keyFailure
+                wg       sync.WaitGroup
+        )
+        sem := make(chan struct{}, max(1, p.cfg.BulkConcurrency))
+        for _, batch := range batches {
+                wg.Add(1)
+                sem <- struct{}{}
+                go func(batch []string) {
+                        defer wg.Done()
+                        defer func() { <-sem }()
+                        fails, err := p.deleteObjects(ctx, bucket, batch)
+                        if onBatch != nil {
+                                defer onBatch(len(batch))
+                        }
+                        mu.Lock()
+                        defer mu.Unlock()
+                        if err != nil {
+                                for _, k := range batch {
+                                        failures = append(failures, keyFailure{Key: k, Error: err.Error()})
+                                }
+                                return
+                        }
+                        deleted += len(batch) - len(fails)
+                        failures = append(failures, fails...)
+                        p.index.noteDelete(bucket, succeededKeys(batch, fails)...)
+                }(batch)
+        }
+        wg.Wait()
+        p.dropThumbs(bucket, succeededKeys(keys, failures)...)
+        return deleted, failures
+}
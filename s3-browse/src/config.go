@@ -0,0 +1,329 @@
+package main
+
+import (
+        "crypto/tls"
+        "crypto/x509"
+        "errors"
+        "flag"
+        "fmt"
+        "io"
+        "log"
+        "log/slog"
+        "net"
+        "net/http"
+        "os"
+        "sort"
+        "strings"
+        "time"
+
+        "gopkg.in/yaml.v3"
+)
+
+/* ===== Configuration: config file, environment, transport ===== */
+
+// Every setting is an environment variable. A YAML config file (-config or
+// CONFIG_FILE) gives values for the same variables, the environment having
+// the last word. Sections of the file are joined to their keys with "_" and
+// lists become comma separated, so
+//
+//	s3:
+//	  endpoint: http://garage:3900
+//	  buckets: [photos, "backup-*"]
+//	tls:
+//	  ca_file: /etc/s3-browse/ca.crt
+//	bulk_concurrency: 16
+//
+// sets S3_ENDPOINT, S3_BUCKETS, TLS_CA_FILE and BULK_CONCURRENCY. A key no
+// setting reads is an error: a typo must not go unnoticed.
+
+// cfgSource tracks where each setting came from, for -check-config.
+type cfgSource struct {
+        file  map[string]string // env name -> value, from the config file
+        path  string
+        used  map[string]string // env name -> "env" | "file" | "default"
+        value map[string]string // env name -> effective value
+}
+
+var cfgSrc = &cfgSource{file: map[string]string{}, used: map[string]string{}, value: map[string]string{}}
+
+// loadConfigFile reads the YAML config file at path into cfgSrc.
+func loadConfigFile(path string) error {
+        b, err := os.ReadFile(path)
+        if err != nil {
+                return err
+        }
+        var doc map[string]any
+        if err := yaml.Unmarshal(b, &doc); err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+        }
+        cfgSrc.path = path
+        return flattenCfg("", doc, cfgSrc.file)
+}
+
+func flattenCfg(prefix string, v any, out map[string]string) error {
+        switch v := v.(type) {
+        case map[string]any:
+                for k, sub := range v {
+                        key := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(k))
+                        if prefix != "" {
+                                key = prefix + "_" + key
+                        }
+                        if err := flattenCfg(key, sub, out); err != nil {
+                                return err
+                        }
+                }
+        case []any:
+                items := make([]string, 0, len(v))
+                for _, it := range v {
+                        switch it.(type) {
+                        case map[string]any, []any:
+                                return fmt.Errorf("%s: lists may only hold scalars", prefix)
+                        }
+                        items = append(items, fmt.Sprint(it))
+                }
+                out[prefix] = strings.Join(items, ",")
+        case nil:
+                out[prefix] = ""
+        default:
+                out[prefix] = fmt.Sprint(v)
+        }
+        return nil
+}
+
+// getenv returns setting k from the environment, else from the config file.
+// An empty variable counts as unset, as docker-compose passes "${X:-}".
+func getenv(k string) string {
+        if v := strings.TrimSpace(os.Getenv(k)); v != "" {
+                cfgSrc.used[k], cfgSrc.value[k] = "env", v
+                return v
+        }
+        if v, ok := cfgSrc.file[k]; ok && strings.TrimSpace(v) != "" {
+                v = strings.TrimSpace(v)
+                cfgSrc.used[k], cfgSrc.value[k] = "file", v
+                return v
+        }
+        cfgSrc.used[k] = "default"
+        return ""
+}
+
+// defaulted records the value a setting got by default.
+func defaulted(k, v string) {
+        if cfgSrc.used[k] == "default" {
+                cfgSrc.value[k] = v
+        }
+}
+
+func envBool(k string, def bool) bool {
+        v := getenv(k)
+        if v == "" {
+                defaulted(k, fmt.Sprint(def))
+                return def
+        }
+        switch strings.ToLower(v) {
+        case "1", "true", "yes", "on":
+                return true
+        case "0", "false", "no", "off":
+                return false
+        }
+        fatalf("invalid env %s: %q (true or false)", k, v)
+        return false
+}
+
+// unknownCfgKeys lists the keys of the config file no setting reads.
+func unknownCfgKeys() []string {
+        var out []string
+        for k := range cfgSrc.file {
+                if _, ok := cfgSrc.used[k]; !ok {
+                        out = append(out, k)
+                }
+        }
+        sort.Strings(out)
+        return out
+}
+
+/* ----- feature toggles ----- */
+
+// features that FEATURES_DISABLED can turn off; their routes answer 404.
+var features = []string{"share", "zip", "extract", "trash", "search", "audit", "metrics", "thumbs"}
+
+func (c cfg) enabled(feature string) bool {
+        for _, f := range c.FeaturesDisabled {
+                if f == feature {
+                        return false
+                }
+        }
+        return true
+}
+
+// feature serves h, or a 404 FeatureDisabled when name is turned off.
+func (p *proxy) feature(name string, h http.Handler) http.Handler {
+        if p.cfg.enabled(name) {
+                return h
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                writeError(w, newAPIError(http.StatusNotFound, "FeatureDisabled", name+" is disabled on this server"))
+        })
+}
+
+/* ----- checks ----- */
+
+// checkCfg validates what loadCfg cannot check value by value.
+func checkCfg(c cfg) error {
+        var errs []error
+        if keys := unknownCfgKeys(); len(keys) > 0 {
+                errs = append(errs, fmt.Errorf("%s: unknown settings %s", cfgSrc.path, strings.Join(keys, ", ")))
+        }
+        for _, f := range c.FeaturesDisabled {
+                ok := false
+                for _, known := range features {
+                        ok = ok || f == known
+                }
+                if !ok {
+                        errs = append(errs, fmt.Errorf("FEATURES_DISABLED: unknown feature %q (%s)", f, strings.Join(features, ", ")))
+                }
+        }
+        if c.AuthMode == "" {
+                // none has to be asked for: it lets anyone reaching the port
+                // read and delete everything
+                errs = append(errs, fmt.Errorf("AUTH_MODE: not set (none, htpasswd, oidc or forward)"))
+        }
+        if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+                errs = append(errs, fmt.Errorf("LISTEN_ADDR: %v", err))
+        }
+        if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/")) {
+                errs = append(errs, fmt.Errorf("BASE_PATH: %q must start with / (and not end with one)", c.BasePath))
+        }
+        var level slog.Level
+        if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+                errs = append(errs, fmt.Errorf("LOG_LEVEL: %q (debug, info, warn or error)", c.LogLevel))
+        }
+        if c.ThumbQuality > 100 {
+                errs = append(errs, fmt.Errorf("THUMB_QUALITY: %d (1 to 100)", c.ThumbQuality))
+        }
+        if c.ThumbPrefix == c.TrashPrefix {
+                errs = append(errs, fmt.Errorf("THUMB_PREFIX: %q is the trash", c.ThumbPrefix))
+        }
+        if c.LogFormat != "text" && c.LogFormat != "json" {
+                errs = append(errs, fmt.Errorf("LOG_FORMAT: %q (text or json)", c.LogFormat))
+        }
+        if st, err := os.Stat(c.StaticDir); c.StaticDir != "" && (err != nil || !st.IsDir()) {
+                errs = append(errs, fmt.Errorf("STATIC_DIR: %s is not a directory", c.StaticDir))
+        }
+        if _, err := upstreamTLS(c); err != nil {
+                errs = append(errs, err)
+        }
+        return errors.Join(errs...)
+}
+
+// printCfg writes the effective settings for -check-config, secrets masked.
+func printCfg(out io.Writer) {
+        keys := make([]string, 0, len(cfgSrc.used))
+        for k := range cfgSrc.used {
+                keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+                v := cfgSrc.value[k]
+                if v != "" && (strings.Contains(k, "SECRET") || strings.Contains(k, "TOKEN")) {
+                        v = "********"
+                }
+                fmt.Fprintf(out, "%-34s %-8s %s\n", k, cfgSrc.used[k], v)
+        }
+}
+
+// fatalf stops on a bad setting; -check-config collects instead of exiting
+// on the first one.
+var fatalf = log.Fatalf
+
+// parseFlags handles the command line: -config FILE and -check-config. It
+// returns true in check mode.
+func parseFlags() bool {
+        file := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE); the environment overrides it")
+        check := flag.Bool("check-config", false, "validate the configuration, print the effective settings and exit")
+        flag.Parse()
+        if *file != "" {
+                if err := loadConfigFile(*file); err != nil {
+                        fatalf("config: %v", err)
+                }
+        }
+        return *check
+}
+
+// checkConfigAndExit is -check-config: every problem is reported, then the
+// exit status tells whether the proxy would start.
+func checkConfigAndExit() {
+        var problems []string
+        fatalf = func(format string, args ...any) {
+                problems = append(problems, fmt.Sprintf(format, args...))
+        }
+        c := loadCfg()
+        if err := checkCfg(c); err != nil {
+                problems = append(problems, strings.Split(err.Error(), "\n")...)
+        }
+        if c.PolicyFile != "" {
+                if _, err := (&policyEngine{file: c.PolicyFile}).current(); err != nil {
+                        problems = append(problems, fmt.Sprintf("POLICY_FILE: %v", err))
+                }
+        }
+        printCfg(os.Stdout)
+        if len(problems) > 0 {
+                fmt.Fprintln(os.Stderr)
+                for _, pb := range problems {
+                        fmt.Fprintln(os.Stderr, "error:", pb)
+                }
+                os.Exit(1)
+        }
+        fmt.Println("\nconfiguration OK")
+        os.Exit(0)
+}
+
+/* ----- upstream transport ----- */
+
+// upstreamTLS is the TLS config towards S3: system roots plus TLS_CA_FILE,
+// and the client certificate when S3 sits behind an mTLS route.
+func upstreamTLS(c cfg) (*tls.Config, error) {
+        tc := &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}
+        if c.TLSCAFile != "" {
+                pem, err := os.ReadFile(c.TLSCAFile)
+                if err != nil {
+                        return nil, fmt.Errorf("TLS_CA_FILE: %v", err)
+                }
+                pool, err := x509.SystemCertPool()
+                if err != nil {
+                        pool = x509.NewCertPool() // scratch image without a system bundle
+                }
+                if !pool.AppendCertsFromPEM(pem) {
+                        return nil, fmt.Errorf("TLS_CA_FILE: no PEM certificate in %s", c.TLSCAFile)
+                }
+                tc.RootCAs = pool
+        }
+        if (c.TLSClientCert == "") != (c.TLSClientKey == "") {
+                return nil, fmt.Errorf("TLS_CLIENT_CERT and TLS_CLIENT_KEY go together")
+        }
+        if c.TLSClientCert != "" {
+                cert, err := tls.LoadX509KeyPair(c.TLSClientCert, c.TLSClientKey)
+                if err != nil {
+                        return nil, fmt.Errorf("TLS_CLIENT_CERT: %v", err)
+                }
+                tc.Certificates = []tls.Certificate{cert}
+        }
+        return tc, nil
+}
+
+// newTransport is the HTTP transport towards S3. There is no overall client
+// timeout: downloads and uploads stream for as long as they need.
+func newTransport(c cfg) (*http.Transport, error) {
+        tc, err := upstreamTLS(c)
+        if err != nil {
+                return nil, err
+        }
+        return &http.Transport{
+                Proxy:                 http.ProxyFromEnvironment,
+                DialContext:           (&net.Dialer{Timeout: c.UpstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+                TLSClientConfig:       tc,
+                TLSHandshakeTimeout:   c.UpstreamTLSHandshakeTimeout,
+                ResponseHeaderTimeout: c.UpstreamResponseHeaderTimeout,
+                IdleConnTimeout:       c.UpstreamIdleConnTimeout,
+                MaxIdleConnsPerHost:   c.UpstreamMaxIdleConns,
+        }, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "encoding/xml"
+        "errors"
+        "io"
+        "net"
+        "net/http"
+        "strings"
+)
+
+/* ===== Errors: one JSON shape for every API error ===== */
+
+// apiError is the body of every error response:
+//
+//	{"status":404,"code":"NoSuchKey","message":"get: The specified key does not exist.",
+//	 "key":"a/b.txt","requestId":"6f1c…","retryable":false}
+//
+// S3 errors keep their S3 code; errors of the proxy itself use the status
+// text without spaces (BadRequest, NotFound…) or a code of their own.
+type apiError struct {
+        Status            int    `json:"status"`
+        Code              string `json:"code"`
+        Message           string `json:"message"`
+        Bucket            string `json:"bucket,omitempty"`
+        Key               string `json:"key,omitempty"`
+        RequestID         string `json:"requestId,omitempty"`
+        UpstreamRequestID string `json:"upstreamRequestId,omitempty"` // the RequestId of the S3 error
+        Retryable         bool   `json:"retryable"`
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func newAPIError(status int, code, msg string) *apiError {
+        if code == "" {
+                code = strings.ReplaceAll(http.StatusText(status), " ", "")
+        }
+        return &apiError{Status: status, Code: code, Message: msg, Retryable: retryableStatus(status)}
+}
+
+func retryableStatus(status int) bool {
+        switch status {
+        case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+                http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+                return true
+        }
+        return false
+}
+
+// s3ErrorStatus is the status answered for an S3 error code, when it differs
+// from the upstream one. Credential errors are the proxy's, not the user's.
+var s3ErrorStatus = map[string]int{
+        "NoSuchKey":             http.StatusNotFound,
+        "NoSuchBucket":          http.StatusNotFound,
+        "NoSuchUpload":          http.StatusNotFound,
+        "AccessDenied":          http.StatusForbidden,
+        "InvalidAccessKeyId":    http.StatusBadGateway,
+        "SignatureDoesNotMatch": http.StatusBadGateway,
+        "PreconditionFailed":    http.StatusPreconditionFailed,
+        "InvalidRange":          http.StatusRequestedRangeNotSatisfiable,
+        "EntityTooLarge":        http.StatusRequestEntityTooLarge,
+        "BucketNotEmpty":        http.StatusConflict,
+        "RequestTimeout":        http.StatusRequestTimeout,
+        "SlowDown":              http.StatusServiceUnavailable,
+        "ServiceUnavailable":    http.StatusServiceUnavailable,
+        "InternalError":         http.StatusBadGateway,
+        "NotImplemented":        http.StatusNotImplemented,
+}
+
+// s3ErrorBody is the <Error> document of S3.
+type s3ErrorBody struct {
+        Code      string `xml:"Code"`
+        Message   string `xml:"Message"`
+        Key       string `xml:"Key"`
+        RequestID string `xml:"RequestId"`
+}
+
+// parseS3Error turns an upstream error response into an apiError; op prefixes
+// the message ("copy: …"). The body is read but not closed.
+func parseS3Error(op string, resp *http.Response) *apiError {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+        return s3ErrorFromBody(op, resp.StatusCode, b)
+}
+
+// s3ErrorFromBody is parseS3Error for a body already read, e.g. the <Error>
+// CompleteMultipartUpload may send with a 200.
+func s3ErrorFromBody(op string, status int, body []byte) *apiError {
+        var eb s3ErrorBody
+        if xml.Unmarshal(body, &eb) != nil || eb.Code == "" {
+                // HEAD, or not S3 XML: only the status is known
+                msg := strings.TrimSpace(string(body))
+                if msg == "" || len(msg) > 512 {
+                        msg = http.StatusText(status)
+                }
+                if status < 400 || status >= 500 {
+                        status = http.StatusBadGateway
+                }
+                e := newAPIError(status, "", msg)
+                if op != "" {
+                        e.Message = op + ": " + e.Message
+                }
+                return e
+        }
+        if s, ok := s3ErrorStatus[eb.Code]; ok {
+                status = s
+        } else if status < 400 || status >= 500 {
+                status = http.StatusBadGateway
+        }
+        msg := eb.Message
+        if msg == "" {
+                msg = eb.Code
+        }
+        if op != "" {
+                msg = op + ": " + msg
+        }
+        e := newAPIError(status, eb.Code, msg)
+        e.Key, e.UpstreamRequestID = eb.Key, eb.RequestID
+        switch eb.Code {
+        case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout", "OperationAborted":
+                e.Retryable = true
+        case "InvalidAccessKeyId", "SignatureDoesNotMatch":
+                e.Retryable = false
+        }
+        return e
+}
+
+// asAPIError classifies err: apiErrors (S3 errors from the helpers) are kept,
+// transport errors become 502 and timeouts 504. op prefixes the message.
+func asAPIError(op string, err error) *apiError {
+        var e *apiError
+        if errors.As(err, &e) {
+                c := *e
+                if op != "" {
+                        c.Message = op + ": " + c.Message
+                }
+                return &c
+        }
+        msg := err.Error()
+        if op != "" {
+                msg = op + ": " + msg
+        }
+        var ne net.Error
+        switch {
+        case errors.Is(err, errBucketNotAllowed):
+                return newAPIError(http.StatusForbidden, "BucketNotAllowed", msg)
+        case errors.Is(err, errNoBucket):
+                return newAPIError(http.StatusNotFound, "NoSuchBucket", msg)
+        case errors.Is(err, errNoKey):
+                return newAPIError(http.StatusBadRequest, "NoKey", msg)
+        case errors.Is(err, context.Canceled):
+                return newAPIError(499, "Canceled", msg) // nginx's "client closed request"
+        case errors.Is(err, context.DeadlineExceeded):
+                return newAPIError(http.StatusGatewayTimeout, "", msg)
+        case errors.As(err, &ne):
+                return newAPIError(http.StatusBadGateway, "UpstreamUnreachable", msg)
+        }
+        return newAPIError(http.StatusBadGateway, "", msg)
+}
+
+// writeError answers with e. The request ID comes from the response header
+// set by withRequestLog, so handlers need not pass the request along.
+func writeError(w http.ResponseWriter, e *apiError) {
+        e.RequestID = w.Header().Get(requestIDHeader)
+        h := w.Header()
+        h.Del("Content-Length")
+        h.Set("Content-Type", "application/json")
+        h.Set("X-Content-Type-Options", "nosniff")
+        w.WriteHeader(e.Status)
+        _ = json.NewEncoder(w).Encode(e)
+}
+
+// httpError is http.Error with a JSON body.
+func httpError(w http.ResponseWriter, msg string, status int) {
+        writeError(w, newAPIError(status, "", msg))
+}
+
+// upstreamError answers with the error of an operation against S3.
+func upstreamError(w http.ResponseWriter, op string, err error) {
+        writeError(w, asAPIError(op, err))
+}
+
+// s3Failed answers with the S3 error in resp.
+func s3Failed(w http.ResponseWriter, op string, resp *http.Response) {
+        writeError(w, parseS3Error(op, resp))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+        "archive/tar"
+        "archive/zip"
+        "compress/gzip"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "mime"
+        "net/http"
+        "path"
+        "strings"
+        "sync"
+)
+
+/* ===== Archive extraction: /api/extract ===== */
+
+// Ranged GETs made by s3ReaderAt are this large; zip entries are mostly read
+// sequentially, so one block of read-ahead avoids a request per Read.
+const extractBlockSize = 8 << 20
+
+type extractRequest struct {
+        Key string `json:"key"` // archive object
+        Dst string `json:"dst"` // destination prefix
+}
+
+func archiveFormat(key string) string {
+        k := strings.ToLower(key)
+        switch {
+        case strings.HasSuffix(k, ".zip"):
+                return "zip"
+        case strings.HasSuffix(k, ".tar.gz"), strings.HasSuffix(k, ".tgz"):
+                return "tar.gz"
+        case strings.HasSuffix(k, ".tar"):
+                return "tar"
+        }
+        return ""
+}
+
+// safeEntryName turns an archive entry name into a relative key, rejecting
+// absolute paths and anything that climbs out of the destination prefix.
+func safeEntryName(name string) (string, bool) {
+        name = strings.ReplaceAll(name, "\\", "/")
+        if name == "" || strings.HasPrefix(name, "/") || strings.ContainsRune(name, 0) {
+                return "", false
+        }
+        if len(name) >= 2 && name[1] == ':' {
+                // C:foo
+                return "", false
+        }
+        c := path.Clean(name)
+        if c == "." || c == ".." || strings.HasPrefix(c, "../") {
+                return "", false
+        }
+        return c, true
+}
+
+// extractGuard enforces EXTRACT_MAX_* against what is actually extracted,
+// not only against what the archive headers claim.
+type extractGuard struct {
+        maxBytes, maxEntries, maxRatio int64
+        archiveSize                    int64
+        bytes, entries                 int64
+}
+
+func (g *extractGuard) add(size int64) error {
+        g.entries++
+        g.bytes += size
+        switch {
+        case g.entries > g.maxEntries:
+                return fmt.Errorf("too many entries (max %d)", g.maxEntries)
+        case g.bytes > g.maxBytes:
+                return fmt.Errorf("archive expands to more than %d bytes", g.maxBytes)
+        case g.archiveSize > 0 && g.bytes > 1<<20 && g.bytes/g.archiveSize > g.maxRatio:
+                // tiny archives of text easily go past the ratio, ignore them
+                return fmt.Errorf("compression ratio above %d, refusing (zip bomb?)", g.maxRatio)
+        }
+        return nil
+}
+
+// s3ReaderAt reads an object with ranged GETs, keeping the last block.
+type s3ReaderAt struct {
+        ctx         context.Context
+        p           *proxy
+        bucket, key string
+        size        int64
+
+        mu    sync.Mutex
+        off   int64
+        block []byte
+}
+
+func (s *s3ReaderAt) ReadAt(b []byte, off int64) (int, error) {
+        if off >= s.size {
+                return 0, io.EOF
+        }
+        n := 0
+        for n < len(b) && off < s.size {
+                chunk, err := s.blockAt(off)
+                if err != nil {
+                        return n, err
+                }
+                c := copy(b[n:], chunk)
+                n += c
+                off += int64(c)
+        }
+        if n < len(b) {
+                return n, io.EOF
+        }
+        return n, nil
+}
+
+// blockAt returns the cached bytes starting at off, fetching a new block if needed.
+func (s *s3ReaderAt) blockAt(off int64) ([]byte, error) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if off >= s.off && off < s.off+int64(len(s.block)) {
+                return s.block[off-s.off:], nil
+        }
+        end := min(off+extractBlockSize, s.size) - 1
+        req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.p.buildObjectURL(s.bucket, s.key, nil), nil)
+        if err != nil {
+                return nil, err
+        }
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
+        resp, err := s.p.signAndDo(s.ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusPartialContent {
+                return nil, parseS3Error("range get", resp)
+        }
+        b, err := io.ReadAll(io.LimitReader(resp.Body, end-off+1))
+        if err != nil {
+                return nil, err
+        }
+        if len(b) == 0 {
+                return nil, io.ErrUnexpectedEOF
+        }
+        s.off, s.block = off, b
+        return b, nil
+}
+
+// objectSize HEADs key.
+func (p *proxy) objectSize(ctx context.Context, bucket, key string) (int64, error) {
+        req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.buildObjectURL(bucket, key, nil), nil)
+        if err != nil {
+                return 0, err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return 0, err
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return 0, s3ErrorFromBody("head", resp.StatusCode, nil)
+        }
+        return resp.ContentLength, nil
+}
+
+// extractArchive unpacks the archive at key under dst. Entries that cannot be
+// written are reported as failures; exceeding a guard aborts the whole run.
+func (p *proxy) extractArchive(ctx context.Context, bucket, key, dst string, progress func(total, done int)) ([]keyFailure, error) {
+        format := archiveFormat(key)
+        if format == "" {
+                return nil, fmt.Errorf("unsupported archive: %s", key)
+        }
+        dst = normPrefix(dst)
+        size, err := p.objectSize(ctx, bucket, key)
+        if err != nil {
+                return nil, err
+        }
+        g := &extractGuard{
+                maxBytes:    int64(p.cfg.ExtractMaxBytes),
+                maxEntries:  int64(p.cfg.ExtractMaxEntries),
+                maxRatio:    int64(p.cfg.ExtractMaxRatio),
+                archiveSize: size,
+        }
+        if progress == nil {
+                progress = func(int, int) {}
+        }
+
+        var failed []keyFailure
+        put := func(name string, r io.Reader, n int64) {
+                rel, ok := safeEntryName(name)
+                if !ok {
+                        failed = append(failed, keyFailure{Key: name, Error: "unsafe path"})
+                        return
+                }
+                ct := mime.TypeByExtension(path.Ext(rel))
+                if err := p.putObject(ctx, bucket, dst+rel, r, n, ct); err != nil {
+                        failed = append(failed, keyFailure{Key: name, Error: err.Error()})
+                }
+        }
+
+        if format == "zip" {
+                zr, err := zip.NewReader(&s3ReaderAt{ctx: ctx, p: p, bucket: bucket, key: key, size: size}, size)
+                if err != nil {
+                        return nil, err
+                }
+                var files []*zip.File
+                for _, f := range zr.File {
+                        if !f.Mode().IsDir() {
+                                files = append(files, f)
+                        }
+                }
+                // check the whole archive up front from the central directory
+                pre := *g
+                for _, f := range files {
+                        if err := pre.add(int64(f.UncompressedSize64)); err != nil {
+                                return nil, err
+                        }
+                }
+                for i, f := range files {
+                        progress(len(files), i)
+                        if err := ctx.Err(); err != nil {
+                                return failed, err
+                        }
+                        if !f.Mode().IsRegular() {
+                                failed = append(failed, keyFailure{Key: f.Name, Error: "not a regular file"})
+                                continue
+                        }
+                        n := int64(f.UncompressedSize64)
+                        if err := g.add(n); err != nil {
+                                return failed, err
+                        }
+                        rc, err := f.Open()
+                        if err != nil {
+                                failed = append(failed, keyFailure{Key: f.Name, Error: err.Error()})
+                                continue
+                        }
+                        // the zip reader fails on a size mismatch, LimitReader makes
+                        // sure we never read past what the header announced
+                        put(f.Name, io.LimitReader(rc, n), n)
+                        rc.Close()
+                }
+                progress(len(files), len(files))
+                return failed, nil
+        }
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildObjectURL(bucket, key, nil), nil)
+        if err != nil {
+                return nil, err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return nil, parseS3Error("get", resp)
+        }
+        var body io.Reader = resp.Body
+        if format == "tar.gz" {
+                zr, err := gzip.NewReader(resp.Body)
+                if err != nil {
+                        return nil, err
+                }
+                defer zr.Close()
+                body = zr
+        }
+        tr := tar.NewReader(body)
+        done := 0
+        for {
+                hdr, err := tr.Next()
+                if errors.Is(err, io.EOF) {
+                        break
+                }
+                if err != nil {
+                        return failed, err
+                }
+                switch hdr.Typeflag {
+                case tar.TypeDir, tar.TypeXGlobalHeader:
+                        continue
+                case tar.TypeReg:
+                default:
+                        failed = append(failed, keyFailure{Key: hdr.Name, Error: "not a regular file"})
+                        continue
+                }
+                // tar has no index: the total grows as entries show up
+                progress(done+1, done)
+                if err := g.add(hdr.Size); err != nil {
+                        return failed, err
+                }
+                put(hdr.Name, tr, hdr.Size)
+                done++
+        }
+        progress(done, done)
+        return failed, ctx.Err()
+}
+
+func (p *proxy) handleExtract(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req extractRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        key := srcToPath(req.Key)
+        if archiveFormat(key) == "" {
+                httpError(w, "key must be a .zip, .tar, .tar.gz or .tgz", http.StatusBadRequest)
+                return
+        }
+        ae := auditOp(r, jobExtract, bucket, key, normPrefix(req.Dst))
+        if !p.authorizeKey(w, r, actRead, bucket, key) || !p.authorizeKey(w, r, actWrite, bucket, normPrefix(req.Dst)) {
+                return
+        }
+
+        j := &job{Type: jobExtract, Bucket: bucket, Src: key, Dst: normPrefix(req.Dst), User: principalFrom(r).User}
+        p.jobs.submit(j)
+        ae.Job = j.ID
+        out, _ := p.jobs.get(j.ID)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", prefixed(r, "/api/jobs?id="+j.ID))
+        w.WriteHeader(http.StatusAccepted)
+        _ = json.NewEncoder(w).Encode(out)
+}
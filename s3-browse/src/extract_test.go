@@ -0,0 +1,86 @@
+package main
+
+import (
+        "strings"
+        "testing"
+)
+
+func TestSafeEntryName(t *testing.T) {
+        tests := []struct {
+                in, want string
+                ok       bool
+        }{
+                {"a.txt", "a.txt", true},
+                {"dir/a.txt", "dir/a.txt", true},
+                {"./dir//a.txt", "dir/a.txt", true},
+                {"dir/../a.txt", "a.txt", true},
+                {`dir\sub\a.txt`, "dir/sub/a.txt", true},
+                {"dir/", "dir", true},
+                {"ab:c", "ab:c", true},
+                {"", "", false},
+                {".", "", false},
+                {"..", "", false},
+                {"../a.txt", "", false},
+                {"dir/../../a.txt", "", false},
+                {`..\a.txt`, "", false},
+                {`dir\..\..\a.txt`, "", false},
+                {"/etc/passwd", "", false},
+                {`\etc\passwd`, "", false},
+                {"C:", "", false},
+                {"C:/Windows/a.txt", "", false},
+                {`C:\Windows\a.txt`, "", false},
+                {"c:a.txt", "", false},
+                {"a\x00.txt", "", false},
+        }
+        for _, tt := range tests {
+                got, ok := safeEntryName(tt.in)
+                if got != tt.want || ok != tt.ok {
+                        t.Errorf("safeEntryName(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+                }
+        }
+}
+
+func TestExtractGuard(t *testing.T) {
+        const mb = 1 << 20
+        tests := []struct {
+                name    string
+                guard   extractGuard
+                sizes   []int64
+                failAt  int    // index of the add that fails, -1 for none
+                message string // in its error
+        }{
+                {"within limits", extractGuard{maxBytes: 10 * mb, maxEntries: 3, maxRatio: 100, archiveSize: mb},
+                        []int64{mb, mb, mb}, -1, ""},
+                {"entries", extractGuard{maxBytes: 10 * mb, maxEntries: 2, maxRatio: 100, archiveSize: mb},
+                        []int64{0, 0, 0}, 2, "too many entries"},
+                {"bytes", extractGuard{maxBytes: 10 * mb, maxEntries: 100, maxRatio: 100, archiveSize: mb},
+                        []int64{6 * mb, 4 * mb, 1}, 2, "more than"},
+                {"ratio", extractGuard{maxBytes: 1 << 40, maxEntries: 100, maxRatio: 200, archiveSize: 10000},
+                        []int64{mb, mb, 1}, 1, "compression ratio"},
+                {"ratio ignored below 1 MiB", extractGuard{maxBytes: 1 << 40, maxEntries: 100, maxRatio: 2, archiveSize: 100},
+                        []int64{mb / 2, mb / 2}, -1, ""},
+                {"ratio without archive size", extractGuard{maxBytes: 1 << 40, maxEntries: 100, maxRatio: 2},
+                        []int64{10 * mb}, -1, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        g := tt.guard
+                        for i, n := range tt.sizes {
+                                err := g.add(n)
+                                if i != tt.failAt {
+                                        if err != nil {
+                                                t.Fatalf("add #%d (%d): %v", i, n, err)
+                                        }
+                                        continue
+                                }
+                                if err == nil || !strings.Contains(err.Error(), tt.message) {
+                                        t.Fatalf("add #%d (%d) = %v, want an error about %q", i, n, err, tt.message)
+                                }
+                                return
+                        }
+                        if tt.failAt >= 0 {
+                                t.Fatalf("no add failed, want #%d to", tt.failAt)
+                        }
+                })
+        }
+}
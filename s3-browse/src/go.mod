@@ -2,4 +2,27 @@ module garage-s3-proxy
 
 go 1.22
 
-require github.com/aws/aws-sdk-go-v2 v1.30.0
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/aws/aws-sdk-go-v2 v1.30.0
+	github.com/coreos/go-oidc/v3 v3.11.0
+	github.com/prometheus/client_golang v1.19.1
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.26.0
+	golang.org/x/image v0.20.0
+	golang.org/x/oauth2 v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/aws/smithy-go v1.20.2 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/go-jose/go-jose/v4 v4.0.2 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
@@ -0,0 +1,489 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/binary"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log"
+        "os"
+        "path/filepath"
+        "sync"
+        "time"
+
+        bolt "go.etcd.io/bbolt"
+)
+
+/* ===== Key index: local copy of the bucket listings (bbolt) ===== */
+
+// keyIndex keeps key, size, mtime and ETag of every object of the indexed
+// buckets in STATE_DIR/index.db, so that stats, folder sizes and search never
+// have to list S3. A refresh walks ListObjectsV2 page by page and merges each
+// page as it arrives; keys not seen by a complete walk are dropped. Writes
+// made through the proxy are applied right away in between.
+//
+// The file survives restarts: a bucket walked less than INDEX_REFRESH ago is
+// served at once and only walked again when its refresh is due.
+type keyIndex struct {
+        p       *proxy
+        refresh time.Duration
+        db      *bolt.DB // nil when the file could not be opened
+
+        mu      sync.Mutex
+        buckets map[string]*bucketIndex
+}
+
+// bucketIndex is the state of one bucket; the exported part is saved in the
+// meta bucket of the file along with the objects.
+type bucketIndex struct {
+        Gen       uint64    `json:"gen"`
+        Keys      int       `json:"keys"`
+        IndexedAt time.Time `json:"indexedAt"` // end of the last complete walk
+
+        started  bool
+        indexing bool
+        err      string
+}
+
+type indexStatus struct {
+        Keys      int        `json:"keys"`
+        Indexing  bool       `json:"indexing"`
+        IndexedAt *time.Time `json:"indexedAt,omitempty"`
+        Error     string     `json:"error,omitempty"`
+}
+
+var (
+        bktMeta    = []byte("meta")    // bucket name -> bucketIndex (JSON)
+        bktObjects = []byte("objects") // one nested bucket per S3 bucket: key -> indexEntry
+)
+
+// indexEntry is stored as size, mtime (unix ns) and generation, three
+// big-endian uint64, followed by the ETag.
+type indexEntry struct {
+        Size         int64
+        LastModified time.Time
+        ETag         string
+        gen          uint64
+}
+
+func (e indexEntry) marshal() []byte {
+        b := make([]byte, 24+len(e.ETag))
+        binary.BigEndian.PutUint64(b, uint64(e.Size))
+        binary.BigEndian.PutUint64(b[8:], uint64(e.LastModified.UnixNano()))
+        binary.BigEndian.PutUint64(b[16:], e.gen)
+        copy(b[24:], e.ETag)
+        return b
+}
+
+func unmarshalEntry(b []byte) (indexEntry, bool) {
+        if len(b) < 24 {
+                return indexEntry{}, false
+        }
+        return indexEntry{
+                Size:         int64(binary.BigEndian.Uint64(b)),
+                LastModified: time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))).UTC(),
+                gen:          binary.BigEndian.Uint64(b[16:]),
+                ETag:         string(b[24:]),
+        }, true
+}
+
+func newKeyIndex(p *proxy) *keyIndex {
+        ix := &keyIndex{p: p, refresh: p.cfg.IndexRefresh, buckets: map[string]*bucketIndex{}}
+        db, err := openIndexDB(p.cfg.StateDir)
+        if err != nil {
+                log.Printf("index: %v (search and instant stats disabled)", err)
+                return ix
+        }
+        err = db.Update(func(tx *bolt.Tx) error {
+                if _, err := tx.CreateBucketIfNotExists(bktObjects); err != nil {
+                        return err
+                }
+                meta, err := tx.CreateBucketIfNotExists(bktMeta)
+                if err != nil {
+                        return err
+                }
+                return meta.ForEach(func(k, v []byte) error {
+                        b := &bucketIndex{}
+                        if err := json.Unmarshal(v, b); err != nil {
+                                return fmt.Errorf("meta %s: %w", k, err)
+                        }
+                        ix.buckets[string(k)] = b
+                        return nil
+                })
+        })
+        if err != nil {
+                log.Printf("index: %v (search and instant stats disabled)", err)
+                db.Close()
+                return ix
+        }
+        ix.db = db
+        return ix
+}
+
+// openIndexDB opens STATE_DIR/index.db, or a throwaway file when there is no
+// state dir. The index is only a cache: a file that cannot be read is
+// dropped and rebuilt.
+func openIndexDB(dir string) (*bolt.DB, error) {
+        if dir == "" {
+                if err := os.MkdirAll(os.TempDir(), 0o777|os.ModeSticky); err != nil {
+                        return nil, err
+                }
+                tmp, err := os.MkdirTemp("", "s3-browse-index-")
+                if err != nil {
+                        return nil, err
+                }
+                dir = tmp
+        } else if err := os.MkdirAll(dir, 0o755); err != nil {
+                return nil, err
+        }
+        file := filepath.Join(dir, "index.db")
+        // the writes made through the proxy are not worth an fsync each: a lost
+        // tail is caught up by the next walk
+        opts := &bolt.Options{Timeout: time.Second, NoSync: true}
+        db, err := bolt.Open(file, 0o644, opts)
+        if err != nil && !errors.Is(err, bolt.ErrTimeout) {
+                log.Printf("index: %v, rebuilding %s", err, file)
+                if rerr := os.Remove(file); rerr != nil {
+                        return nil, err
+                }
+                db, err = bolt.Open(file, 0o644, opts)
+        }
+        return db, err
+}
+
+// ensure starts indexing bucket (and refreshing it every INDEX_REFRESH) the
+// first time it is asked for.
+func (ix *keyIndex) ensure(bucket string) {
+        if ix.db == nil {
+                return
+        }
+        ix.mu.Lock()
+        b, ok := ix.buckets[bucket]
+        if !ok {
+                b = &bucketIndex{indexing: true}
+                ix.buckets[bucket] = b
+        }
+        start := !b.started
+        b.started = true
+        var wait time.Duration
+        if !b.IndexedAt.IsZero() {
+                wait = ix.refresh - time.Since(b.IndexedAt)
+        }
+        ix.mu.Unlock()
+        if start {
+                go ix.loop(bucket, wait)
+        }
+}
+
+func (ix *keyIndex) loop(bucket string, wait time.Duration) {
+        for {
+                if wait > 0 {
+                        time.Sleep(wait)
+                }
+                if err := ix.walk(context.Background(), bucket); err != nil {
+                        log.Printf("index %s: %v", bucket, err)
+                }
+                wait = ix.refresh
+        }
+}
+
+// update runs fn on the objects of an indexed bucket in a write transaction,
+// with ix.mu held, and saves the bucket state with it. Buckets that are not
+// indexed are left alone.
+func (ix *keyIndex) update(bucket string, fn func(objs *bolt.Bucket, b *bucketIndex) error) error {
+        if ix.db == nil {
+                return nil
+        }
+        return ix.db.Update(func(tx *bolt.Tx) error {
+                ix.mu.Lock()
+                defer ix.mu.Unlock()
+                b, ok := ix.buckets[bucket]
+                if !ok {
+                        return nil
+                }
+                objs, err := tx.Bucket(bktObjects).CreateBucketIfNotExists([]byte(bucket))
+                if err != nil {
+                        return err
+                }
+                if err := fn(objs, b); err != nil {
+                        return err
+                }
+                meta, err := json.Marshal(b)
+                if err != nil {
+                        return err
+                }
+                return tx.Bucket(bktMeta).Put([]byte(bucket), meta)
+        })
+}
+
+// putEntry stores e under key, keeping the key count up to date.
+func putEntry(objs *bolt.Bucket, b *bucketIndex, key string, e indexEntry) error {
+        k := []byte(key)
+        if objs.Get(k) == nil {
+                b.Keys++
+        }
+        return objs.Put(k, e.marshal())
+}
+
+func deleteEntry(objs *bolt.Bucket, b *bucketIndex, key []byte) error {
+        if objs.Get(key) == nil {
+                return nil
+        }
+        b.Keys--
+        return objs.Delete(key)
+}
+
+// walk re-lists the whole bucket into the index.
+func (ix *keyIndex) walk(ctx context.Context, bucket string) error {
+        var gen uint64
+        err := ix.update(bucket, func(_ *bolt.Bucket, b *bucketIndex) error {
+                b.Gen++
+                b.indexing = true
+                gen = b.Gen
+                return nil
+        })
+        if err == nil {
+                var werr error
+                err = ix.p.walkObjects(ctx, bucket, "", func(page []objectInfo) {
+                        if werr != nil {
+                                return
+                        }
+                        werr = ix.update(bucket, func(objs *bolt.Bucket, b *bucketIndex) error {
+                                for _, o := range page {
+                                        e := indexEntry{Size: o.Size, LastModified: o.LastModified, ETag: o.ETag, gen: gen}
+                                        if err := putEntry(objs, b, o.Key, e); err != nil {
+                                                return err
+                                        }
+                                }
+                                return nil
+                        })
+                })
+                if err == nil {
+                        err = werr
+                }
+        }
+        if err == nil {
+                err = ix.sweep(bucket, gen)
+        }
+
+        ix.mu.Lock()
+        defer ix.mu.Unlock()
+        b := ix.buckets[bucket]
+        b.indexing = false
+        if err != nil {
+                b.err = err.Error()
+                return err
+        }
+        b.err = ""
+        return nil
+}
+
+// sweep drops the keys that the walk of generation gen did not see and marks
+// the bucket as complete.
+func (ix *keyIndex) sweep(bucket string, gen uint64) error {
+        var stale [][]byte
+        err := ix.db.View(func(tx *bolt.Tx) error {
+                objs := tx.Bucket(bktObjects).Bucket([]byte(bucket))
+                if objs == nil {
+                        return nil
+                }
+                return objs.ForEach(func(k, v []byte) error {
+                        if e, ok := unmarshalEntry(v); !ok || e.gen < gen {
+                                stale = append(stale, bytes.Clone(k))
+                        }
+                        return nil
+                })
+        })
+        if err != nil {
+                return err
+        }
+        return ix.update(bucket, func(objs *bolt.Bucket, b *bucketIndex) error {
+                for _, k := range stale {
+                        // written through the proxy since the View above?
+                        if e, ok := unmarshalEntry(objs.Get(k)); ok && e.gen >= gen {
+                                continue
+                        }
+                        if err := deleteEntry(objs, b, k); err != nil {
+                                return err
+                        }
+                }
+                b.Keys = objs.Stats().KeyN
+                b.IndexedAt = time.Now().UTC()
+                return nil
+        })
+}
+
+func (ix *keyIndex) status(bucket string) indexStatus {
+        if ix.db == nil {
+                return indexStatus{Error: "index unavailable"}
+        }
+        ix.mu.Lock()
+        defer ix.mu.Unlock()
+        b, ok := ix.buckets[bucket]
+        if !ok {
+                return indexStatus{}
+        }
+        st := indexStatus{Keys: b.Keys, Indexing: b.indexing, Error: b.err}
+        if !b.IndexedAt.IsZero() {
+                t := b.IndexedAt
+                st.IndexedAt = &t
+        }
+        return st
+}
+
+// complete reports whether bucket has been walked to the end at least once,
+// and when.
+func (ix *keyIndex) complete(bucket string) (time.Time, bool) {
+        if ix.db == nil {
+                return time.Time{}, false
+        }
+        ix.mu.Lock()
+        defer ix.mu.Unlock()
+        b, ok := ix.buckets[bucket]
+        if !ok || b.IndexedAt.IsZero() {
+                return time.Time{}, false
+        }
+        return b.IndexedAt, true
+}
+
+// scan calls fn for each indexed object under prefix, in key order, until fn
+// returns false.
+func (ix *keyIndex) scan(bucket, prefix string, fn func(o objectInfo) bool) error {
+        if ix.db == nil {
+                return nil
+        }
+        return ix.db.View(func(tx *bolt.Tx) error {
+                objs := tx.Bucket(bktObjects).Bucket([]byte(bucket))
+                if objs == nil {
+                        return nil
+                }
+                c := objs.Cursor()
+                p := []byte(prefix)
+                for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+                        e, ok := unmarshalEntry(v)
+                        if !ok {
+                                continue
+                        }
+                        if !fn(objectInfo{Key: string(k), Size: e.Size, LastModified: e.LastModified, ETag: e.ETag}) {
+                                return nil
+                        }
+                }
+                return nil
+        })
+}
+
+// find returns the first limit indexed objects under prefix accepted by
+// match, in key order, and how many were accepted in all.
+func (ix *keyIndex) find(bucket, prefix string, limit int, match func(o objectInfo) bool) ([]objectInfo, int) {
+        var out []objectInfo
+        total := 0
+        if err := ix.scan(bucket, prefix, func(o objectInfo) bool {
+                if match(o) {
+                        if total < limit {
+                                out = append(out, o)
+                        }
+                        total++
+                }
+                return true
+        }); err != nil {
+                log.Printf("index %s: %v", bucket, err)
+        }
+        return out, total
+}
+
+// stats answers /api/stats from the index; false until bucket has been
+// completely walked.
+func (ix *keyIndex) stats(bucket, prefix string) (*statsResponse, bool) {
+        at, ok := ix.complete(bucket)
+        if !ok {
+                return nil, false
+        }
+        start := time.Now()
+        out := newStatsResponse(prefix)
+        err := ix.scan(bucket, prefix, func(o objectInfo) bool {
+                out.add(o)
+                return true
+        })
+        if err != nil {
+                log.Printf("index %s: %v", bucket, err)
+                return nil, false
+        }
+        out.finish(start)
+        out.Source = "index"
+        out.IndexedAt = &at
+        return out, true
+}
+
+// folderSize sums the sizes under prefix; false until bucket has been
+// completely walked.
+func (ix *keyIndex) folderSize(bucket, prefix string) (int64, bool) {
+        if _, ok := ix.complete(bucket); !ok {
+                return 0, false
+        }
+        var n int64
+        err := ix.scan(bucket, prefix, func(o objectInfo) bool {
+                n += o.Size
+                return true
+        })
+        return n, err == nil
+}
+
+/* Writes going through the proxy; ignored for buckets that are not indexed. */
+
+func (ix *keyIndex) note(bucket string, fn func(objs *bolt.Bucket, b *bucketIndex) error) {
+        if err := ix.update(bucket, fn); err != nil {
+                log.Printf("index %s: %v", bucket, err)
+        }
+}
+
+func (ix *keyIndex) notePut(bucket, key string, size int64, etag string) {
+        ix.note(bucket, func(objs *bolt.Bucket, b *bucketIndex) error {
+                e := indexEntry{Size: size, LastModified: time.Now().UTC(), ETag: etag, gen: b.Gen}
+                return putEntry(objs, b, key, e)
+        })
+}
+
+// noteUpload records a write whose size the proxy did not see, a chunked
+// PUT or a completed multipart upload, from a HEAD of key.
+func (ix *keyIndex) noteUpload(ctx context.Context, bucket, key string) {
+        ix.mu.Lock()
+        _, indexed := ix.buckets[bucket]
+        ix.mu.Unlock()
+        if ix.db == nil || !indexed {
+                return
+        }
+        m, err := ix.p.headObject(ctx, bucket, key)
+        if err != nil {
+                log.Printf("index %s: %s: %v", bucket, key, err)
+                return
+        }
+        ix.notePut(bucket, key, m.Size, m.ETag)
+}
+
+func (ix *keyIndex) noteCopy(bucket, src, dst string) {
+        ix.note(bucket, func(objs *bolt.Bucket, b *bucketIndex) error {
+                e, ok := unmarshalEntry(objs.Get([]byte(src)))
+                if !ok {
+                        return nil
+                }
+                e.LastModified = time.Now().UTC()
+                e.gen = b.Gen
+                return putEntry(objs, b, dst, e)
+        })
+}
+
+func (ix *keyIndex) noteDelete(bucket string, keys ...string) {
+        if len(keys) == 0 {
+                return
+        }
+        ix.note(bucket, func(objs *bolt.Bucket, b *bucketIndex) error {
+                for _, k := range keys {
+                        if err := deleteEntry(objs, b, []byte(k)); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+}
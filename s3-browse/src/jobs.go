@@ -0,0 +1,466 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "path/filepath"
+        "sort"
+        "sync"
+        "time"
+)
+
+/* ===== Background jobs: /api/jobs ===== */
+
+const (
+        jobRename       = "rename"
+        jobDeletePrefix = "delete-prefix"
+        jobStats        = "stats"
+        jobExtract      = "extract" // submitted through /api/extract
+)
+
+const (
+        jobQueued   = "queued"
+        jobRunning  = "running"
+        jobDone     = "done"
+        jobFailed   = "failed"
+        jobCanceled = "canceled"
+)
+
+// Only the first failures are kept on the job; FailedCount has the total.
+const maxJobFailures = 100
+
+type jobRequest struct {
+        Type   string `json:"type"`
+        Src    string `json:"src,omitempty"`    // rename
+        Dst    string `json:"dst,omitempty"`    // rename
+        Prefix string `json:"prefix,omitempty"` // delete-prefix, stats
+}
+
+type job struct {
+        ID     string `json:"id"`
+        Type   string `json:"type"`
+        Bucket string `json:"bucket"`
+        Src    string `json:"src,omitempty"`
+        Dst    string `json:"dst,omitempty"`
+        Prefix string `json:"prefix,omitempty"`
+        User   string `json:"user,omitempty"` // who submitted it
+
+        Status      string         `json:"status"`
+        Total       int            `json:"total"`
+        Done        int            `json:"done"`
+        FailedCount int            `json:"failedCount,omitempty"`
+        Failed      []keyFailure   `json:"failed,omitempty"`
+        Error       string         `json:"error,omitempty"`
+        Stats       *statsResponse `json:"stats,omitempty"`
+
+        CreatedAt  time.Time  `json:"createdAt"`
+        StartedAt  *time.Time `json:"startedAt,omitempty"`
+        FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (j *job) finished() bool {
+        return j.Status == jobDone || j.Status == jobFailed || j.Status == jobCanceled
+}
+
+// jobManager runs bulk operations detached from the HTTP request, at most
+// JOBS_CONCURRENCY at a time, and keeps their state in STATE_DIR/jobs.json.
+type jobManager struct {
+        p         *proxy
+        file      string
+        retention time.Duration
+        sem       chan struct{}
+
+        mu      sync.Mutex
+        jobs    map[string]*job
+        cancels map[string]context.CancelFunc
+        dirty   bool
+}
+
+func newJobManager(p *proxy) *jobManager {
+        m := &jobManager{
+                p:         p,
+                retention: p.cfg.JobsRetention,
+                sem:       make(chan struct{}, p.cfg.JobsConcurrency),
+                jobs:      map[string]*job{},
+                cancels:   map[string]context.CancelFunc{},
+        }
+        if p.cfg.StateDir != "" {
+                if err := os.MkdirAll(p.cfg.StateDir, 0o755); err != nil {
+                        log.Printf("jobs: state dir: %v (jobs will not survive a restart)", err)
+                } else {
+                        m.file = filepath.Join(p.cfg.StateDir, "jobs.json")
+                }
+        }
+        m.load()
+        go m.loop()
+        return m
+}
+
+// load reads the state file and resumes the jobs that were interrupted.
+func (m *jobManager) load() {
+        if m.file == "" {
+                return
+        }
+        b, err := os.ReadFile(m.file)
+        if err != nil {
+                if !errors.Is(err, os.ErrNotExist) {
+                        log.Printf("jobs: %v", err)
+                }
+                return
+        }
+        var jobs []*job
+        if err := json.Unmarshal(b, &jobs); err != nil {
+                log.Printf("jobs: %s: %v", m.file, err)
+                return
+        }
+        for _, j := range jobs {
+                m.jobs[j.ID] = j
+                if !j.finished() {
+                        log.Printf("jobs: resuming %s %s (%d/%d)", j.ID, j.Type, j.Done, j.Total)
+                        j.Status = jobQueued
+                        m.start(j)
+                }
+        }
+}
+
+// save writes every job to the state file (tmp + rename).
+func (m *jobManager) save() {
+        m.mu.Lock()
+        if !m.dirty || m.file == "" {
+                m.mu.Unlock()
+                return
+        }
+        m.dirty = false
+        b, err := json.Marshal(m.snapshot())
+        m.mu.Unlock()
+        if err != nil {
+                log.Printf("jobs: %v", err)
+                return
+        }
+        tmp := m.file + ".tmp"
+        if err := os.WriteFile(tmp, b, 0o644); err != nil {
+                log.Printf("jobs: %v", err)
+                return
+        }
+        if err := os.Rename(tmp, m.file); err != nil {
+                log.Printf("jobs: %v", err)
+        }
+}
+
+// loop flushes the state file at most once per second and drops finished
+// jobs older than JOBS_RETENTION.
+func (m *jobManager) loop() {
+        t := time.NewTicker(time.Second)
+        defer t.Stop()
+        for range t.C {
+                m.mu.Lock()
+                for id, j := range m.jobs {
+                        if j.finished() && j.FinishedAt != nil && time.Since(*j.FinishedAt) > m.retention {
+                                delete(m.jobs, id)
+                                m.dirty = true
+                        }
+                }
+                m.mu.Unlock()
+                m.save()
+        }
+}
+
+// snapshot copies all jobs, newest first. Caller holds m.mu.
+func (m *jobManager) snapshot() []job {
+        out := make([]job, 0, len(m.jobs))
+        for _, j := range m.jobs {
+                c := *j
+                c.Failed = append([]keyFailure(nil), j.Failed...)
+                out = append(out, c)
+        }
+        sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.After(out[k].CreatedAt) })
+        return out
+}
+
+func (m *jobManager) get(id string) (job, bool) {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        j, ok := m.jobs[id]
+        if !ok {
+                return job{}, false
+        }
+        c := *j
+        c.Failed = append([]keyFailure(nil), j.Failed...)
+        return c, true
+}
+
+func (m *jobManager) submit(j *job) {
+        b := make([]byte, 8)
+        _, _ = rand.Read(b)
+        j.ID = hex.EncodeToString(b)
+        j.Status = jobQueued
+        j.CreatedAt = time.Now().UTC()
+
+        m.mu.Lock()
+        m.jobs[j.ID] = j
+        m.dirty = true
+        m.mu.Unlock()
+        m.start(j)
+}
+
+func (m *jobManager) cancel(id string) (job, error) {
+        m.mu.Lock()
+        j, ok := m.jobs[id]
+        if !ok {
+                m.mu.Unlock()
+                return job{}, errJobNotFound
+        }
+        if j.finished() {
+                m.mu.Unlock()
+                return job{}, errJobFinished
+        }
+        if c := m.cancels[id]; c != nil {
+                c()
+        }
+        m.mu.Unlock()
+        j2, _ := m.get(id)
+        return j2, nil
+}
+
+var (
+        errJobNotFound = errors.New("job not found")
+        errJobFinished = errors.New("job already finished")
+
+        // A folder is not renamed into itself or a subfolder, nor the
+        // reverse: the moved keys would land under the listed prefix, be
+        // moved again on a resume, or overwrite keys not moved yet.
+        errNestedRename = errors.New("src and dst must not be the same folder nor one inside the other")
+)
+
+// update applies fn to the job under the lock and marks the state dirty.
+func (m *jobManager) update(j *job, fn func(j *job)) {
+        m.mu.Lock()
+        fn(j)
+        m.dirty = true
+        m.mu.Unlock()
+}
+
+func (m *jobManager) addFailures(j *job, failed []keyFailure) {
+        if len(failed) == 0 {
+                return
+        }
+        m.update(j, func(j *job) {
+                j.FailedCount += len(failed)
+                if room := maxJobFailures - len(j.Failed); room > 0 {
+                        j.Failed = append(j.Failed, failed[:min(room, len(failed))]...)
+                }
+        })
+}
+
+func (m *jobManager) start(j *job) {
+        // upstream requests of the job carry job-<id> as their request ID
+        ctx, cancel := context.WithCancel(withRequestInfo(context.Background(), &requestInfo{ID: "job-" + j.ID, User: j.User}))
+        m.mu.Lock()
+        m.cancels[j.ID] = cancel
+        m.mu.Unlock()
+
+        go func() {
+                defer func() {
+                        cancel()
+                        m.mu.Lock()
+                        delete(m.cancels, j.ID)
+                        m.mu.Unlock()
+                }()
+
+                select {
+                case m.sem <- struct{}{}:
+                        defer func() { <-m.sem }()
+                case <-ctx.Done():
+                        m.finish(j, ctx.Err())
+                        return
+                }
+                now := time.Now().UTC()
+                m.update(j, func(j *job) {
+                        j.Status = jobRunning
+                        j.StartedAt = &now
+                })
+                m.finish(j, m.run(ctx, j))
+        }()
+}
+
+func (m *jobManager) finish(j *job, err error) {
+        now := time.Now().UTC()
+        m.update(j, func(j *job) {
+                j.FinishedAt = &now
+                switch {
+                case errors.Is(err, context.Canceled):
+                        j.Status = jobCanceled
+                case err != nil:
+                        j.Status = jobFailed
+                        j.Error = err.Error()
+                default:
+                        j.Status = jobDone
+                }
+        })
+        c, _ := m.get(j.ID)
+        m.p.auditJob(&c)
+}
+
+// run executes the operation. Keys handled before a restart are not listed
+// again (they were moved or deleted), so progress resumes from j.Done.
+func (m *jobManager) run(ctx context.Context, j *job) error {
+        if !m.p.bucketAllowed(j.Bucket) {
+                return errBucketNotAllowed
+        }
+        offset := j.Done
+        progress := func(total, done int) {
+                m.update(j, func(j *job) {
+                        j.Total = offset + total
+                        j.Done = offset + done
+                })
+        }
+
+        switch j.Type {
+        case jobRename:
+                if overlaps(normPrefix(j.Src), normPrefix(j.Dst)) {
+                        return errNestedRename // submitted before it was refused
+                }
+                _, failed, err := m.p.renamePrefix(ctx, j.Bucket, j.Src, j.Dst, progress)
+                m.addFailures(j, failed)
+                if err != nil {
+                        return err
+                }
+        case jobDeletePrefix:
+                _, failed, err := m.p.deletePrefix(ctx, j.Bucket, j.Prefix, progress)
+                m.addFailures(j, failed)
+                if err != nil {
+                        return err
+                }
+        case jobStats:
+                // nothing was changed, start over
+                m.update(j, func(j *job) { j.Total, j.Done = 0, 0 })
+                st, err := m.p.computeStats(ctx, j.Bucket, j.Prefix, func(scanned int) {
+                        m.update(j, func(j *job) { j.Total, j.Done = scanned, scanned })
+                })
+                if err != nil {
+                        return err
+                }
+                m.update(j, func(j *job) { j.Stats = st })
+        case jobExtract:
+                // entries are overwritten, extracting again from the start is harmless
+                m.update(j, func(j *job) { j.Total, j.Done = 0, 0 })
+                offset = 0
+                failed, err := m.p.extractArchive(ctx, j.Bucket, j.Src, j.Dst, progress)
+                m.addFailures(j, failed)
+                if err != nil {
+                        return err
+                }
+        default:
+                return fmt.Errorf("unknown job type %q", j.Type)
+        }
+        return ctx.Err()
+}
+
+func (p *proxy) handleJobs(w http.ResponseWriter, r *http.Request) {
+        id := r.URL.Query().Get("id")
+        switch r.Method {
+        case http.MethodGet:
+                var out any
+                if id == "" {
+                        p.jobs.mu.Lock()
+                        all := p.jobs.snapshot()
+                        p.jobs.mu.Unlock()
+                        mine := all[:0]
+                        for _, j := range all {
+                                if p.jobVisible(r, j) {
+                                        mine = append(mine, j)
+                                }
+                        }
+                        out = mine
+                } else {
+                        j, ok := p.jobs.get(id)
+                        if !ok || !p.jobVisible(r, j) {
+                                httpError(w, errJobNotFound.Error(), http.StatusNotFound)
+                                return
+                        }
+                        out = j
+                }
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(out)
+
+        case http.MethodPost:
+                bucket, err := p.queryBucket(r)
+                if err != nil {
+                        pathError(w, err)
+                        return
+                }
+                var req jobRequest
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        httpError(w, "bad json", http.StatusBadRequest)
+                        return
+                }
+                j := &job{Type: req.Type, Bucket: bucket, User: principalFrom(r).User}
+                ae := &auditEntry{}
+                switch req.Type {
+                case jobRename:
+                        src, dst := normPrefix(req.Src), normPrefix(req.Dst)
+                        if overlaps(src, dst) {
+                                httpError(w, errNestedRename.Error(), http.StatusBadRequest)
+                                return
+                        }
+                        ae = auditOp(r, jobRename, bucket, src, dst)
+                        if !p.authorizeMove(w, r, bucket, src, dst) {
+                                return
+                        }
+                        j.Src, j.Dst = src, dst
+                case jobDeletePrefix, jobStats:
+                        action := actDelete
+                        if req.Type == jobStats {
+                                action = actRead
+                        } else {
+                                ae = auditOp(r, jobDeletePrefix, bucket, normPrefix(req.Prefix))
+                        }
+                        if !p.authorizeKey(w, r, action, bucket, normPrefix(req.Prefix)) {
+                                return
+                        }
+                        j.Prefix = normPrefix(req.Prefix)
+                default:
+                        httpError(w, "type must be rename, delete-prefix or stats", http.StatusBadRequest)
+                        return
+                }
+                p.jobs.submit(j)
+                ae.Job = j.ID
+                out, _ := p.jobs.get(j.ID)
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusAccepted)
+                _ = json.NewEncoder(w).Encode(out)
+
+        case http.MethodDelete:
+                if j, ok := p.jobs.get(id); ok && !p.jobVisible(r, j) {
+                        httpError(w, errJobNotFound.Error(), http.StatusNotFound)
+                        return
+                }
+                out, err := p.jobs.cancel(id)
+                switch {
+                case errors.Is(err, errJobNotFound):
+                        httpError(w, err.Error(), http.StatusNotFound)
+                        return
+                case err != nil:
+                        httpError(w, err.Error(), http.StatusConflict)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusAccepted)
+                _ = json.NewEncoder(w).Encode(out)
+
+        default:
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// jobVisible hides the jobs of other users once a policy is in force.
+func (p *proxy) jobVisible(r *http.Request, j job) bool {
+        return p.policy == nil || j.User == "" || j.User == principalFrom(r).User
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+        "context"
+        "crypto/rand"
+        "encoding/hex"
+        "fmt"
+        "io"
+        "log"
+        "log/slog"
+        "net/http"
+        "os"
+        "strings"
+        "time"
+)
+
+/* ===== Logging: slog access log and request IDs ===== */
+
+const requestIDHeader = "X-Request-Id"
+
+// requestInfo follows a request through the middlewares; withAuth fills in
+// the user once it knows it.
+type requestInfo struct {
+        ID     string
+        User   string
+        Prefix string          // public path prefix, see withBasePath
+        body   *countingReader // the request body, nil when there is none
+}
+
+type requestInfoCtxKey struct{}
+
+func withRequestInfo(ctx context.Context, ri *requestInfo) context.Context {
+        return context.WithValue(ctx, requestInfoCtxKey{}, ri)
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+        ri, _ := ctx.Value(requestInfoCtxKey{}).(*requestInfo)
+        return ri
+}
+
+type countingReader struct {
+        io.ReadCloser
+        n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+        n, err := c.ReadCloser.Read(b)
+        c.n += int64(n)
+        return n, err
+}
+
+// bytesIn is the size of the request body read so far. The body is counted
+// once, by withRequestLog, for the log, the metrics and the audit.
+func (ri *requestInfo) bytesIn() int64 {
+        if ri == nil || ri.body == nil {
+                return 0
+        }
+        return ri.body.n
+}
+
+// requestID is the ID of the request ctx belongs to, "" outside of one.
+func requestID(ctx context.Context) string {
+        if ri := requestInfoFrom(ctx); ri != nil {
+                return ri.ID
+        }
+        return ""
+}
+
+func newRequestID() string {
+        b := make([]byte, 8)
+        _, _ = rand.Read(b)
+        return hex.EncodeToString(b)
+}
+
+// validRequestID accepts a client supplied X-Request-Id if it is short and
+// cannot mess up a log line or a header.
+func validRequestID(id string) bool {
+        if id == "" || len(id) > 128 {
+                return false
+        }
+        for _, c := range id {
+                switch {
+                case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-_.:", c):
+                default:
+                        return false
+                }
+        }
+        return true
+}
+
+// setupLogging installs the slog handler chosen by LOG_FORMAT and LOG_LEVEL;
+// the log.Printf calls go through it too.
+func setupLogging(c cfg) {
+        var level slog.Level
+        if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+                log.Fatalf("invalid env LOG_LEVEL: %q (debug, info, warn or error)", c.LogLevel)
+        }
+        opts := &slog.HandlerOptions{Level: level}
+        var h slog.Handler
+        switch c.LogFormat {
+        case "text":
+                h = slog.NewTextHandler(os.Stderr, opts)
+        case "json":
+                h = slog.NewJSONHandler(os.Stderr, opts)
+        default:
+                log.Fatalf("invalid env LOG_FORMAT: %q (text or json)", c.LogFormat)
+        }
+        slog.SetDefault(slog.New(h))
+}
+
+// withRequestLog gives every request an ID (X-Request-Id when the client
+// sent a sane one), echoes it in the response and writes one access log
+// line when the request is done. Plain text error bodies get the ID
+// appended so that it ends up in bug reports.
+func (p *proxy) withRequestLog(h http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                start := time.Now()
+                ri := &requestInfo{ID: r.Header.Get(requestIDHeader)}
+                if !validRequestID(ri.ID) {
+                        ri.ID = newRequestID()
+                }
+                w.Header().Set(requestIDHeader, ri.ID)
+                if r.Body != nil && r.Body != http.NoBody {
+                        // http.NoBody stays as is: it is how a PUT of 0 bytes
+                        // is sent upstream with its Content-Length
+                        ri.body = &countingReader{ReadCloser: r.Body}
+                        r.Body = ri.body
+                }
+                sw := &statusWriter{ResponseWriter: w}
+                h.ServeHTTP(sw, r.WithContext(withRequestInfo(r.Context(), ri)))
+
+                if sw.status == 0 {
+                        sw.status = http.StatusOK
+                }
+                hdr := sw.Header()
+                if sw.status >= 400 && strings.HasPrefix(hdr.Get("Content-Type"), "text/plain") && hdr.Get("Content-Length") == "" {
+                        fmt.Fprintf(sw, "request id: %s\n", ri.ID)
+                }
+
+                level := slog.LevelInfo
+                switch {
+                case sw.status >= 500:
+                        level = slog.LevelError
+                case sw.status >= 400:
+                        level = slog.LevelWarn
+                case r.URL.Path == "/healthz" || r.URL.Path == "/metrics":
+                        level = slog.LevelDebug
+                }
+                slog.LogAttrs(r.Context(), level, "request",
+                        slog.String("id", ri.ID),
+                        slog.String("method", r.Method),
+                        slog.String("path", r.URL.Path),
+                        slog.Int("status", sw.status),
+                        slog.Int64("bytesIn", ri.bytesIn()),
+                        slog.Int64("bytesOut", sw.n),
+                        slog.Int64("durationMs", time.Since(start).Milliseconds()),
+                        slog.String("user", ri.User),
+                        slog.String("clientIp", p.clientIP(r)),
+                )
+        })
+}
@@ -2,18 +2,19 @@ package main
 
 import (
         "context"
-        "crypto/tls"
         "encoding/json"
         "encoding/xml"
         "fmt"
         "io"
         "log"
+        "log/slog"
+        "net"
         "net/http"
         "net/url"
-        "os"
         "sort"
         "strconv"
         "strings"
+        "sync"
         "time"
 		"encoding/base64"
         "github.com/aws/aws-sdk-go-v2/aws"
@@ -41,13 +42,14 @@ type listBucketResultV2 struct {
 }
 
 type listItemJSON struct {
-    Type         string     `json:"type"` // "prefix" | "content"
-    Name         string     `json:"name"`
-    Prefix       string     `json:"prefix,omitempty"`
-    Key          string     `json:"key,omitempty"`
-    Size         int64      `json:"size,omitempty"`
-    LastModified *time.Time `json:"lastModified,omitempty"`
-    ETag         string     `json:"etag,omitempty"`
+    Type         string            `json:"type"` // "prefix" | "content"
+    Name         string            `json:"name"`
+    Prefix       string            `json:"prefix,omitempty"`
+    Key          string            `json:"key,omitempty"`
+    Size         int64             `json:"size,omitempty"`
+    LastModified *time.Time        `json:"lastModified,omitempty"`
+    ETag         string            `json:"etag,omitempty"`
+    Tags         map[string]string `json:"tags,omitempty"` // ?tags=1 or ?tag=
 }
 
 type listResponseJSON struct {
@@ -63,18 +65,171 @@ type cfg struct {
         Region   string
         AKID     string
         Secret   string
-        Bucket   string
+        Bucket   string   // default bucket
+        Buckets  []string // allowlist, path.Match patterns; the default bucket is always allowed
         Port     string
+
+        // Share links (/api/share)
+        PublicEndpoint  string
+        ShareSecret     string
+        ShareDefaultTTL time.Duration
+        ShareMaxTTL     time.Duration
+
+        // Bulk operations (rename / delete-prefix)
+        BulkConcurrency int
+
+        // Background jobs (/api/jobs)
+        StateDir        string // jobs.json and index.db live here; empty = not kept across restarts
+        JobsConcurrency int
+        JobsRetention   time.Duration
+
+        // Server-side ZIP (/api/zip)
+        ZipMaxBytes int
+
+        // Archive extraction (/api/extract), zip bomb guards
+        ExtractMaxBytes   int // total uncompressed bytes
+        ExtractMaxEntries int
+        ExtractMaxRatio   int // uncompressed / compressed
+
+        // Server-side trash (/api/trash)
+        TrashPrefix        string
+        TrashRetentionDays int // 0: batches stay until purged by hand
+        TrashSweepInterval time.Duration
+
+        // Thumbnails (/api/thumb), cached in the bucket
+        ThumbPrefix      string
+        ThumbMaxSize     int // width and height, pixels
+        ThumbMaxSource   int // bytes of the source image
+        ThumbMaxPixels   int // of the decoded source
+        ThumbQuality     int // JPEG, 1-100
+        ThumbConcurrency int // images decoded at once
+
+        // Key index behind /api/search
+        IndexRefresh time.Duration
+
+        // Authentication (auth.go)
+        AuthMode           string // none | htpasswd | oidc | forward, required
+        AuthHtpasswdFile   string
+        AuthTrustedProxies []string // forward: CIDRs allowed to send the identity headers
+        AuthUserHeader     string
+        AuthEmailHeader    string
+        AuthGroupsHeader   string
+        OIDCIssuer         string
+        OIDCClientID       string
+        OIDCClientSecret   string
+        OIDCRedirectURL    string // https://<host>/auth/callback
+        OIDCScopes         []string
+        OIDCUserClaim      string
+        OIDCGroupsClaim    string
+        SessionSecret      string
+        SessionTTL         time.Duration
+
+        // Prefix-scoped access policies (policy.go)
+        PolicyFile string
+
+        // Audit log (audit.go)
+        AuditSinks        []string // file | stdout | webhook | none
+        AuditFile         string   // default STATE_DIR/audit.log
+        AuditMaxSizeMB    int
+        AuditMaxFiles     int // rotated files kept
+        AuditWebhookURL   string
+        AuditWebhookToken string
+        AuditMemory       int // entries kept for /api/audit, 0: none
+
+        // Prometheus /metrics (metrics.go)
+        MetricsToken string // bearer token required to scrape, if set
+
+        // Logging (logging.go)
+        LogFormat string // text | json
+        LogLevel  string // debug | info | warn | error
+
+        // Server and transport (config.go)
+        ListenAddr       string // default :PORT
+        BasePath         string // e.g. /files, routes are served below it
+        TrustPrefix      bool   // honor X-Forwarded-Prefix from anyone (basepath.go)
+        StaticDir        string // serves this directory instead of the embedded UI (development)
+        CORSOrigins      []string // "*" or exact origins
+        FeaturesDisabled []string // names from features (config.go)
+
+        TLSCAFile             string // PEM bundle trusted on top of the system roots
+        TLSClientCert         string // client certificate, when S3 sits behind an mTLS route
+        TLSClientKey          string
+        TLSInsecureSkipVerify bool
+
+        UpstreamDialTimeout           time.Duration
+        UpstreamTLSHandshakeTimeout   time.Duration
+        UpstreamResponseHeaderTimeout time.Duration // a server-side copy answers once done
+        UpstreamIdleConnTimeout       time.Duration
+        UpstreamMaxIdleConns          int // per host
+        ServerReadHeaderTimeout       time.Duration
+        ServerIdleTimeout             time.Duration
+
+        // Upstream retries and circuit breaker (retry.go)
+        UpstreamMaxAttempts int // 1 = no retry
+        UpstreamRetryBase   time.Duration
+        UpstreamRetryMax    time.Duration
+        BreakerThreshold    int // consecutive failures that open the breaker
+        BreakerCooldown     time.Duration
 }
 
 func mustEnv(k string) string {
-        v := strings.TrimSpace(os.Getenv(k))
+        v := getenv(k)
         if v == "" {
-                log.Fatalf("missing env: %s", k)
+                fatalf("missing env: %s", k)
         }
         return v
 }
 
+func splitList(v string) []string {
+        var out []string
+        for _, s := range strings.Split(v, ",") {
+                if s = strings.TrimSpace(s); s != "" {
+                        out = append(out, s)
+                }
+        }
+        return out
+}
+
+func envString(k, def string) string {
+        if v := getenv(k); v != "" {
+                return v
+        }
+        defaulted(k, def)
+        return def
+}
+
+// envInt reads a positive integer.
+func envInt(k string, def int) int { return envIntMin(k, def, 1) }
+
+// envIntOff also accepts 0, for the settings where 0 turns the feature off.
+func envIntOff(k string, def int) int { return envIntMin(k, def, 0) }
+
+func envIntMin(k string, def, min int) int {
+        v := getenv(k)
+        if v == "" {
+                defaulted(k, strconv.Itoa(def))
+                return def
+        }
+        n, err := strconv.Atoi(v)
+        if err != nil || n < min {
+                fatalf("invalid env %s: %q", k, v)
+        }
+        return n
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+        v := getenv(k)
+        if v == "" {
+                defaulted(k, def.String())
+                return def
+        }
+        d, err := time.ParseDuration(v)
+        if err != nil || d <= 0 {
+                fatalf("invalid env %s: %q", k, v)
+        }
+        return d
+}
+
 func loadCfg() cfg {
         c := cfg{
                 Endpoint: mustEnv("S3_ENDPOINT"),
@@ -82,21 +237,135 @@ func loadCfg() cfg {
                 AKID:     mustEnv("S3_ACCESS_KEY_ID"),
                 Secret:   mustEnv("S3_SECRET_ACCESS_KEY"),
                 Bucket:   mustEnv("S3_BUCKET"),
-                Port:     os.Getenv("PORT"),
+                Buckets:  splitList(getenv("S3_BUCKETS")),
+                Port:     getenv("PORT"),
+
+                PublicEndpoint:  (getenv("S3_PUBLIC_ENDPOINT")),
+                ShareSecret:     getenv("SHARE_SECRET"),
+                ShareDefaultTTL: envDuration("SHARE_DEFAULT_TTL", time.Hour),
+                ShareMaxTTL:     envDuration("SHARE_MAX_TTL", 7*24*time.Hour),
+
+                BulkConcurrency: envInt("BULK_CONCURRENCY", 16),
+
+                StateDir:        getenv("STATE_DIR"),
+                JobsConcurrency: envInt("JOBS_CONCURRENCY", 2),
+                JobsRetention:   envDuration("JOBS_RETENTION", 24*time.Hour),
+
+                ZipMaxBytes: envInt("ZIP_MAX_BYTES", 50<<30),
+
+                ExtractMaxBytes:   envInt("EXTRACT_MAX_BYTES", 20<<30),
+                ExtractMaxEntries: envInt("EXTRACT_MAX_ENTRIES", 100000),
+                ExtractMaxRatio:   envInt("EXTRACT_MAX_RATIO", 200),
+
+                TrashPrefix:        normPrefix(getenv("TRASH_PREFIX")),
+                TrashRetentionDays: envIntOff("TRASH_RETENTION_DAYS", 30),
+                TrashSweepInterval: envDuration("TRASH_SWEEP_INTERVAL", time.Hour),
+
+                ThumbPrefix:      normPrefix(getenv("THUMB_PREFIX")),
+                ThumbMaxSize:     envInt("THUMB_MAX_SIZE", 1024),
+                ThumbMaxSource:   envInt("THUMB_MAX_SOURCE", 64<<20),
+                ThumbMaxPixels:   envInt("THUMB_MAX_PIXELS", 50_000_000),
+                ThumbQuality:     envInt("THUMB_QUALITY", 80),
+                ThumbConcurrency: envInt("THUMB_CONCURRENCY", 4),
+
+                IndexRefresh: envDuration("INDEX_REFRESH", 10*time.Minute),
+
+                AuthMode:           strings.ToLower(getenv("AUTH_MODE")), // no default, see checkCfg
+                AuthHtpasswdFile:   getenv("AUTH_HTPASSWD_FILE"),
+                AuthTrustedProxies: splitList(getenv("AUTH_TRUSTED_PROXIES")),
+                AuthUserHeader:     envString("AUTH_USER_HEADER", "X-Forwarded-User"),
+                AuthEmailHeader:    envString("AUTH_EMAIL_HEADER", "X-Forwarded-Email"),
+                AuthGroupsHeader:   envString("AUTH_GROUPS_HEADER", "X-Forwarded-Groups"),
+                OIDCIssuer:         getenv("OIDC_ISSUER"),
+                OIDCClientID:       getenv("OIDC_CLIENT_ID"),
+                OIDCClientSecret:   getenv("OIDC_CLIENT_SECRET"),
+                OIDCRedirectURL:    getenv("OIDC_REDIRECT_URL"),
+                OIDCScopes:         splitList(envString("OIDC_SCOPES", "openid,email,profile")),
+                OIDCUserClaim:      envString("OIDC_USER_CLAIM", "preferred_username"),
+                OIDCGroupsClaim:    envString("OIDC_GROUPS_CLAIM", "groups"),
+                SessionSecret:      getenv("SESSION_SECRET"),
+                SessionTTL:         envDuration("SESSION_TTL", 12*time.Hour),
+
+                PolicyFile: getenv("POLICY_FILE"),
+
+                AuditSinks:        splitList(envString("AUDIT_SINKS", "file")),
+                AuditFile:         getenv("AUDIT_FILE"),
+                AuditMaxSizeMB:    envInt("AUDIT_MAX_SIZE_MB", 100),
+                AuditMaxFiles:     envInt("AUDIT_MAX_FILES", 5),
+                AuditWebhookURL:   getenv("AUDIT_WEBHOOK_URL"),
+                AuditWebhookToken: getenv("AUDIT_WEBHOOK_TOKEN"),
+                AuditMemory:       envIntOff("AUDIT_MEMORY", 10000),
+
+                MetricsToken: getenv("METRICS_TOKEN"),
+
+                LogFormat: strings.ToLower(envString("LOG_FORMAT", "text")),
+                LogLevel:  envString("LOG_LEVEL", "info"),
+
+                ListenAddr:       getenv("LISTEN_ADDR"),
+                BasePath:         strings.TrimRight(getenv("BASE_PATH"), "/"),
+                TrustPrefix:      envBool("TRUST_FORWARDED_PREFIX", false),
+                StaticDir:        getenv("STATIC_DIR"),
+                CORSOrigins:      splitList(envString("CORS_ORIGINS", "*")),
+                FeaturesDisabled: splitList(strings.ToLower(getenv("FEATURES_DISABLED"))),
+
+                TLSCAFile:             getenv("TLS_CA_FILE"),
+                TLSClientCert:         getenv("TLS_CLIENT_CERT"),
+                TLSClientKey:          getenv("TLS_CLIENT_KEY"),
+                TLSInsecureSkipVerify: envBool("TLS_INSECURE_SKIP_VERIFY", false),
+
+                UpstreamDialTimeout:           envDuration("UPSTREAM_DIAL_TIMEOUT", 10*time.Second),
+                UpstreamTLSHandshakeTimeout:   envDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+                UpstreamResponseHeaderTimeout: envDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT", 15*time.Minute),
+                UpstreamIdleConnTimeout:       envDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+                UpstreamMaxIdleConns:          envInt("UPSTREAM_MAX_IDLE_CONNS", 32),
+                ServerReadHeaderTimeout:       envDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+                ServerIdleTimeout:             envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+
+                UpstreamMaxAttempts: envInt("UPSTREAM_MAX_ATTEMPTS", 4),
+                UpstreamRetryBase:   envDuration("UPSTREAM_RETRY_BASE", 100*time.Millisecond),
+                UpstreamRetryMax:    envDuration("UPSTREAM_RETRY_MAX", 5*time.Second),
+                BreakerThreshold:    envInt("BREAKER_THRESHOLD", 10),
+                BreakerCooldown:     envDuration("BREAKER_COOLDOWN", 30*time.Second),
         }
         if c.Port == "" {
                 c.Port = "8088"
+                defaulted("PORT", c.Port)
+        }
+        if c.ListenAddr == "" {
+                c.ListenAddr = ":" + c.Port
+                defaulted("LISTEN_ADDR", c.ListenAddr)
+        }
+        if c.TrashPrefix == "" {
+                c.TrashPrefix = "_trash/"
+                defaulted("TRASH_PREFIX", c.TrashPrefix)
+        }
+        if c.ThumbPrefix == "" {
+                c.ThumbPrefix = "_thumbs/"
+                defaulted("THUMB_PREFIX", c.ThumbPrefix)
         }
         return c
 }
 
 type proxy struct {
-        cfg     cfg
-        origin  *url.URL
-        client  *http.Client
-        signer  *v4.Signer
-        creds   aws.Credentials
-        hostHdr string
+        cfg      cfg
+        origin   *url.URL
+        public   *url.URL
+        client   *http.Client
+        signer   *v4.Signer
+        creds    aws.Credentials
+        hostHdr  string
+        shareKey []byte
+        jobs     *jobManager
+        index    *keyIndex
+        auth     authenticator
+        policy   *policyEngine
+        trusted  []*net.IPNet // AUTH_TRUSTED_PROXIES
+        audit    *auditLog
+        metrics  *metrics
+        breaker  *breaker
+
+        writeLocks writeLocks    // conditional writes, see guardWrite
+        thumbSem   chan struct{} // THUMB_CONCURRENCY
 }
 
 func newProxy(c cfg) *proxy {
@@ -104,20 +373,36 @@ func newProxy(c cfg) *proxy {
         if err != nil {
                 log.Fatalf("invalid S3_ENDPOINT: %v", err)
         }
-        tr := &http.Transport{
-                Proxy: http.ProxyFromEnvironment,
-                TLSClientConfig: &tls.Config{
-                        InsecureSkipVerify: false,
-                },
+        tr, err := newTransport(c)
+        if err != nil {
+                log.Fatalf("upstream transport: %v", err)
+        }
+        pub := u
+        if c.PublicEndpoint != "" {
+                if pub, err = url.Parse(strings.TrimRight(c.PublicEndpoint, "/")); err != nil {
+                        log.Fatalf("invalid S3_PUBLIC_ENDPOINT: %v", err)
+                }
         }
-        return &proxy{
-                cfg:     c,
-                origin:  u,
-                client:  &http.Client{Transport: tr, Timeout: 0},
-                signer:  v4.NewSigner(),
-                creds:   aws.Credentials{AccessKeyID: c.AKID, SecretAccessKey: c.Secret, Source: "static"},
-                hostHdr: u.Host,
+        p := &proxy{
+                cfg:      c,
+                origin:   u,
+                public:   pub,
+                client:   &http.Client{Transport: tr, Timeout: 0},
+                signer:   v4.NewSigner(),
+                creds:    aws.Credentials{AccessKeyID: c.AKID, SecretAccessKey: c.Secret, Source: "static"},
+                hostHdr:  u.Host,
+                shareKey: loadShareKey(c.ShareSecret),
+                trusted:  parseTrustedProxies(c.AuthTrustedProxies),
+                metrics:  newMetrics(),
         }
+        p.breaker = newBreaker(c, p.metrics)
+        p.thumbSem = make(chan struct{}, c.ThumbConcurrency)
+        p.audit = newAuditLog(c)
+        p.index = newKeyIndex(p)
+        p.auth = newAuthenticator(c)
+        p.policy = newPolicyEngine(c.PolicyFile)
+        p.jobs = newJobManager(p)
+        return p
 }
 
 func (p *proxy) copySafeHeaders(dst http.ResponseWriter, src *http.Response) {
@@ -132,31 +417,19 @@ func (p *proxy) copySafeHeaders(dst http.ResponseWriter, src *http.Response) {
                 "upgrade":             true,
         }
         for k, vv := range src.Header {
-                if hop[strings.ToLower(k)] {
+                // CORS is withCORS' business, not S3's
+                if hop[strings.ToLower(k)] || strings.HasPrefix(strings.ToLower(k), "access-control-") {
                         continue
                 }
                 for _, v := range vv {
                         dst.Header().Add(k, v)
                 }
         }
-        dst.Header().Set("Access-Control-Allow-Origin", "*")
-        dst.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Content-Length, Content-Type")
+        dst.Header().Set("Access-Control-Expose-Headers", exposedHeaders(src.Header))
 }
 
-func (p *proxy) signAndDo(ctx context.Context, req *http.Request) (*http.Response, error) {
-        req.Host = p.hostHdr
-        req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
-        now := time.Now().UTC()
-        if err := p.signer.SignHTTP(
-                ctx, p.creds, req, "UNSIGNED-PAYLOAD", "s3", p.cfg.Region, now,
-                func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true },
-        ); err != nil {
-                return nil, err
-        }
-        return p.client.Do(req)
-}
-
-func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathUnescaped, rawPath, rawQuery string, body io.Reader, contentLength int64, contentType string) {
+// forwardRaw relays the request to S3 and returns the upstream status.
+func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathUnescaped, rawPath, rawQuery string, body io.Reader, contentLength int64, contentType string) int {
         ctx := r.Context()
 
         u := *p.origin
@@ -166,16 +439,11 @@ func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathU
 
         req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
         if err != nil {
-                http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
-                return
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return http.StatusInternalServerError
         }
 
-        copyHdrs := []string{"Range", "If-None-Match", "If-Modified-Since", "Accept", "User-Agent", "Content-Type"}
-        for _, h := range copyHdrs {
-                if v := r.Header.Get(h); v != "" {
-                        req.Header.Set(h, v)
-                }
-        }
+        copyRequestHeaders(req, r)
         if contentType != "" {
                 req.Header.Set("Content-Type", contentType)
         }
@@ -186,33 +454,55 @@ func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathU
 
         resp, err := p.signAndDo(ctx, req)
         if err != nil {
-                http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
-                return
+                upstreamError(w, "upstream", err)
+                return http.StatusBadGateway
         }
         defer resp.Body.Close()
 
         for k := range w.Header() {
-                w.Header().Del(k)
+                // keep what withCORS set
+                if k != "Vary" && !strings.HasPrefix(k, "Access-Control-") {
+                        w.Header().Del(k)
+                }
         }
         p.copySafeHeaders(w, resp)
+        w.Header().Set(requestIDHeader, requestID(ctx))
+        if resp.StatusCode >= 400 {
+                // S3 XML errors become JSON like every other error
+                e := parseS3Error(strings.ToLower(method), resp)
+                if bucket, key, err := p.splitBucketKey(r); err == nil {
+                        e.Bucket = bucket
+                        if e.Key == "" {
+                                e.Key = key
+                        }
+                }
+                writeError(w, e)
+                return resp.StatusCode
+        }
         w.WriteHeader(resp.StatusCode)
 
         if method != http.MethodHead {
                 _, _ = io.Copy(w, resp.Body)
         }
+        return resp.StatusCode
 }
 
 func (p *proxy) handleList(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet && r.Method != http.MethodHead {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
+        if !p.authorizeListing(w, r, p.cfg.Bucket) {
+                return
+        }
+        // bare /s3 lists the default bucket
         pathUnescaped := "/" + p.cfg.Bucket
         rawPath := "/" + url.PathEscape(p.cfg.Bucket)
         p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
 }
 
-func (p *proxy) splitKeyFromURL(r *http.Request) (pathUnescaped, rawPath string, err error) {
+// splitBucketKey parses /s3/{bucket}/{key...}; empty segments are dropped.
+func (p *proxy) splitBucketKey(r *http.Request) (bucket, key string, err error) {
         escaped := r.URL.EscapedPath()
         keyPart := strings.TrimPrefix(escaped, "/s3/")
         keyPart = strings.TrimLeft(keyPart, "/")
@@ -224,32 +514,55 @@ func (p *proxy) splitKeyFromURL(r *http.Request) (pathUnescaped, rawPath string,
 
         segs := strings.Split(unescaped, "/")
         segsClean := make([]string, 0, len(segs))
-        segsEsc := make([]string, 0, len(segs))
         for _, s := range segs {
                 if s == "" {
                         continue
                 }
                 segsClean = append(segsClean, s)
-                segsEsc = append(segsEsc, url.PathEscape(s))
         }
+        if len(segsClean) == 0 {
+                return "", "", errNoBucket
+        }
+        bucket = segsClean[0]
+        if !p.bucketAllowed(bucket) {
+                return "", "", errBucketNotAllowed
+        }
+        return bucket, strings.Join(segsClean[1:], "/"), nil
+}
 
-        pathUnescaped = "/" + p.cfg.Bucket
-        rawPath = "/" + url.PathEscape(p.cfg.Bucket)
-        if len(segsClean) > 0 {
-                pathUnescaped += "/" + strings.Join(segsClean, "/")
-                rawPath += "/" + strings.Join(segsEsc, "/")
+func (p *proxy) splitKeyFromURL(r *http.Request) (pathUnescaped, rawPath string, err error) {
+        bucket, key, err := p.splitBucketKey(r)
+        if err != nil {
+                return "", "", err
+        }
+        if key == "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+                // never let PUT/DELETE reach the bucket itself
+                return "", "", errNoKey
+        }
+        pathUnescaped = "/" + bucket
+        rawPath = "/" + url.PathEscape(bucket)
+        if key != "" {
+                pathUnescaped += "/" + key
+                rawPath += "/" + encodeKeyRaw(key)
         }
         return pathUnescaped, rawPath, nil
 }
 
 func (p *proxy) handleGetObject(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet && r.Method != http.MethodHead {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
         pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
         if err != nil {
-                http.Error(w, "bad path", http.StatusBadRequest)
+                pathError(w, err)
+                return
+        }
+        if !p.authorizeObject(w, r, actRead) {
+                return
+        }
+        if bucket, key, err := p.splitBucketKey(r); err == nil && key != "" && servedLocally(r) {
+                p.serveRanges(w, r, bucket, key)
                 return
         }
         p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
@@ -257,57 +570,143 @@ func (p *proxy) handleGetObject(w http.ResponseWriter, r *http.Request) {
 
 func (p *proxy) handlePutObject(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPut {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
         pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
         if err != nil {
-                http.Error(w, "bad path", http.StatusBadRequest)
+                pathError(w, err)
+                return
+        }
+        if bucket, key, err := p.splitBucketKey(r); err == nil {
+                auditOp(r, "put", bucket, key)
+        }
+        if !p.authorizeObject(w, r, actWrite) {
                 return
         }
+        if bucket, key, err := p.splitBucketKey(r); err == nil {
+                unlock, ok := p.guardWrite(w, r, bucket, key)
+                if !ok {
+                        return
+                }
+                defer unlock()
+        }
 
         ct := r.Header.Get("Content-Type")
         cl := r.ContentLength
-        if cl < 0 {
+        body := io.Reader(r.Body)
+        if cl == 0 {
+                body = http.NoBody // else sent chunked, without Content-Length
         }
 
-        p.forwardRaw(w, r, http.MethodPut, pathUnescaped, rawPath, r.URL.RawQuery, r.Body, cl, ct)
+        status := p.forwardRaw(w, r, http.MethodPut, pathUnescaped, rawPath, r.URL.RawQuery, body, cl, ct)
+        if status/100 == 2 && r.URL.RawQuery == "" {
+                if bucket, key, err := p.splitBucketKey(r); err == nil {
+                        if cl < 0 {
+                                p.index.noteUpload(r.Context(), bucket, key)
+                        } else {
+                                p.index.notePut(bucket, key, cl, w.Header().Get("ETag"))
+                        }
+                }
+        }
 }
 
 func (p *proxy) handleDeleteObject(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodDelete {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
         pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
         if err != nil {
-                http.Error(w, "bad path", http.StatusBadRequest)
+                pathError(w, err)
                 return
         }
-        p.forwardRaw(w, r, http.MethodDelete, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
+        if bucket, key, err := p.splitBucketKey(r); err == nil {
+                auditOp(r, "delete", bucket, key)
+        }
+        if !p.authorizeObject(w, r, actDelete) {
+                return
+        }
+        if bucket, key, err := p.splitBucketKey(r); err == nil {
+                unlock, ok := p.guardWrite(w, r, bucket, key)
+                if !ok {
+                        return
+                }
+                defer unlock()
+        }
+        status := p.forwardRaw(w, r, http.MethodDelete, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
+        if status/100 == 2 && r.URL.RawQuery == "" {
+                if bucket, key, err := p.splitBucketKey(r); err == nil {
+                        p.index.noteDelete(bucket, key)
+                        p.dropThumbs(bucket, key)
+                }
+        }
 }
 
 /* ===== Helpers for API operations ===== */
 
-func (p *proxy) buildBucketURL(q url.Values) (string, string) {
+func (p *proxy) buildBucketURL(bucket string, q url.Values) string {
         u := *p.origin
-        u.Path = "/" + p.cfg.Bucket
-        u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
+        u.Path = "/" + bucket
+        u.RawPath = "/" + url.PathEscape(bucket)
         u.RawQuery = q.Encode()
-        return u.String(), u.RawPath
+        return u.String()
+}
+
+func (p *proxy) buildObjectURL(bucket, key string, q url.Values) string {
+        u := *p.origin
+        u.Path = "/" + bucket + "/" + srcToPath(key)
+        u.RawPath = "/" + url.PathEscape(bucket) + "/" + encodeKeyRaw(key)
+        if q != nil {
+                u.RawQuery = q.Encode()
+        }
+        return u.String()
+}
+
+// objectInfo is one entry of a recursive listing.
+type objectInfo struct {
+        Key          string
+        Size         int64
+        LastModified time.Time
+        ETag         string
+}
+
+func (p *proxy) listAllKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+        objs, err := p.listAllObjects(ctx, bucket, prefix)
+        if err != nil {
+                return nil, err
+        }
+        keys := make([]string, len(objs))
+        for i, o := range objs {
+                keys[i] = o.Key
+        }
+        return keys, nil
+}
+
+func (p *proxy) listAllObjects(ctx context.Context, bucket, prefix string) ([]objectInfo, error) {
+        var objs []objectInfo
+        err := p.walkObjects(ctx, bucket, prefix, func(page []objectInfo) {
+                objs = append(objs, page...)
+        })
+        if err != nil {
+                return nil, err
+        }
+        return objs, nil
 }
 
-func (p *proxy) listAllKeys(ctx context.Context, prefix string) ([]string, error) {
+// walkObjects lists prefix recursively and hands each page (up to 1000 keys) to fn.
+func (p *proxy) walkObjects(ctx context.Context, bucket, prefix string, fn func(page []objectInfo)) error {
         type listBucketResult struct {
                 XMLName               xml.Name `xml:"ListBucketResult"`
                 NextContinuationToken string   `xml:"NextContinuationToken"`
                 Contents              []struct {
-                        Key  string `xml:"Key"`
-                        Size int64  `xml:"Size"`
+                        Key          string    `xml:"Key"`
+                        Size         int64     `xml:"Size"`
+                        LastModified time.Time `xml:"LastModified"`
+                        ETag         string    `xml:"ETag"`
                 } `xml:"Contents"`
         }
 
-        var keys []string
         var token string
         for {
                 q := url.Values{}
@@ -320,81 +719,95 @@ func (p *proxy) listAllKeys(ctx context.Context, prefix string) ([]string, error
                         q.Set("continuation-token", token)
                 }
 
-                u := *p.origin
-                u.Path = "/" + p.cfg.Bucket
-                u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
-                u.RawQuery = q.Encode()
-
-                req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+                req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.buildBucketURL(bucket, q), nil)
                 resp, err := p.signAndDo(ctx, req)
                 if err != nil {
-                        return nil, err
+                        return err
                 }
                 b, err := io.ReadAll(resp.Body)
                 resp.Body.Close()
                 if err != nil {
-                        return nil, err
+                        return err
                 }
                 if resp.StatusCode != http.StatusOK {
-                        return nil, fmt.Errorf("list failed: %s", resp.Status)
+                        return s3ErrorFromBody("list", resp.StatusCode, b)
                 }
                 var lb listBucketResult
                 if err := xml.Unmarshal(b, &lb); err != nil {
-                        return nil, err
+                        return err
                 }
-                for _, c := range lb.Contents {
-                        keys = append(keys, c.Key)
+                page := make([]objectInfo, len(lb.Contents))
+                for i, c := range lb.Contents {
+                        page[i] = objectInfo{Key: c.Key, Size: c.Size, LastModified: c.LastModified, ETag: c.ETag}
                 }
+                fn(page)
                 if lb.NextContinuationToken == "" {
-                        break
+                        return nil
                 }
                 token = lb.NextContinuationToken
         }
-        return keys, nil
 }
 
 // CopyObject via PUT on destination with x-amz-copy-source
-func (p *proxy) copyObject(ctx context.Context, srcKey, dstKey string) error {
-        // Build destination URL
-        dstUnescaped := "/" + p.cfg.Bucket + "/" + strings.TrimLeft(srcToPath(dstKey), "/")
-        dstRaw := "/" + url.PathEscape(p.cfg.Bucket) + "/" + encodeKeyRaw(dstKey)
-
-        u := *p.origin
-        u.Path = dstUnescaped
-        u.RawPath = dstRaw
-
-        req, _ := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
+func (p *proxy) copyObject(ctx context.Context, bucket, srcKey, dstKey string) error {
+        req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.buildObjectURL(bucket, dstKey, nil), nil)
         // x-amz-copy-source must be URL-encoded path /bucket/srcKey
-        copySrc := "/" + p.cfg.Bucket + "/" + encodeKeyRaw(srcKey)
+        copySrc := "/" + url.PathEscape(bucket) + "/" + encodeKeyRaw(srcKey)
         req.Header.Set("x-amz-copy-source", copySrc)
 
         resp, err := p.signAndDo(ctx, req)
         if err != nil {
                 return err
         }
-        io.Copy(io.Discard, resp.Body)
-        resp.Body.Close()
+        defer resp.Body.Close()
         if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-                return fmt.Errorf("copy failed: %s", resp.Status)
+                return parseS3Error("copy", resp)
         }
+        io.Copy(io.Discard, resp.Body)
+        p.index.noteCopy(bucket, srcKey, dstKey)
         return nil
 }
 
-func (p *proxy) deleteObject(ctx context.Context, key string) error {
-        u := *p.origin
-        u.Path = "/" + p.cfg.Bucket + "/" + strings.TrimLeft(srcToPath(key), "/")
-        u.RawPath = "/" + url.PathEscape(p.cfg.Bucket) + "/" + encodeKeyRaw(key)
-
-        req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+// putObject uploads exactly size bytes read from body.
+func (p *proxy) putObject(ctx context.Context, bucket, key string, body io.Reader, size int64, contentType string) error {
+        if size == 0 {
+                body = http.NoBody
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.buildObjectURL(bucket, key, nil), body)
+        if err != nil {
+                return err
+        }
+        req.ContentLength = size
+        rewindable(req, body)
+        if contentType != "" {
+                req.Header.Set("Content-Type", contentType)
+        }
         resp, err := p.signAndDo(ctx, req)
         if err != nil {
                 return err
         }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+                return parseS3Error("put", resp)
+        }
         io.Copy(io.Discard, resp.Body)
-        resp.Body.Close()
+        p.index.notePut(bucket, key, size, resp.Header.Get("ETag"))
+        return nil
+}
+
+func (p *proxy) deleteObject(ctx context.Context, bucket, key string) error {
+        req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, p.buildObjectURL(bucket, key, nil), nil)
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
         if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-                return fmt.Errorf("delete failed: %s", resp.Status)
+                return parseS3Error("delete", resp)
         }
+        io.Copy(io.Discard, resp.Body)
+        p.index.noteDelete(bucket, key)
+        p.dropThumbs(bucket, key)
         return nil
 }
 
@@ -411,23 +824,20 @@ func encodeKeyRaw(key string) string {
         return strings.Join(enc, "/")
 }
 
+// srcToPath makes a key of the API relative to the bucket root and drops
+// its empty segments, as splitBucketKey and encodeKeyRaw do: "a//b" reaches
+// S3 as a/b, so it must be authorized as a/b. A trailing slash is kept.
 func srcToPath(s string) string {
-        return strings.TrimLeft(s, "/")
+        segs := strings.FieldsFunc(s, func(c rune) bool { return c == '/' })
+        key := strings.Join(segs, "/")
+        if key != "" && strings.HasSuffix(s, "/") {
+                key += "/"
+        }
+        return key
 }
 
 /* ===== Stats API: /api/stats?prefix=...  ===== */
 
-type listBucketResult struct {
-        XMLName               xml.Name `xml:"ListBucketResult"`
-        NextContinuationToken string   `xml:"NextContinuationToken"`
-        Contents              []struct {
-                Key          string    `xml:"Key"`
-                LastModified time.Time `xml:"LastModified"`
-                Size         int64     `xml:"Size"`
-                ETag         string    `xml:"ETag"`
-        } `xml:"Contents"`
-}
-
 type agg struct {
         Count int64 `json:"count"`
         Bytes int64 `json:"bytes"`
@@ -442,6 +852,84 @@ type statsResponse struct {
         ByFolder   map[string]agg `json:"byFolder"` // TOP 1000 by bytes (desc)
         Newest     *time.Time     `json:"newest,omitempty"`
         Oldest     *time.Time     `json:"oldest,omitempty"`
+        Source     string         `json:"source"`              // "index" | "live"
+        IndexedAt  *time.Time     `json:"indexedAt,omitempty"` // index snapshot used, if any
+}
+
+func newStatsResponse(prefix string) *statsResponse {
+        return &statsResponse{
+                Prefix:   prefix,
+                ByType:   map[string]agg{},
+                ByFolder: map[string]agg{},
+        }
+}
+
+// add counts one object of the listing.
+func (out *statsResponse) add(o objectInfo) {
+        // ignorer les "markers" de dossier (key se terminant par '/' et size==0)
+        if strings.HasSuffix(o.Key, "/") && o.Size == 0 {
+                return
+        }
+        out.Count++
+        out.TotalBytes += o.Size
+
+        // newest / oldest
+        if out.Newest == nil || o.LastModified.After(*out.Newest) {
+                t := o.LastModified
+                out.Newest = &t
+        }
+        if out.Oldest == nil || o.LastModified.Before(*out.Oldest) {
+                t := o.LastModified
+                out.Oldest = &t
+        }
+
+        // byType
+        kind := detectKind(o.Key)
+        aggT := out.ByType[kind]
+        aggT.Count++
+        aggT.Bytes += o.Size
+        out.ByType[kind] = aggT
+
+        // byFolder (1er niveau sous le préfixe)
+        rest := o.Key
+        if out.Prefix != "" && strings.HasPrefix(rest, out.Prefix) {
+                rest = strings.TrimPrefix(rest, out.Prefix)
+        }
+        if i := strings.IndexByte(rest, '/'); i >= 0 {
+                folder := rest[:i+1] // inclut le slash de fin "dir/"
+                ag := out.ByFolder[folder]
+                ag.Count++
+                ag.Bytes += o.Size
+                out.ByFolder[folder] = ag
+        }
+}
+
+// finish trims ByFolder and sets TookMs.
+func (out *statsResponse) finish(start time.Time) {
+        // Limiter les dossiers à TOP 1000 par taille (desc)
+        type kv struct {
+                Name string
+                A    agg
+        }
+        var folders []kv
+        for k, v := range out.ByFolder {
+                folders = append(folders, kv{Name: k, A: v})
+        }
+        sort.Slice(folders, func(i, j int) bool {
+                if folders[i].A.Bytes == folders[j].A.Bytes {
+                        return folders[i].Name < folders[j].Name
+                }
+                return folders[i].A.Bytes > folders[j].A.Bytes
+        })
+        if len(folders) > 1000 {
+                folders = folders[:1000]
+        }
+        trimmed := make(map[string]agg, len(folders))
+        for _, it := range folders {
+                trimmed[it.Name] = it.A
+        }
+        out.ByFolder = trimmed
+        out.TookMs = time.Since(start).Milliseconds()
 }
 
 func detectKind(key string) string {
@@ -470,137 +958,60 @@ func detectKind(key string) string {
 
 func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
                 return
         }
         prefix := r.URL.Query().Get("prefix") // ex: "foo/bar/"
-
-        start := time.Now()
-        ctx := r.Context()
-
-        out := statsResponse{
-                Prefix:   prefix,
-                ByType:   map[string]agg{},
-                ByFolder: map[string]agg{},
+        if !p.access(r, bucket).canAll(actRead, prefix) {
+                forbidden(w, r, actRead, bucket, prefix)
+                return
         }
 
-        var token string
-        for {
-                q := url.Values{}
-                q.Set("list-type", "2")
-                if prefix != "" {
-                        q.Set("prefix", prefix)
-                }
-                q.Set("max-keys", "1000")
-                if token != "" {
-                        q.Set("continuation-token", token)
-                }
-
-                u := *p.origin
-                u.Path = "/" + p.cfg.Bucket
-                u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
-                u.RawQuery = q.Encode()
-
-                req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
-                        return
-                }
-                resp, err := p.signAndDo(ctx, req)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
-                        return
-                }
-                body, err := io.ReadAll(resp.Body)
-                resp.Body.Close()
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("read: %v", err), http.StatusBadGateway)
-                        return
-                }
-                if resp.StatusCode != http.StatusOK {
-                        http.Error(w, fmt.Sprintf("list failed: %s", resp.Status), resp.StatusCode)
-                        return
-                }
-
-                var lb listBucketResult
-                if err := xml.Unmarshal(body, &lb); err != nil {
-                        http.Error(w, fmt.Sprintf("xml: %v", err), http.StatusBadGateway)
+        // answered from the key index once the bucket has been walked;
+        // ?fresh=1 lists S3 instead
+        p.index.ensure(bucket)
+        if r.URL.Query().Get("fresh") != "1" {
+                if out, ok := p.index.stats(bucket, prefix); ok {
+                        w.Header().Set("Content-Type", "application/json")
+                        _ = json.NewEncoder(w).Encode(out)
                         return
                 }
-
-                for _, c := range lb.Contents {
-                        // ignorer les "markers" de dossier (key se terminant par '/' et size==0)
-                        if strings.HasSuffix(c.Key, "/") && c.Size == 0 {
-                                continue
-                        }
-                        out.Count++
-                        out.TotalBytes += c.Size
-
-                        // newest / oldest
-                        if out.Newest == nil || c.LastModified.After(*out.Newest) {
-                                t := c.LastModified
-                                out.Newest = &t
-                        }
-                        if out.Oldest == nil || c.LastModified.Before(*out.Oldest) {
-                                t := c.LastModified
-                                out.Oldest = &t
-                        }
-
-                        // byType
-                        kind := detectKind(c.Key)
-                        aggT := out.ByType[kind]
-                        aggT.Count++
-                        aggT.Bytes += c.Size
-                        out.ByType[kind] = aggT
-
-                        // byFolder (1er niveau sous le préfixe)
-                        rest := c.Key
-                        if prefix != "" && strings.HasPrefix(rest, prefix) {
-                                rest = strings.TrimPrefix(rest, prefix)
-                        }
-                        if i := strings.IndexByte(rest, '/'); i >= 0 {
-                                folder := rest[:i+1] // inclut le slash de fin "dir/"
-                                ag := out.ByFolder[folder]
-                                ag.Count++
-                                ag.Bytes += c.Size
-                                out.ByFolder[folder] = ag
-                        }
-                }
-
-                if lb.NextContinuationToken == "" {
-                        break
-                }
-                token = lb.NextContinuationToken
         }
-
-        // Limiter les dossiers à TOP 1000 par taille (desc)
-        type kv struct {
-                Name string
-                A    agg
-        }
-        var folders []kv
-        for k, v := range out.ByFolder {
-                folders = append(folders, kv{Name: k, A: v})
+        out, err := p.computeStats(r.Context(), bucket, prefix, nil)
+        if err != nil {
+                upstreamError(w, "stats", err)
+                return
         }
-        sort.Slice(folders, func(i, j int) bool {
-                if folders[i].A.Bytes == folders[j].A.Bytes {
-                        return folders[i].Name < folders[j].Name
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+// computeStats scans prefix; progress (optional) receives the number of keys seen so far.
+func (p *proxy) computeStats(ctx context.Context, bucket, prefix string, progress func(scanned int)) (*statsResponse, error) {
+        defer p.metrics.observeOperation(jobStats, time.Now())
+        start := time.Now()
+        scanned := 0
+        out := newStatsResponse(prefix)
+        out.Source = "live"
+        err := p.walkObjects(ctx, bucket, prefix, func(page []objectInfo) {
+                for _, o := range page {
+                        out.add(o)
+                }
+                scanned += len(page)
+                if progress != nil {
+                        progress(scanned)
                 }
-                return folders[i].A.Bytes > folders[j].A.Bytes
         })
-        if len(folders) > 1000 {
-                folders = folders[:1000]
-        }
-        trimmed := make(map[string]agg, len(folders))
-        for _, it := range folders {
-                trimmed[it.Name] = it.A
+        if err != nil {
+                return nil, err
         }
-        out.ByFolder = trimmed
-
-        out.TookMs = time.Since(start).Milliseconds()
-
-        w.Header().Set("Content-Type", "application/json")
-        _ = json.NewEncoder(w).Encode(out)
+        out.finish(start)
+        return out, nil
 }
 
 /* ===== Rename & Delete-prefix APIs ===== */
@@ -612,116 +1023,189 @@ type renameRequest struct {
 }
 
 type renameResponse struct {
-        Moved int   `json:"moved"`
-        Took  int64 `json:"tookMs"`
+        Moved  int          `json:"moved"`
+        Took   int64        `json:"tookMs"`
+        Failed []keyFailure `json:"failed,omitempty"` // clés non déplacées (copie ou suppression)
 }
 
 func (p *proxy) handleRename(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
         ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
         var req renameRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                http.Error(w, "bad json", http.StatusBadRequest)
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        src, dst := srcToPath(req.Src), srcToPath(req.Dst)
+        if req.IsPrefix {
+                src, dst = normPrefix(req.Src), normPrefix(req.Dst)
+                if overlaps(src, dst) {
+                        httpError(w, errNestedRename.Error(), http.StatusBadRequest)
+                        return
+                }
+        }
+        ae := auditOp(r, "rename", bucket, src, dst)
+        if !p.authorizeMove(w, r, bucket, src, dst) {
                 return
         }
 
         start := time.Now()
         moved := 0
+        var failed []keyFailure
 
         if req.IsPrefix {
-                src := strings.TrimLeft(req.Src, "/")
-                if src != "" && !strings.HasSuffix(src, "/") {
-                        src += "/"
-                }
-                dst := strings.TrimLeft(req.Dst, "/")
-                if dst != "" && !strings.HasSuffix(dst, "/") {
-                        dst += "/"
-                }
-                keys, err := p.listAllKeys(ctx, src)
+                moved, failed, err = p.renamePrefix(ctx, bucket, src, dst, nil)
                 if err != nil {
-                        http.Error(w, fmt.Sprintf("list: %v", err), http.StatusBadGateway)
+                        upstreamError(w, "list", err)
                         return
                 }
-                for _, k := range keys {
-                        if strings.HasSuffix(k, "/") {
-                                // ignore markers
-                                continue
-                        }
-                        newKey := dst + strings.TrimPrefix(k, src)
-                        if err := p.copyObject(ctx, k, newKey); err != nil {
-                                http.Error(w, fmt.Sprintf("copy %s -> %s: %v", k, newKey, err), http.StatusBadGateway)
-                                return
-                        }
-                        if err := p.deleteObject(ctx, k); err != nil {
-                                http.Error(w, fmt.Sprintf("delete %s: %v", k, err), http.StatusBadGateway)
-                                return
-                        }
-                        moved++
-                }
         } else {
                 // single object
-                if err := p.copyObject(ctx, req.Src, req.Dst); err != nil {
-                        http.Error(w, fmt.Sprintf("copy %s -> %s: %v", req.Src, req.Dst, err), http.StatusBadGateway)
+                if err := p.copyObject(ctx, bucket, src, dst); err != nil {
+                        upstreamError(w, fmt.Sprintf("copy %s -> %s", src, dst), err)
                         return
                 }
-                if err := p.deleteObject(ctx, req.Src); err != nil {
-                        http.Error(w, fmt.Sprintf("delete %s: %v", req.Src, err), http.StatusBadGateway)
+                if err := p.deleteObject(ctx, bucket, src); err != nil {
+                        upstreamError(w, "delete "+src, err)
                         return
                 }
                 moved = 1
+                p.metrics.observeOperation(jobRename, start)
         }
 
-        out := renameResponse{Moved: moved, Took: time.Since(start).Milliseconds()}
+        ae.Count = moved
+        out := renameResponse{Moved: moved, Took: time.Since(start).Milliseconds(), Failed: failed}
         w.Header().Set("Content-Type", "application/json")
         _ = json.NewEncoder(w).Encode(out)
 }
 
+// normPrefix makes p relative to the bucket root and slash-terminated.
+func normPrefix(p string) string {
+        p = srcToPath(p)
+        if p != "" && !strings.HasSuffix(p, "/") {
+                p += "/"
+        }
+        return p
+}
+
+// renamePrefix moves every object under src to dst, one DeleteObjects batch at
+// a time: the batch is copied in parallel, then only the copied sources are
+// deleted. progress (optional) receives the listing size and the keys handled.
+func (p *proxy) renamePrefix(ctx context.Context, bucket, src, dst string, progress func(total, done int)) (int, []keyFailure, error) {
+        defer p.metrics.observeOperation(jobRename, time.Now())
+        src, dst = normPrefix(src), normPrefix(dst)
+        keys, err := p.listAllKeys(ctx, bucket, src)
+        if err != nil {
+                return 0, nil, err
+        }
+        files := keys[:0]
+        for _, k := range keys {
+                if strings.HasSuffix(k, "/") {
+                        // ignore markers
+                        continue
+                }
+                files = append(files, k)
+        }
+
+        moved := 0
+        var failed []keyFailure
+        for done := 0; done < len(files); {
+                if progress != nil {
+                        progress(len(files), done)
+                }
+                batch := files[done:min(done+deleteBatchSize, len(files))]
+                copyFailed := forEachKey(ctx, p.cfg.BulkConcurrency, batch, func(ctx context.Context, k string) error {
+                        newKey := dst + strings.TrimPrefix(k, src)
+                        if err := p.copyObject(ctx, bucket, k, newKey); err != nil {
+                                return fmt.Errorf("copy -> %s: %w", newKey, err)
+                        }
+                        return nil
+                })
+                deleted, delFailed := p.deleteKeys(ctx, bucket, succeededKeys(batch, copyFailed), nil)
+                moved += deleted
+                failed = append(failed, copyFailed...)
+                failed = append(failed, delFailed...)
+                done += len(batch)
+        }
+        if progress != nil {
+                progress(len(files), len(files))
+        }
+        return moved, failed, nil
+}
+
 type deletePrefixRequest struct {
         Prefix string `json:"prefix"`
 }
 type deletePrefixResponse struct {
-        Deleted int   `json:"deleted"`
-        Took    int64 `json:"tookMs"`
+        Deleted int          `json:"deleted"`
+        Took    int64        `json:"tookMs"`
+        Failed  []keyFailure `json:"failed,omitempty"`
 }
 
 func (p *proxy) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
-                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
         ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
         var req deletePrefixRequest
         if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                http.Error(w, "bad json", http.StatusBadRequest)
+                httpError(w, "bad json", http.StatusBadRequest)
                 return
         }
-        pfx := strings.TrimLeft(req.Prefix, "/")
-        if pfx != "" && !strings.HasSuffix(pfx, "/") {
-                pfx += "/"
+        ae := auditOp(r, "delete-prefix", bucket, normPrefix(req.Prefix))
+        if !p.authorizeKey(w, r, actDelete, bucket, normPrefix(req.Prefix)) {
+                return
         }
 
         start := time.Now()
-        keys, err := p.listAllKeys(ctx, pfx)
+        deleted, failed, err := p.deletePrefix(ctx, bucket, req.Prefix, nil)
         if err != nil {
-                http.Error(w, fmt.Sprintf("list: %v", err), http.StatusBadGateway)
+                upstreamError(w, "list", err)
                 return
         }
-        deleted := 0
-        for _, k := range keys {
-                if err := p.deleteObject(ctx, k); err != nil {
-                        http.Error(w, fmt.Sprintf("delete %s: %v", k, err), http.StatusBadGateway)
-                        return
-                }
-                deleted++
-        }
-        out := deletePrefixResponse{Deleted: deleted, Took: time.Since(start).Milliseconds()}
+        ae.Count = deleted
+        out := deletePrefixResponse{Deleted: deleted, Took: time.Since(start).Milliseconds(), Failed: failed}
         w.Header().Set("Content-Type", "application/json")
         _ = json.NewEncoder(w).Encode(out)
 }
 
+// deletePrefix removes every object (markers included) under prefix.
+func (p *proxy) deletePrefix(ctx context.Context, bucket, prefix string, progress func(total, done int)) (int, []keyFailure, error) {
+        defer p.metrics.observeOperation(jobDeletePrefix, time.Now())
+        keys, err := p.listAllKeys(ctx, bucket, normPrefix(prefix))
+        if err != nil {
+                return 0, nil, err
+        }
+        var onBatch func(n int)
+        if progress != nil {
+                var mu sync.Mutex
+                done := 0
+                progress(len(keys), 0)
+                onBatch = func(n int) {
+                        mu.Lock()
+                        defer mu.Unlock()
+                        done += n
+                        progress(len(keys), done)
+                }
+        }
+        deleted, failed := p.deleteKeys(ctx, bucket, keys, onBatch)
+        return deleted, failed, nil
+}
+
 type ffCursor struct {
     Phase string `json:"p"`           // "dir" | "file"
     After string `json:"a,omitempty"` // relatif au prefix: "scripts/" ou "file.txt"
@@ -753,7 +1237,7 @@ func decodeCursor(s string) (ffCursor, error) {
     return c, nil
 }
 
-func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter string, maxKeys int) (*listBucketResultV2, error) {
+func (p *proxy) s3ListPage(ctx context.Context, bucket, prefix, delimiter, startAfter string, maxKeys int) (*listBucketResultV2, error) {
     if delimiter == "" { delimiter = "/" }
     if maxKeys <= 0 || maxKeys > 1000 { maxKeys = 1000 }
 
@@ -764,12 +1248,7 @@ func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter st
     if prefix != "" { q.Set("prefix", prefix) }
     if startAfter != "" { q.Set("start-after", startAfter) }
 
-    u := *p.origin
-    u.Path = "/" + p.cfg.Bucket
-    u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
-    u.RawQuery = q.Encode()
-
-    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildBucketURL(bucket, q), nil)
     if err != nil { return nil, err }
 
     resp, err := p.signAndDo(ctx, req)
@@ -777,8 +1256,7 @@ func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter st
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        b, _ := io.ReadAll(resp.Body)
-        return nil, fmt.Errorf("list failed: %s %s", resp.Status, strings.TrimSpace(string(b)))
+        return nil, parseS3Error("list", resp)
     }
     b, err := io.ReadAll(resp.Body)
     if err != nil { return nil, err }
@@ -812,12 +1290,22 @@ func isExcluded(rel string, excludes []string) bool {
 
 func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet && r.Method != http.MethodHead {
-        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        httpError(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
     ctx := r.Context()
+    bucket, err := p.queryBucket(r)
+    if err != nil {
+        pathError(w, err)
+        return
+    }
 
     prefix := strings.TrimLeft(r.URL.Query().Get("prefix"), "/") // relatif au bucket root
+    acl := p.access(r, bucket)
+    if !acl.canSee(prefix) {
+        forbidden(w, r, actRead, bucket, prefix)
+        return
+    }
     delimiter := r.URL.Query().Get("delimiter")
     if delimiter == "" { delimiter = "/" }
 
@@ -829,11 +1317,19 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
 
     // Exclusions (relatives au même 'prefix')
     excludes := parseExcludes(r)
+    if r.URL.Query().Get("trash") != "1" {
+        // la corbeille n'apparaît pas dans les listings
+        if rel, ok := p.trashRel(prefix); ok { excludes = append(excludes, rel) }
+    }
+    if rel, ok := p.thumbsRel(prefix); ok { excludes = append(excludes, rel) }
+
+    // Filtre sur les tags (?tag=status:validated) : les dossiers restent visibles
+    tagFilters := parseTagFilters(r)
 
     // Curseur
     cur, err := decodeCursor(r.URL.Query().Get("continuationToken"))
     if err != nil {
-        http.Error(w, "bad continuationToken", http.StatusBadRequest)
+        httpError(w, "bad continuationToken", http.StatusBadRequest)
         return
     }
     if cur.Phase != "dir" && cur.Phase != "file" { cur.Phase = "dir" }
@@ -845,6 +1341,10 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
     seenDirs := map[string]struct{}{}
     const maxAttempts = 200
     attempts := 0
+    // ?tag= coûte une requête S3 par fichier : au-delà, on rend la main avec un curseur
+    const maxTagFetches = 1000
+    tagFetches := 0
+    done := false
 
     for len(items) < limit && attempts < maxAttempts {
         attempts++
@@ -869,9 +1369,9 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
         }
         if prefix != "" && sa != "" { sa = prefix + sa }
 
-        lb, err := p.s3ListPage(ctx, prefix, delimiter, sa, innerMax)
+        lb, err := p.s3ListPage(ctx, bucket, prefix, delimiter, sa, innerMax)
         if err != nil {
-            http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
+            upstreamError(w, "upstream", err)
             return
         }
 
@@ -885,7 +1385,12 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
                     rel = strings.TrimPrefix(rel, prefix)
                 }
                 if rel == "" || !strings.HasSuffix(rel, "/") { continue }
-                if isExcluded(rel, excludes) { continue }
+                if isExcluded(rel, excludes) || !acl.canSee(cp.Prefix) {
+                    // sauté mais dépassé : la page suivante repart après lui
+                    cur.After = rel
+                    progress = true
+                    continue
+                }
 
                 if _, ok := seenDirs[cp.Prefix]; ok { continue }
                 seenDirs[cp.Prefix] = struct{}{}
@@ -937,13 +1442,33 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
 
         // --- Phase fichiers ---
         if cur.Phase == "file" {
+            var pageTags map[string]map[string]string
+            if len(tagFilters) > 0 {
+                keys := make([]string, 0, len(lb.Contents))
+                for _, c := range lb.Contents {
+                    if !strings.HasSuffix(c.Key, "/") && acl.can(actRead, c.Key) { keys = append(keys, c.Key) }
+                }
+                if tagFetches > 0 && tagFetches+len(keys) > maxTagFetches { break }
+                tagFetches += len(keys)
+                if pageTags, err = p.fetchTags(ctx, bucket, keys); err != nil {
+                    upstreamError(w, "tags", err)
+                    return
+                }
+            }
             for _, c := range lb.Contents {
-                if strings.HasSuffix(c.Key, "/") && c.Size == 0 { continue } // marker dossier
                 rel := c.Key
                 if prefix != "" && strings.HasPrefix(rel, prefix) {
                     rel = strings.TrimPrefix(rel, prefix)
                 }
-                if isExcluded(rel, excludes) { continue }
+                skip := strings.HasSuffix(c.Key, "/") && c.Size == 0 // marker dossier
+                skip = skip || isExcluded(rel, excludes) || !acl.can(actRead, c.Key)
+                if skip || len(tagFilters) > 0 && !matchTags(pageTags[c.Key], tagFilters) {
+                    // on avance quand même, sinon une page sans résultat (exclus,
+                    // illisibles ou filtrés) arrêterait le listing
+                    cur.After = rel
+                    progress = true
+                    continue
+                }
 
                 name := c.Key
                 if i := strings.LastIndexByte(name, '/'); i >= 0 { name = name[i+1:] }
@@ -955,6 +1480,7 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
                     Size:         c.Size,
                     LastModified: &t,
                     ETag:         c.ETag,
+                    Tags:         pageTags[c.Key],
                 })
                 cur.After = rel
                 progress = true
@@ -967,12 +1493,44 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
                 break
             }
             if !progress {
-                hasMore = false
+                done = true
                 break
             }
             continue
         }
     }
+    // essais ou budget de tags épuisés : la suite reste à lister, le client repartira du curseur
+    if !done && !hasMore {
+        hasMore = true
+        next = ffCursor{Phase: cur.Phase, After: cur.After}
+    }
+
+    // ?sizes=1 : taille des dossiers depuis l'index (seulement s'il est complet)
+    // et seulement si tout le dossier est lisible, comme /api/stats : sinon la
+    // taille trahirait celle des clés interdites
+    if r.URL.Query().Get("sizes") == "1" {
+        p.index.ensure(bucket)
+        for i := range items {
+            if items[i].Type != "prefix" || !acl.canAll(actRead, items[i].Prefix) { continue }
+            if n, ok := p.index.folderSize(bucket, items[i].Prefix); ok { items[i].Size = n }
+        }
+    }
+
+    // ?tags=1 : les tags de chaque fichier (une requête S3 par fichier)
+    if r.URL.Query().Get("tags") == "1" && len(tagFilters) == 0 {
+        var keys []string
+        for _, it := range items {
+            if it.Type == "content" { keys = append(keys, it.Key) }
+        }
+        tags, err := p.fetchTags(ctx, bucket, keys)
+        if err != nil {
+            upstreamError(w, "tags", err)
+            return
+        }
+        for i := range items {
+            items[i].Tags = tags[items[i].Key]
+        }
+    }
 
     out := listResponseJSON{
         Prefix:    prefix,
@@ -993,14 +1551,17 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
 
 /* ===== Routing & server ===== */
 
-func withCORS(h http.Handler) http.Handler {
+// withCORS allows the origins of CORS_ORIGINS ("*" for any).
+func (p *proxy) withCORS(h http.Handler) http.Handler {
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-                w.Header().Set("Access-Control-Allow-Origin", "*")
+                if origin := p.corsOrigin(r.Header.Get("Origin")); origin != "" {
+                        w.Header().Set("Access-Control-Allow-Origin", origin)
+                }
                 w.Header().Set("Vary", "Origin")
+                w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id")
                 if r.Method == http.MethodOptions {
                         w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, DELETE, POST, OPTIONS")
-                        w.Header().Set("Access-Control-Allow-Headers",
-                                "Content-Type, Content-Length, Range, If-None-Match, If-Modified-Since, Accept, User-Agent")
+                        w.Header().Set("Access-Control-Allow-Headers", preflightHeaders(r.Header.Get("Access-Control-Request-Headers")))
                         w.WriteHeader(http.StatusNoContent)
                         return
                 }
@@ -1008,6 +1569,18 @@ func withCORS(h http.Handler) http.Handler {
         })
 }
 
+func (p *proxy) corsOrigin(origin string) string {
+        for _, o := range p.cfg.CORSOrigins {
+                if o == "*" {
+                        return "*"
+                }
+                if origin != "" && strings.EqualFold(o, origin) {
+                        return origin
+                }
+        }
+        return ""
+}
+
 func (p *proxy) routes() http.Handler {
         mux := http.NewServeMux()
 
@@ -1016,9 +1589,33 @@ func (p *proxy) routes() http.Handler {
         mux.HandleFunc("/api/stats", p.handleStats)
         mux.HandleFunc("/api/rename", p.handleRename)
         mux.HandleFunc("/api/delete-prefix", p.handleDeletePrefix)
-
-        // Static site
-        mux.Handle("/", http.FileServer(http.Dir("/public")))
+        mux.HandleFunc("/api/multipart/create", p.handleMultipartCreate)
+        mux.HandleFunc("/api/multipart/part", p.handleMultipartPart)
+        mux.HandleFunc("/api/multipart/complete", p.handleMultipartComplete)
+        mux.HandleFunc("/api/multipart/abort", p.handleMultipartAbort)
+        mux.HandleFunc("/api/multipart/parts", p.handleMultipartParts)
+        mux.HandleFunc("/api/meta", p.handleMeta)
+        mux.HandleFunc("/api/tags", p.handleTags)
+        mux.Handle("/api/thumb", p.feature("thumbs", http.HandlerFunc(p.handleThumb)))
+        mux.Handle("/api/share", p.feature("share", http.HandlerFunc(p.handleShare)))
+        mux.HandleFunc("/api/buckets", p.handleBuckets)
+        mux.HandleFunc("/api/jobs", p.handleJobs)
+        mux.Handle("/api/zip", p.feature("zip", http.HandlerFunc(p.handleZip)))
+        mux.Handle("/api/extract", p.feature("extract", http.HandlerFunc(p.handleExtract)))
+        mux.Handle("/api/trash", p.feature("trash", http.HandlerFunc(p.handleTrash)))
+        mux.Handle("/api/trash/restore", p.feature("trash", http.HandlerFunc(p.handleTrashRestore)))
+        mux.Handle("/api/trash/purge", p.feature("trash", http.HandlerFunc(p.handleTrashPurge)))
+        mux.Handle("/api/search", p.feature("search", http.HandlerFunc(p.handleSearch)))
+        mux.HandleFunc("/api/whoami", p.handleWhoami)
+        mux.Handle("/api/audit", p.feature("audit", http.HandlerFunc(p.handleAudit)))
+        mux.Handle("/metrics", p.feature("metrics", p.handleMetrics()))
+
+        // Login endpoints of the auth backend, if any
+        p.auth.routes(mux)
+
+        // Static site, and the public prefix for its scripts
+        mux.Handle("/", p.staticHandler())
+        mux.HandleFunc("/assets/js/env.js", p.handleUIEnv)
 
         // S3 proxy endpoints
         mux.HandleFunc("/s3", func(w http.ResponseWriter, r *http.Request) {
@@ -1028,22 +1625,22 @@ func (p *proxy) routes() http.Handler {
                 case http.MethodOptions:
                         w.WriteHeader(http.StatusNoContent)
                 default:
-                        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                        httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 }
         })
 
         mux.HandleFunc("/s3/", func(w http.ResponseWriter, r *http.Request) {
                 switch r.Method {
                 case http.MethodGet, http.MethodHead:
-                        p.handleGetObject(w, r)
+                        p.withShareToken(p.handleGetObject)(w, r)
                 case http.MethodPut:
-                        p.handlePutObject(w, r)
+                        p.withShareToken(p.handlePutObject)(w, r)
                 case http.MethodDelete:
                         p.handleDeleteObject(w, r)
                 case http.MethodOptions:
                         w.WriteHeader(http.StatusNoContent)
                 default:
-                        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+                        httpError(w, "method not allowed", http.StatusMethodNotAllowed)
                 }
         })
 
@@ -1055,15 +1652,31 @@ func (p *proxy) routes() http.Handler {
                 _, _ = w.Write([]byte("ok\n"))
         })
 
-        return withCORS(mux)
+        return p.withRequestLog(p.withBasePath(p.withCORS(p.withMetrics(mux, p.withAuth(p.withAudit(mux))))))
 }
 
 func main() {
+        if parseFlags() {
+                checkConfigAndExit()
+        }
         c := loadCfg()
+        if err := checkCfg(c); err != nil {
+                log.Fatalf("config: %v", err)
+        }
+        setupLogging(c)
         p := newProxy(c)
-        addr := ":" + c.Port
-        log.Printf("garage-s3-proxy listening on %s (bucket=%s, endpoint=%s)", addr, c.Bucket, c.Endpoint)
-        if err := http.ListenAndServe(addr, p.routes()); err != nil {
+        if c.enabled("trash") && c.TrashRetentionDays > 0 {
+                go p.runTrashSweeper()
+        }
+        p.index.ensure(c.Bucket)
+        srv := &http.Server{
+                Addr:              c.ListenAddr,
+                Handler:           p.routes(),
+                ReadHeaderTimeout: c.ServerReadHeaderTimeout,
+                IdleTimeout:       c.ServerIdleTimeout,
+        }
+        slog.Info("garage-s3-proxy listening", "addr", c.ListenAddr, "basePath", c.BasePath, "bucket", c.Bucket, "buckets", c.Buckets, "endpoint", c.Endpoint)
+        if err := srv.ListenAndServe(); err != nil {
                 log.Fatal(err)
         }
 }
\ No newline at end of file
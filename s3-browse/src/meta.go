@@ -0,0 +1,308 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "encoding/xml"
+        "fmt"
+        "io"
+        "net/http"
+        "net/url"
+        "strings"
+        "time"
+)
+
+/* ===== Object metadata: pass-through and /api/meta ===== */
+
+const amzMetaPrefix = "X-Amz-Meta-"
+
+// metaHeaders are the standard headers S3 stores with an object and returns
+// on GET/HEAD, next to the user metadata x-amz-meta-*.
+var metaHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires"}
+
+// forwardedHeaders are the request headers relayed to S3 by forwardRaw; a
+// PUT also carries the metadata.
+var forwardedHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Accept", "User-Agent", "Content-Type"}
+
+func copyRequestHeaders(dst *http.Request, src *http.Request) {
+        for _, h := range forwardedHeaders {
+                if v := src.Header.Get(h); v != "" {
+                        dst.Header.Set(h, v)
+                }
+        }
+        if dst.Method != http.MethodPut {
+                return
+        }
+        if v := src.Header.Get("Content-MD5"); v != "" {
+                dst.Header.Set("Content-MD5", v)
+        }
+        copyObjectMeta(dst.Header, src.Header)
+}
+
+// copyObjectMeta copies the metadata an upload stores with the object, the
+// metaHeaders and x-amz-meta-*: from a PUT, or from the request creating a
+// multipart upload.
+func copyObjectMeta(dst, src http.Header) {
+        for _, h := range metaHeaders {
+                if v := src.Get(h); v != "" {
+                        dst.Set(h, v)
+                }
+        }
+        for k, vv := range src {
+                if strings.HasPrefix(k, amzMetaPrefix) {
+                        dst[k] = vv
+                }
+        }
+}
+
+// allowedRequestHeader is what a CORS preflight may ask to send.
+func allowedRequestHeader(h string) bool {
+        h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+        if strings.HasPrefix(h, amzMetaPrefix) {
+                return true
+        }
+        for _, a := range append(append([]string{"Content-Length", "Content-MD5", "X-Request-Id"}, forwardedHeaders...), metaHeaders...) {
+                if h == a {
+                        return true
+                }
+        }
+        return false
+}
+
+// preflightHeaders answers Access-Control-Request-Headers: the requested
+// headers when all are allowed, else the fixed list (the browser then refuses).
+func preflightHeaders(requested string) string {
+        ok := requested != ""
+        for _, h := range strings.Split(requested, ",") {
+                ok = ok && allowedRequestHeader(h)
+        }
+        if ok {
+                return requested
+        }
+        return "Content-Type, Content-Length, Content-MD5, Range, If-Match, If-None-Match, If-Modified-Since, Accept, User-Agent, X-Request-Id, " +
+                strings.Join(metaHeaders, ", ")
+}
+
+// exposedHeaders lists the response headers a cross-origin UI may read:
+// the usual ones, the stored metadata, and the x-amz-meta-* of h.
+func exposedHeaders(h http.Header) string {
+        out := append([]string{"ETag", "Last-Modified", "Content-Length", "Content-Type", "Content-Range", "Accept-Ranges", requestIDHeader}, metaHeaders...)
+        for k := range h {
+                if strings.HasPrefix(k, amzMetaPrefix) {
+                        out = append(out, k)
+                }
+        }
+        return strings.Join(out, ", ")
+}
+
+/* ----- /api/meta ----- */
+
+// objectMeta is the metadata of one object, as read and written by /api/meta.
+type objectMeta struct {
+        Key                string            `json:"key"`
+        ContentType        string            `json:"contentType,omitempty"`
+        CacheControl       string            `json:"cacheControl,omitempty"`
+        ContentDisposition string            `json:"contentDisposition,omitempty"`
+        ContentEncoding    string            `json:"contentEncoding,omitempty"`
+        ContentLanguage    string            `json:"contentLanguage,omitempty"`
+        Expires            string            `json:"expires,omitempty"`
+        Metadata           map[string]string `json:"metadata"` // x-amz-meta-<name>, names lowercased
+        Size               int64             `json:"size"`
+        ETag               string            `json:"etag,omitempty"`
+        LastModified       string            `json:"lastModified,omitempty"`
+}
+
+func (m *objectMeta) fields() []*string {
+        return []*string{&m.CacheControl, &m.ContentDisposition, &m.ContentEncoding, &m.ContentLanguage, &m.Expires}
+}
+
+// headObject reads the metadata of key.
+func (p *proxy) headObject(ctx context.Context, bucket, key string) (*objectMeta, error) {
+        req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.buildObjectURL(bucket, key, nil), nil)
+        if err != nil {
+                return nil, err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return nil, parseS3Error("head", resp)
+        }
+        m := &objectMeta{
+                Key:          key,
+                ContentType:  resp.Header.Get("Content-Type"),
+                Metadata:     map[string]string{},
+                Size:         resp.ContentLength,
+                ETag:         resp.Header.Get("ETag"),
+                LastModified: resp.Header.Get("Last-Modified"),
+        }
+        for i, f := range m.fields() {
+                *f = resp.Header.Get(metaHeaders[i])
+        }
+        for k, vv := range resp.Header {
+                if strings.HasPrefix(k, amzMetaPrefix) && len(vv) > 0 {
+                        m.Metadata[strings.ToLower(strings.TrimPrefix(k, amzMetaPrefix))] = vv[0]
+                }
+        }
+        return m, nil
+}
+
+// validMeta checks user metadata: token names, printable ASCII values, and
+// the 2 KB S3 puts on names and values together.
+func validMeta(md map[string]string) error {
+        total := 0
+        for k, v := range md {
+                if k == "" {
+                        return fmt.Errorf("empty metadata name")
+                }
+                for _, c := range k {
+                        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.", c)) {
+                                return fmt.Errorf("metadata name %q: letters, digits, '-', '_' and '.' only", k)
+                        }
+                }
+                for _, c := range v {
+                        if c < 0x20 || c > 0x7e {
+                                return fmt.Errorf("metadata %q: value must be printable ASCII", k)
+                        }
+                }
+                total += len(k) + len(v)
+        }
+        if total > 2048 {
+                return fmt.Errorf("metadata too large: %d bytes (2048 max)", total)
+        }
+        return nil
+}
+
+// replaceMeta rewrites the metadata of key with a CopyObject onto itself.
+// ifMatch guards against a concurrent overwrite; it returns the new ETag.
+func (p *proxy) replaceMeta(ctx context.Context, bucket string, m *objectMeta, ifMatch string) (string, error) {
+        req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.buildObjectURL(bucket, m.Key, nil), nil)
+        if err != nil {
+                return "", err
+        }
+        req.Header.Set("x-amz-copy-source", "/"+url.PathEscape(bucket)+"/"+encodeKeyRaw(m.Key))
+        req.Header.Set("x-amz-metadata-directive", "REPLACE")
+        if ifMatch != "" {
+                req.Header.Set("x-amz-copy-source-if-match", ifMatch)
+        }
+        if m.ContentType != "" {
+                req.Header.Set("Content-Type", m.ContentType)
+        }
+        for i, f := range m.fields() {
+                if *f != "" {
+                        req.Header.Set(metaHeaders[i], *f)
+                }
+        }
+        for k, v := range m.Metadata {
+                req.Header.Set(amzMetaPrefix+k, v)
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return "", err
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+        if resp.StatusCode != http.StatusOK {
+                return "", s3ErrorFromBody("replace metadata", resp.StatusCode, body)
+        }
+        var res struct {
+                XMLName xml.Name `xml:"CopyObjectResult"`
+                ETag    string   `xml:"ETag"`
+        }
+        if err := xml.Unmarshal(body, &res); err != nil {
+                // a CopyObject may fail after its 200
+                return "", s3ErrorFromBody("replace metadata", resp.StatusCode, body)
+        }
+        return res.ETag, nil
+}
+
+// handleMeta reads (GET ?key=) or replaces (POST {key, …}) the metadata of
+// an object. A POST replaces everything: fields left out are removed, except
+// contentType which is kept. ifMatch defaults to the current ETag.
+func (p *proxy) handleMeta(w http.ResponseWriter, r *http.Request) {
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        switch r.Method {
+        case http.MethodGet:
+                key := srcToPath(r.URL.Query().Get("key"))
+                if key == "" || strings.HasSuffix(key, "/") {
+                        httpError(w, "key required", http.StatusBadRequest)
+                        return
+                }
+                if !p.authorizeKey(w, r, actRead, bucket, key) {
+                        return
+                }
+                m, err := p.headObject(r.Context(), bucket, key)
+                if err != nil {
+                        upstreamError(w, "", err)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(m)
+
+        case http.MethodPost:
+                var in struct {
+                        objectMeta
+                        IfMatch string `json:"ifMatch"`
+                }
+                if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+                        httpError(w, "bad json", http.StatusBadRequest)
+                        return
+                }
+                m := &in.objectMeta
+                m.Key = srcToPath(m.Key)
+                if m.Key == "" || strings.HasSuffix(m.Key, "/") {
+                        httpError(w, "key required", http.StatusBadRequest)
+                        return
+                }
+                auditOp(r, "meta", bucket, m.Key)
+                if !p.authorizeKey(w, r, actWrite, bucket, m.Key) {
+                        return
+                }
+                lower := map[string]string{}
+                for k, v := range m.Metadata {
+                        lower[strings.ToLower(k)] = v
+                }
+                m.Metadata = lower
+                if err := validMeta(m.Metadata); err != nil {
+                        httpError(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+                if m.Expires != "" {
+                        if _, err := http.ParseTime(m.Expires); err != nil {
+                                httpError(w, "expires: HTTP date expected", http.StatusBadRequest)
+                                return
+                        }
+                }
+
+                cur, err := p.headObject(r.Context(), bucket, m.Key)
+                if err != nil {
+                        upstreamError(w, "", err)
+                        return
+                }
+                if in.IfMatch == "" {
+                        in.IfMatch = cur.ETag
+                }
+                if m.ContentType == "" {
+                        m.ContentType = cur.ContentType
+                }
+                etag, err := p.replaceMeta(r.Context(), bucket, m, in.IfMatch)
+                if err != nil {
+                        upstreamError(w, "", err)
+                        return
+                }
+                p.index.notePut(bucket, m.Key, cur.Size, etag)
+
+                m.Size, m.ETag, m.LastModified = cur.Size, etag, time.Now().UTC().Format(http.TimeFormat)
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(m)
+
+        default:
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+}
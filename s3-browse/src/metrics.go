@@ -0,0 +1,168 @@
+package main
+
+import (
+        "crypto/subtle"
+        "net/http"
+        "strconv"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/collectors"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/* ===== Prometheus metrics: /metrics ===== */
+
+// metrics has its own registry: /metrics serves exactly what is registered below.
+type metrics struct {
+        reg *prometheus.Registry
+
+        requests      *prometheus.CounterVec   // route, method, code
+        duration      *prometheus.HistogramVec // route, method
+        inFlight      *prometheus.GaugeVec     // route
+        bytes         *prometheus.CounterVec   // route, direction
+        upstream      *prometheus.CounterVec   // method, code
+        upstreamTime  *prometheus.HistogramVec // method
+        operationTime *prometheus.HistogramVec // op
+
+        upstreamRetries *prometheus.CounterVec // method
+        breakerOpen     prometheus.Gauge
+        breakerRejected prometheus.Counter
+}
+
+func newMetrics() *metrics {
+        m := &metrics{
+                reg: prometheus.NewRegistry(),
+                requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "s3browse_http_requests_total",
+                        Help: "HTTP requests served, by route, method and status code.",
+                }, []string{"route", "method", "code"}),
+                duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                        Name:    "s3browse_http_request_duration_seconds",
+                        Help:    "Time to serve an HTTP request, body included.",
+                        Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+                }, []string{"route", "method"}),
+                inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "s3browse_http_requests_in_flight",
+                        Help: "HTTP requests being served.",
+                }, []string{"route"}),
+                bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "s3browse_http_bytes_total",
+                        Help: "Bytes read from clients (in) and written to them (out).",
+                }, []string{"route", "direction"}),
+                upstream: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "s3browse_upstream_requests_total",
+                        Help: "Signed requests sent to S3, by method and status code (\"error\" when no response came back).",
+                }, []string{"method", "code"}),
+                upstreamTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                        Name:    "s3browse_upstream_request_duration_seconds",
+                        Help:    "Time until S3 answered with headers.",
+                        Buckets: prometheus.DefBuckets,
+                }, []string{"method"}),
+                operationTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                        Name:    "s3browse_operation_duration_seconds",
+                        Help:    "Duration of rename, delete-prefix and stats operations, inline or as jobs.",
+                        Buckets: prometheus.ExponentialBuckets(0.05, 4, 9), // 50ms .. ~55min
+                }, []string{"op"}),
+                upstreamRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "s3browse_upstream_retries_total",
+                        Help: "Upstream requests sent again after a transient failure.",
+                }, []string{"method"}),
+                breakerOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+                        Name: "s3browse_upstream_breaker_open",
+                        Help: "1 while the circuit breaker in front of S3 is open.",
+                }),
+                breakerRejected: prometheus.NewCounter(prometheus.CounterOpts{
+                        Name: "s3browse_upstream_breaker_rejected_total",
+                        Help: "Upstream requests failed fast because the circuit breaker was open.",
+                }),
+        }
+        m.reg.MustRegister(m.requests, m.duration, m.inFlight, m.bytes, m.upstream, m.upstreamTime, m.operationTime,
+                m.upstreamRetries, m.breakerOpen, m.breakerRejected,
+                collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+        return m
+}
+
+// observeUpstream counts one round trip to S3, each retry included.
+func (m *metrics) observeUpstream(method string, resp *http.Response, err error, start time.Time) {
+        code := "error"
+        if err == nil {
+                code = strconv.Itoa(resp.StatusCode)
+        }
+        m.upstream.WithLabelValues(method, code).Inc()
+        m.upstreamTime.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// observeOperation is deferred by the bulk operations:
+//
+//	defer p.metrics.observeOperation("rename", time.Now())
+func (m *metrics) observeOperation(op string, start time.Time) {
+        m.operationTime.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// statusWriter keeps the status and counts the bytes written, for the
+// metrics and the access log.
+type statusWriter struct {
+        http.ResponseWriter
+        status int
+        n      int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+        if w.status == 0 {
+                w.status = code
+        }
+        w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+        if w.status == 0 {
+                w.status = http.StatusOK
+        }
+        n, err := w.ResponseWriter.Write(b)
+        w.n += int64(n)
+        return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// withMetrics instruments h, labelling requests with the mux pattern they
+// are routed to ("/api/list", "/s3/", "/" for static files…) to keep the
+// label set small.
+func (p *proxy) withMetrics(mux *http.ServeMux, h http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                _, route := mux.Handler(r)
+                if route == "" {
+                        route = "unmatched"
+                }
+                m := p.metrics
+                start := time.Now()
+                m.inFlight.WithLabelValues(route).Inc()
+                defer m.inFlight.WithLabelValues(route).Dec()
+
+                mw := &statusWriter{ResponseWriter: w}
+                h.ServeHTTP(mw, r)
+
+                if mw.status == 0 {
+                        mw.status = http.StatusOK
+                }
+                m.requests.WithLabelValues(route, r.Method, strconv.Itoa(mw.status)).Inc()
+                m.duration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+                m.bytes.WithLabelValues(route, "in").Add(float64(requestInfoFrom(r.Context()).bytesIn()))
+                m.bytes.WithLabelValues(route, "out").Add(float64(mw.n))
+        })
+}
+
+// handleMetrics serves the registry, behind METRICS_TOKEN when it is set.
+func (p *proxy) handleMetrics() http.Handler {
+        h := promhttp.HandlerFor(p.metrics.reg, promhttp.HandlerOpts{})
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if tok := p.cfg.MetricsToken; tok != "" {
+                        if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+tok)) != 1 {
+                                httpError(w, "unauthorized", http.StatusUnauthorized)
+                                return
+                        }
+                }
+                h.ServeHTTP(w, r)
+        })
+}
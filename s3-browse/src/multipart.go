@@ -0,0 +1,430 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "encoding/xml"
+        "fmt"
+        "io"
+        "net/http"
+        "net/url"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+/* ===== Multipart upload APIs: /api/multipart/* ===== */
+
+type initiateMultipartUploadResult struct {
+        XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+        Bucket   string   `xml:"Bucket"`
+        Key      string   `xml:"Key"`
+        UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+        XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+        Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+        PartNumber int    `xml:"PartNumber" json:"partNumber"`
+        ETag       string `xml:"ETag" json:"etag"`
+}
+
+type completeMultipartUploadResult struct {
+        XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+        Location string   `xml:"Location"`
+        Bucket   string   `xml:"Bucket"`
+        Key      string   `xml:"Key"`
+        ETag     string   `xml:"ETag"`
+}
+
+type listPartsResult struct {
+        XMLName              xml.Name `xml:"ListPartsResult"`
+        IsTruncated          bool     `xml:"IsTruncated"`
+        NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+        Parts                []struct {
+                PartNumber   int       `xml:"PartNumber"`
+                LastModified time.Time `xml:"LastModified"`
+                ETag         string    `xml:"ETag"`
+                Size         int64     `xml:"Size"`
+        } `xml:"Part"`
+}
+
+type multipartCreateRequest struct {
+        Key         string `json:"key"`
+        ContentType string `json:"contentType"`
+}
+
+type multipartCreateResponse struct {
+        Key      string `json:"key"`
+        UploadID string `json:"uploadId"`
+}
+
+type multipartPartResponse struct {
+        PartNumber int    `json:"partNumber"`
+        ETag       string `json:"etag"`
+}
+
+type multipartCompleteRequest struct {
+        Key      string         `json:"key"`
+        UploadID string         `json:"uploadId"`
+        Parts    []completePart `json:"parts"`
+}
+
+type multipartCompleteResponse struct {
+        Key  string `json:"key"`
+        ETag string `json:"etag"`
+        Took int64  `json:"tookMs"`
+}
+
+type multipartAbortRequest struct {
+        Key      string `json:"key"`
+        UploadID string `json:"uploadId"`
+}
+
+type multipartPartJSON struct {
+        PartNumber   int        `json:"partNumber"`
+        ETag         string     `json:"etag"`
+        Size         int64      `json:"size"`
+        LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
+type multipartPartsResponse struct {
+        Key      string              `json:"key"`
+        UploadID string              `json:"uploadId"`
+        Parts    []multipartPartJSON `json:"parts"`
+}
+
+// S3 refuses part numbers outside 1..10000.
+const maxPartNumber = 10000
+
+func (p *proxy) handleMultipartCreate(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req multipartCreateRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        key := srcToPath(req.Key)
+        if key == "" || strings.HasSuffix(key, "/") {
+                httpError(w, "bad key", http.StatusBadRequest)
+                return
+        }
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+
+        u := p.buildObjectURL(bucket, key, nil) + "?uploads"
+        upReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+        if err != nil {
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        ct := req.ContentType
+        if ct == "" {
+                ct = "application/octet-stream"
+        }
+        upReq.Header.Set("Content-Type", ct)
+        copyObjectMeta(upReq.Header, r.Header) // Cache-Control, x-amz-meta-*… as on a PUT
+
+        resp, err := p.signAndDo(ctx, upReq)
+        if err != nil {
+                upstreamError(w, "upstream", err)
+                return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                s3Failed(w, "create multipart", resp)
+                return
+        }
+        var res initiateMultipartUploadResult
+        if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+                upstreamError(w, "xml", err)
+                return
+        }
+
+        out := multipartCreateResponse{Key: key, UploadID: res.UploadID}
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+// handleMultipartPart streams one part: PUT /api/multipart/part?key=&uploadId=&partNumber=
+func (p *proxy) handleMultipartPart(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPut {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        qs := r.URL.Query()
+        key := srcToPath(qs.Get("key"))
+        uploadID := qs.Get("uploadId")
+        partNumber, err := strconv.Atoi(qs.Get("partNumber"))
+        if key == "" || uploadID == "" || err != nil || partNumber < 1 || partNumber > maxPartNumber {
+                httpError(w, "bad key, uploadId or partNumber", http.StatusBadRequest)
+                return
+        }
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+        if r.ContentLength < 0 {
+                httpError(w, "content-length required", http.StatusLengthRequired)
+                return
+        }
+
+        q := url.Values{}
+        q.Set("partNumber", strconv.Itoa(partNumber))
+        q.Set("uploadId", uploadID)
+        upReq, err := http.NewRequestWithContext(ctx, http.MethodPut, p.buildObjectURL(bucket, key, q), r.Body)
+        if err != nil {
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        upReq.ContentLength = r.ContentLength
+        if md5 := r.Header.Get("Content-MD5"); md5 != "" {
+                upReq.Header.Set("Content-MD5", md5)
+        }
+
+        resp, err := p.signAndDo(ctx, upReq)
+        if err != nil {
+                upstreamError(w, "upstream", err)
+                return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                s3Failed(w, "upload part", resp)
+                return
+        }
+        _, _ = io.Copy(io.Discard, resp.Body)
+
+        out := multipartPartResponse{PartNumber: partNumber, ETag: resp.Header.Get("ETag")}
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+func (p *proxy) handleMultipartComplete(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req multipartCompleteRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        key := srcToPath(req.Key)
+        if key == "" || req.UploadID == "" || len(req.Parts) == 0 {
+                httpError(w, "bad key, uploadId or parts", http.StatusBadRequest)
+                return
+        }
+        auditOp(r, "multipart-complete", bucket, key)
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+
+        // S3 wants parts in ascending order; the browser finishes them in any order.
+        parts := append([]completePart(nil), req.Parts...)
+        sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+        for i, pt := range parts {
+                if pt.PartNumber < 1 || pt.PartNumber > maxPartNumber || pt.ETag == "" {
+                        httpError(w, fmt.Sprintf("bad part #%d", pt.PartNumber), http.StatusBadRequest)
+                        return
+                }
+                if i > 0 && parts[i-1].PartNumber == pt.PartNumber {
+                        httpError(w, fmt.Sprintf("duplicate part #%d", pt.PartNumber), http.StatusBadRequest)
+                        return
+                }
+                if !strings.HasPrefix(pt.ETag, `"`) {
+                        parts[i].ETag = `"` + pt.ETag + `"`
+                }
+        }
+        payload, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+        if err != nil {
+                httpError(w, fmt.Sprintf("xml: %v", err), http.StatusInternalServerError)
+                return
+        }
+
+        start := time.Now()
+        q := url.Values{}
+        q.Set("uploadId", req.UploadID)
+        upReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.buildObjectURL(bucket, key, q), bytes.NewReader(payload))
+        if err != nil {
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        upReq.Header.Set("Content-Type", "application/xml")
+
+        resp, err := p.signAndDo(ctx, upReq)
+        if err != nil {
+                upstreamError(w, "upstream", err)
+                return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                s3Failed(w, "complete multipart", resp)
+                return
+        }
+        // CompleteMultipartUpload may answer 200 with an <Error> body.
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+                upstreamError(w, "read", err)
+                return
+        }
+        var res completeMultipartUploadResult
+        if err := xml.Unmarshal(body, &res); err != nil {
+                writeError(w, s3ErrorFromBody("complete multipart", resp.StatusCode, body))
+                return
+        }
+
+        p.index.noteUpload(ctx, bucket, key)
+
+        out := multipartCompleteResponse{Key: key, ETag: res.ETag, Took: time.Since(start).Milliseconds()}
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+func (p *proxy) handleMultipartAbort(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req multipartAbortRequest
+        if r.Method == http.MethodPost {
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        httpError(w, "bad json", http.StatusBadRequest)
+                        return
+                }
+        } else {
+                req.Key = r.URL.Query().Get("key")
+                req.UploadID = r.URL.Query().Get("uploadId")
+        }
+        key := srcToPath(req.Key)
+        if key == "" || req.UploadID == "" {
+                httpError(w, "bad key or uploadId", http.StatusBadRequest)
+                return
+        }
+        auditOp(r, "multipart-abort", bucket, key)
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+
+        q := url.Values{}
+        q.Set("uploadId", req.UploadID)
+        upReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.buildObjectURL(bucket, key, q), nil)
+        if err != nil {
+                httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        resp, err := p.signAndDo(ctx, upReq)
+        if err != nil {
+                upstreamError(w, "upstream", err)
+                return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+                s3Failed(w, "abort multipart", resp)
+                return
+        }
+        w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMultipartParts lists the parts already stored, so an interrupted upload
+// can resume where it stopped: GET /api/multipart/parts?key=&uploadId=
+func (p *proxy) handleMultipartParts(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        key := srcToPath(r.URL.Query().Get("key"))
+        uploadID := r.URL.Query().Get("uploadId")
+        if key == "" || uploadID == "" {
+                httpError(w, "bad key or uploadId", http.StatusBadRequest)
+                return
+        }
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+
+        out := multipartPartsResponse{Key: key, UploadID: uploadID, Parts: []multipartPartJSON{}}
+        marker := 0
+        for {
+                q := url.Values{}
+                q.Set("uploadId", uploadID)
+                q.Set("max-parts", "1000")
+                if marker > 0 {
+                        q.Set("part-number-marker", strconv.Itoa(marker))
+                }
+                upReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildObjectURL(bucket, key, q), nil)
+                if err != nil {
+                        httpError(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                        return
+                }
+                resp, err := p.signAndDo(ctx, upReq)
+                if err != nil {
+                        upstreamError(w, "upstream", err)
+                        return
+                }
+                if resp.StatusCode != http.StatusOK {
+                        s3Failed(w, "list parts", resp)
+                        resp.Body.Close()
+                        return
+                }
+                var lp listPartsResult
+                err = xml.NewDecoder(resp.Body).Decode(&lp)
+                resp.Body.Close()
+                if err != nil {
+                        upstreamError(w, "xml", err)
+                        return
+                }
+                for _, pt := range lp.Parts {
+                        t := pt.LastModified
+                        out.Parts = append(out.Parts, multipartPartJSON{
+                                PartNumber:   pt.PartNumber,
+                                ETag:         pt.ETag,
+                                Size:         pt.Size,
+                                LastModified: &t,
+                        })
+                }
+                if !lp.IsTruncated || lp.NextPartNumberMarker <= marker {
+                        break
+                }
+                marker = lp.NextPartNumberMarker
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
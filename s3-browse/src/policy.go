@@ -0,0 +1,379 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "path"
+        "path/filepath"
+        "strings"
+        "sync"
+        "time"
+
+        "gopkg.in/yaml.v3"
+)
+
+/* ===== Access policies: POLICY_FILE (YAML or JSON) ===== */
+
+// A policy file grants actions on key prefixes to users and groups:
+//
+//	default: deny            # when no rule matches: deny (default) | allow
+//	rules:
+//	  - subjects: [group:teamA]
+//	    prefixes: [teamA/]
+//	    actions: [read, write, delete]
+//	  - subjects: [group:teamA]
+//	    prefixes: [shared/]
+//	    actions: [read]
+//	  - subjects: ["*"]
+//	    buckets: [default]      # path.Match patterns, all buckets when empty
+//	    prefixes: [home/${user}/]
+//	    actions: ["*"]
+//	  - subjects: [user:intern]
+//	    prefixes: [teamA/secret/]
+//	    actions: [read]
+//	    effect: deny            # deny always wins over allow
+//
+// Subjects are user:<name>, group:<name> or "*" (anyone authenticated); a
+// bare name is a user. An empty prefix list means the whole bucket. Without
+// POLICY_FILE everything is allowed, as before.
+
+const (
+        actRead   = "read" // get, list, stats, search, zip
+        actWrite  = "write"
+        actDelete = "delete"
+)
+
+type policyFile struct {
+        Default string       `json:"default" yaml:"default"`
+        Rules   []policyRule `json:"rules" yaml:"rules"`
+}
+
+type policyRule struct {
+        Subjects []string `json:"subjects" yaml:"subjects"`
+        Buckets  []string `json:"buckets" yaml:"buckets"`
+        Prefixes []string `json:"prefixes" yaml:"prefixes"`
+        Actions  []string `json:"actions" yaml:"actions"`
+        Effect   string   `json:"effect" yaml:"effect"` // allow (default) | deny
+}
+
+func (pf *policyFile) validate() error {
+        switch pf.Default {
+        case "":
+                pf.Default = "deny"
+        case "allow", "deny":
+        default:
+                return fmt.Errorf("default must be allow or deny, got %q", pf.Default)
+        }
+        for i := range pf.Rules {
+                ru := &pf.Rules[i]
+                if len(ru.Subjects) == 0 || len(ru.Actions) == 0 {
+                        return fmt.Errorf("rule %d: subjects and actions are required", i+1)
+                }
+                switch ru.Effect {
+                case "":
+                        ru.Effect = "allow"
+                case "allow", "deny":
+                default:
+                        return fmt.Errorf("rule %d: effect must be allow or deny, got %q", i+1, ru.Effect)
+                }
+                for _, a := range ru.Actions {
+                        switch a {
+                        case actRead, actWrite, actDelete, "*":
+                        default:
+                                return fmt.Errorf("rule %d: unknown action %q (read, write, delete or *)", i+1, a)
+                        }
+                }
+                for _, b := range ru.Buckets {
+                        if _, err := path.Match(b, ""); err != nil {
+                                return fmt.Errorf("rule %d: bad bucket pattern %q", i+1, b)
+                        }
+                }
+                for j, pfx := range ru.Prefixes {
+                        if pfx == "*" {
+                                pfx = ""
+                        }
+                        ru.Prefixes[j] = strings.TrimLeft(pfx, "/")
+                }
+        }
+        return nil
+}
+
+// policyEngine holds the policy file, reloaded when its mtime changes. A nil
+// engine (no POLICY_FILE) allows everything.
+type policyEngine struct {
+        file string
+
+        mu    sync.Mutex
+        mtime time.Time
+        pf    *policyFile
+}
+
+func newPolicyEngine(file string) *policyEngine {
+        if file == "" {
+                return nil
+        }
+        e := &policyEngine{file: file}
+        if _, err := e.current(); err != nil {
+                log.Fatalf("policy: %v", err)
+        }
+        return e
+}
+
+// current returns the loaded policy; when the file became unreadable or
+// invalid the previous version stays in force.
+func (e *policyEngine) current() (*policyFile, error) {
+        e.mu.Lock()
+        defer e.mu.Unlock()
+        st, err := os.Stat(e.file)
+        if err != nil {
+                return e.pf, err
+        }
+        if e.pf != nil && st.ModTime().Equal(e.mtime) {
+                return e.pf, nil
+        }
+        b, err := os.ReadFile(e.file)
+        if err != nil {
+                return e.pf, err
+        }
+        pf := &policyFile{}
+        if strings.EqualFold(filepath.Ext(e.file), ".json") {
+                dec := json.NewDecoder(strings.NewReader(string(b)))
+                dec.DisallowUnknownFields()
+                err = dec.Decode(pf)
+        } else {
+                dec := yaml.NewDecoder(strings.NewReader(string(b)))
+                dec.KnownFields(true)
+                err = dec.Decode(pf)
+        }
+        if err == nil {
+                err = pf.validate()
+        }
+        if err != nil {
+                return e.pf, fmt.Errorf("%s: %w", e.file, err)
+        }
+        if e.pf != nil {
+                log.Printf("policy: reloaded %s (%d rules)", e.file, len(pf.Rules))
+        }
+        e.pf, e.mtime = pf, st.ModTime()
+        return pf, nil
+}
+
+// access is what one principal may do in one bucket, the rules that apply
+// flattened into prefixes per action.
+type access struct {
+        all         bool // no policy, or a share link already checked by withShareToken
+        defAllow    bool
+        allow, deny map[string][]string // action -> prefixes, "" = whole bucket
+        thumbs      string              // THUMB_PREFIX, see source
+}
+
+func (p *proxy) access(r *http.Request, bucket string) *access {
+        pr := principalFrom(r)
+        if p.policy == nil || pr.Method == "share" {
+                return &access{all: true}
+        }
+        pf, err := p.policy.current()
+        if err != nil {
+                log.Printf("policy: %v", err)
+        }
+        a := &access{defAllow: pf.Default == "allow", allow: map[string][]string{}, deny: map[string][]string{}, thumbs: p.cfg.ThumbPrefix}
+        for _, ru := range pf.Rules {
+                if !subjectMatch(ru.Subjects, pr) || !bucketMatch(ru.Buckets, bucket) {
+                        continue
+                }
+                prefixes := ru.Prefixes
+                if len(prefixes) == 0 {
+                        prefixes = []string{""}
+                }
+                dst := a.allow
+                if ru.Effect == "deny" {
+                        dst = a.deny
+                }
+                for _, act := range ru.Actions {
+                        acts := []string{act}
+                        if act == "*" {
+                                acts = []string{actRead, actWrite, actDelete}
+                        }
+                        for _, act := range acts {
+                                for _, pfx := range prefixes {
+                                        dst[act] = append(dst[act], strings.ReplaceAll(pfx, "${user}", pr.User))
+                                }
+                        }
+                }
+        }
+        return a
+}
+
+func subjectMatch(subjects []string, pr *principal) bool {
+        for _, s := range subjects {
+                kind, name, ok := strings.Cut(s, ":")
+                if !ok {
+                        kind, name = "user", s
+                }
+                switch {
+                case s == "*":
+                        return true
+                case kind == "user" && name == pr.User:
+                        return true
+                case kind == "group":
+                        for _, g := range pr.Groups {
+                                if g == name {
+                                        return true
+                                }
+                        }
+                }
+        }
+        return false
+}
+
+func bucketMatch(patterns []string, bucket string) bool {
+        if len(patterns) == 0 {
+                return true
+        }
+        for _, pat := range patterns {
+                if ok, _ := path.Match(pat, bucket); ok {
+                        return true
+                }
+        }
+        return false
+}
+
+// source maps a key or prefix under the thumbnails to the image it was
+// made from, so that a thumbnail is only reached by who may reach the image:
+// THUMB_PREFIX a/b.jpg/<etag>-256x256-contain.jpg is a/b.jpg, the prefix
+// THUMB_PREFIX a/ is a/. A prefix above the thumbnails covers every image.
+func (a *access) source(key string, object bool) string {
+        switch {
+        case a.thumbs == "":
+        case strings.HasPrefix(key, a.thumbs):
+                key = strings.TrimPrefix(key, a.thumbs)
+                if i := strings.LastIndex(key, "/"); object && i >= 0 {
+                        key = key[:i]
+                }
+        case !object && key != "" && strings.HasPrefix(a.thumbs, key):
+                key = ""
+        }
+        return key
+}
+
+// can reports whether action is allowed on key.
+func (a *access) can(action, key string) bool {
+        if a.all {
+                return true
+        }
+        key = a.source(key, true)
+        for _, pfx := range a.deny[action] {
+                if strings.HasPrefix(key, pfx) {
+                        return false
+                }
+        }
+        for _, pfx := range a.allow[action] {
+                if strings.HasPrefix(key, pfx) {
+                        return true
+                }
+        }
+        return a.defAllow
+}
+
+// canAll reports whether action is allowed on every key under prefix.
+func (a *access) canAll(action, prefix string) bool {
+        if a.all {
+                return true
+        }
+        prefix = a.source(prefix, false)
+        for _, pfx := range a.deny[action] {
+                if overlaps(prefix, pfx) {
+                        return false
+                }
+        }
+        for _, pfx := range a.allow[action] {
+                if strings.HasPrefix(prefix, pfx) {
+                        return true
+                }
+        }
+        return a.defAllow
+}
+
+// canSee reports whether some key under prefix may be read, i.e. whether the
+// folder shows up in listings.
+func (a *access) canSee(prefix string) bool {
+        if a.all {
+                return true
+        }
+        prefix = a.source(prefix, false)
+        for _, pfx := range a.deny[actRead] {
+                if strings.HasPrefix(prefix, pfx) {
+                        return false
+                }
+        }
+        for _, pfx := range a.allow[actRead] {
+                if overlaps(prefix, pfx) {
+                        return true
+                }
+        }
+        return a.defAllow
+}
+
+func overlaps(a, b string) bool {
+        return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// forbidden answers a request denied by the policy.
+func forbidden(w http.ResponseWriter, r *http.Request, action, bucket, key string) {
+        e := newAPIError(http.StatusForbidden, "AccessDenied",
+                fmt.Sprintf("%s may not %s %s/%s", principalFrom(r).User, action, bucket, key))
+        e.Bucket, e.Key = bucket, key
+        writeError(w, e)
+}
+
+// authorizeObject checks action on the object of an /s3/ request; a request
+// on the bucket itself (a raw listing) needs it on the whole ?prefix=.
+func (p *proxy) authorizeObject(w http.ResponseWriter, r *http.Request, action string) bool {
+        bucket, key, err := p.splitBucketKey(r)
+        if err != nil {
+                pathError(w, err)
+                return false
+        }
+        if key == "" {
+                return p.authorizeListing(w, r, bucket)
+        }
+        return p.authorizeKey(w, r, action, bucket, key)
+}
+
+// authorizeListing checks a raw ListObjects, which needs read on everything
+// under its ?prefix= since the XML is passed through unfiltered.
+func (p *proxy) authorizeListing(w http.ResponseWriter, r *http.Request, bucket string) bool {
+        prefix := r.URL.Query().Get("prefix")
+        if !p.access(r, bucket).canAll(actRead, prefix) {
+                forbidden(w, r, actRead, bucket, prefix)
+                return false
+        }
+        return true
+}
+
+// authorizeKey checks action on key; an empty key or one ending in "/" is a
+// prefix and needs action on everything under it.
+func (p *proxy) authorizeKey(w http.ResponseWriter, r *http.Request, action, bucket, key string) bool {
+        a := p.access(r, bucket)
+        ok := a.can(action, key)
+        if key == "" || strings.HasSuffix(key, "/") {
+                ok = a.canAll(action, key)
+        }
+        if !ok {
+                forbidden(w, r, action, bucket, key)
+        }
+        return ok
+}
+
+// authorizeMove checks a move of src to dst, keys or prefixes.
+func (p *proxy) authorizeMove(w http.ResponseWriter, r *http.Request, bucket, src, dst string) bool {
+        for _, c := range []struct{ action, key string }{{actRead, src}, {actDelete, src}, {actWrite, dst}} {
+                if !p.authorizeKey(w, r, c.action, bucket, c.key) {
+                        return false
+                }
+        }
+        return true
+}
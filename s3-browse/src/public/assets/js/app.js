@@ -2,12 +2,15 @@
 const config = {
   primaryColor: '#167df0',
   allowDownloadAll: true,
-  bucketUrl: '/s3',
-  bucketMaskUrl: '/s3',
+  bucket: '',          // rempli par BB.api.initBucket() (/api/buckets)
+  bucketUrl: (window.BB?.base || '') + '/s3',
+  bucketMaskUrl: (window.BB?.base || '') + '/s3',
   rootPrefix: '',
   trashPrefix: '_trash/',
+  shareMode: 'presigned', // 'presigned' (URL S3 signée) | 'proxy' (lien /s3/ avec jeton HMAC)
   keyExcludePatterns: [/^index\.html$/],
   pageSize: 50,
+  multipartThreshold: 64 * 1024 * 1024,
   defaultOrder: 'name-asc'
 };
 window.BB = window.BB || {};
@@ -42,8 +45,8 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
   const htmlPrefix = 'HTML>';
   if (config.title) config.titleHTML = config.title.startsWith(htmlPrefix) ? config.title.substring(htmlPrefix.length) : config.title.escapeHTML();
   if (config.subtitle) config.subtitleHTML = config.subtitle.startsWith(htmlPrefix) ? config.subtitle.substring(htmlPrefix.length) : config.subtitle.escapeHTML();
-  config.bucketUrl = config.bucketUrl || '/s3';
-  config.bucketMaskUrl = config.bucketMaskUrl || '/s3';
+  config.bucketUrl = config.bucketUrl || BB.api.baseUrl('/s3');
+  config.bucketMaskUrl = config.bucketMaskUrl || BB.api.baseUrl('/s3');
   config.rootPrefix = (config.rootPrefix || '');
   if (config.rootPrefix) config.rootPrefix = config.rootPrefix.replace(/\/?$/, '/');
   document.title = config.title || 'Bucket Browser';
@@ -55,11 +58,17 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
 })();
 
 /* ===== App ===== */
-(function main() {
+(async function main() {
+  const { buckets } = await BB.api.initBucket();
+  const me = await BB.api.whoami().catch(() => null);
+  config.disabledFeatures = me?.disabledFeatures || [];
   const app = Vue.createApp({
     data() {
       return {
         config,
+        bucket: config.bucket,
+        buckets,
+        me,
         pathPrefix: '',
         searchPrefix: '',
         pathContentTableData: [],
@@ -67,11 +76,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         continuationToken: undefined,
         nextContinuationToken: undefined,
         windowWidth: window.innerWidth,
-        downloadAllFilesCount: null,
-        downloadAllFilesReceivedCount: null,
-        downloadAllFilesProgress: null,
         isRefreshing: false,
-        hasFflate: typeof window !== 'undefined' && !!window.fflate,
         pageSize: config.pageSize || 50   // server-side page size
       };
     },
@@ -81,11 +86,20 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
       bucketPrefix() { return `${config.rootPrefix}${this.pathPrefix || ''}`; },
       canDownloadAll() {
         const filesCount = this.pathContentTableData.filter(i => i.type === 'content').length;
-        return this.config.allowDownloadAll && filesCount >= 2;
+        return this.config.allowDownloadAll && this.hasFeature('zip') && filesCount >= 2;
       },
       currentPage() { return (this.previousContinuationTokens?.length || 0) + 1; }
     },
     watch: {
+      bucket(name) {
+        if (!name || name === config.bucket) return;
+        BB.api.useBucket(name);
+        this.previousContinuationTokens = [];
+        this.continuationToken = undefined;
+        this.nextContinuationToken = undefined;
+        if (window.location.hash) window.location.hash = '';
+        else this.refresh();
+      },
       pathPrefix() {
         const pp = (this.pathPrefix || '');
         this.previousContinuationTokens = [];
@@ -141,6 +155,11 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         if (isCodeExt(e))          return 'file-code-outline';
         return 'file-outline';
       },
+      // Miniature des images (/api/thumb), l’icône si elle échoue (trop grosse, illisible…)
+      rowThumb(row) {
+        if (row.type !== 'content' || row.thumbFailed || !this.hasFeature('thumbs') || !isImageExt(extOf(row.name))) return '';
+        return BB.api.thumbUrl(row.key, { w: 48, fit: 'cover', etag: row.etag });
+      },
 
       /* Search / nav (server-side: prefix) */
       validBucketPrefix(prefix) {
@@ -151,12 +170,41 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         return true;
       },
       searchByPrefix() {
+        // glob (**/*.pdf) ou regex (re:...) -> recherche dans l'index du serveur
+        const text = (this.searchPrefix || '').trim();
+        if (/[*?[]/.test(text)) return this.searchIndex({ glob: text });
+        if (text.startsWith('re:')) return this.searchIndex({ regex: text.slice(3) });
         if (this.validBucketPrefix(this.searchPrefix)) {
           const dir = (this.pathPrefix || '').replace(/[^/]*$/, '');
           const nextPath = dir + this.searchPrefix;
           if (('#' + nextPath) !== window.location.hash) window.location.hash = nextPath;
         }
       },
+      async searchIndex(params) {
+        if (this.isRefreshing) return;
+        this.isRefreshing = true;
+        try {
+          const prefix = this.bucketPrefix || '';
+          const data = await BB.api.search({ ...params, prefix, limit: 1000 });
+          const base = (BB.cfg.bucketUrl || '/s3').replace(/\/*$/, '');
+          this.nextContinuationToken = undefined;
+          this.pathContentTableData = data.items.map(it => ({
+            type: 'content',
+            name: it.key.slice(prefix.length), // relatif au dossier courant, pour les actions de ligne
+            key: it.key,
+            size: it.size || 0,
+            dateModified: it.lastModified ? new Date(it.lastModified) : null,
+            url: `${base}/${BB.detect.encodePath(it.key)}`
+          }));
+          if (data.index && data.index.indexing && !data.index.indexedAt) BB.ui.toast('Indexation en cours, résultats partiels.');
+          else if (data.truncated) BB.ui.toast(`${data.total} résultats, ${data.items.length} affichés.`);
+          else if (!data.items.length) BB.ui.toast('Aucun résultat.');
+        } catch (error) {
+          BB.ui.toast((error && (error.message || error))?.toString() || 'Error');
+        } finally {
+          this.isRefreshing = false;
+        }
+      },
       previousPage() {
         if (this.previousContinuationTokens.length > 0) {
           this.continuationToken = this.previousContinuationTokens.pop();
@@ -181,7 +229,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         else if (isPdfExt(e)) type = 'pdf';
         else if (isCodeExt(e)) type = 'code';
         const lang = type === 'code' ? (langFromExt(e) || 'plaintext') : '';
-        const base = location.pathname.replace(/[^/]*$/, '') + 'preview.html';
+        const base = location.pathname.replace(/[^/]*$/, '') + 'preview.html?bucket=' + encodeURIComponent(config.bucket || '');
         return `${base}#${dir}${row.name}?type=${type}${lang ? `&lang=${encodeURIComponent(lang)}`:''}`;
       },
       async openPreview(row) {
@@ -229,6 +277,21 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         const dst = await BB.actions.renameObject(absKey);
         if (dst) await this.refresh();
       },
+      onRowShare(row) {
+        const absKey = ((config.rootPrefix||'') + (this.pathPrefix||'') + row.name).replace(/\/{2,}/g,'/');
+        BB.actions.shareObject(absKey);
+      },
+      async onShowTrash() {
+        await BB.actions.showTrash();
+        await this.refresh();
+      },
+      hasFeature(name) { return !(this.me?.disabledFeatures || []).includes(name); },
+      canExtract(row) { return this.hasFeature('extract') && /\.(zip|tar|tar\.gz|tgz)$/i.test(row.name || ''); },
+      async onRowExtract(row) {
+        const absKey = ((config.rootPrefix||'') + (this.pathPrefix||'') + row.name).replace(/\/{2,}/g,'/');
+        const dst = await BB.actions.extractObject(absKey);
+        if (dst) await this.refresh();
+      },
       onRowMetadata(row) {
         const absKey = ((config.rootPrefix||'') + (this.pathPrefix||'') + row.name).replace(/\/{2,}/g,'/');
         BB.actions.showFileDetails(absKey);
@@ -269,7 +332,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         this.isRefreshing = true;
         try {
           const prefix = this.bucketPrefix || '';
-          let url = `/api/list?prefix=${encodeURIComponent(prefix)}&delimiter=/&max=${this.pageSize || 50}`;
+          let url = BB.api.apiUrl(`/api/list?prefix=${encodeURIComponent(prefix)}&delimiter=/&max=${this.pageSize || 50}&sizes=1`);
 
           // Exclure la corbeille côté back pour des pages "pleines"
           if (BB.cfg.trashPrefix) {
@@ -281,7 +344,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
           }
 
           const resp = await fetch(url);
-          if (!resp.ok) throw new Error(`HTTP ${resp.status}`);
+          if (!resp.ok) throw await BB.apiFailed(resp, 'LIST');
           const data = await resp.json();
 
           this.nextContinuationToken = data.nextContinuationToken || undefined;
@@ -295,7 +358,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
                 type: 'prefix',
                 name: it.name || (relPrefix.split('/').slice(-2)[0] + '/'),
                 prefix: relPrefix,
-                size: 0,
+                size: it.size || 0, // rempli par l'index serveur quand il est prêt
                 dateModified: null
               };
             } else {
@@ -311,6 +374,8 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
                 key,
                 size: it.size || 0,
                 dateModified: it.lastModified ? new Date(it.lastModified) : null,
+                etag: it.etag || '',
+                thumbFailed: false,
                 url,
                 installUrl
               };
@@ -371,6 +436,7 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
       async uploadFiles(files, keyResolver) {
         const base = (config.bucketUrl || '/s3').replace(/\/*$/, '');
         const concurrency = 5;
+        const multipartThreshold = config.multipartThreshold || 64 * 1024 * 1024;
         const queue = files.slice();
         const runOne = async () => {
           const f = queue.shift(); if (!f) return;
@@ -378,8 +444,12 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
           const key = (this.bucketPrefix + rel).replace(/\/{2,}/g, '/');
           const putURL = `${base}/${encodePath(key)}`;
           try {
-            const res = await fetch(putURL, { method: 'PUT', headers: { 'Content-Type': f.type || 'application/octet-stream' }, body: f });
-            if (!res.ok) { const txt = await res.text().catch(()=>''); throw new Error(`HTTP ${res.status}${txt ? ' – ' + txt : ''}`); }
+            if (f.size >= multipartThreshold) {
+              await BB.api.putMultipart(key, f);
+            } else {
+              const res = await fetch(putURL, { method: 'PUT', headers: { 'Content-Type': f.type || 'application/octet-stream' }, body: f });
+              if (!res.ok) throw await BB.apiFailed(res, 'PUT');
+            }
           } catch (e) { BB.ui.toast(`Upload failed: ${rel} — ${e}`); }
           if (queue.length) await runOne();
         };
@@ -387,54 +457,17 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         BB.ui.toast(`Upload terminé (${files.length})`);
       },
 
-      /* Download all (fflate) */
-      async downloadAllFiles() {
-        if (!window.fflate || !window.fflate.Zip || !window.fflate.ZipPassThrough) { BB.ui.toast('Archive indisponible (fflate non chargé).'); return; }
-        const { Zip, ZipPassThrough } = window.fflate;
-        const archiveFiles = this.pathContentTableData.filter(i => i.type === 'content').map(i => i.url);
-        if (!archiveFiles.length) { BB.ui.toast('Aucun fichier à télécharger.'); return; }
-        this.downloadAllFilesCount = archiveFiles.length;
-        this.downloadAllFilesReceivedCount = 0;
-        this.downloadAllFilesProgress = 0;
-
-        let totalContentLength = 0, totalReceivedLength = 0;
-        const archiveName = (this.pathPrefix || '').split('/').filter(p => p.trim()).pop();
-        const archiveData = [];
-        const archive = new Zip((err, data) => { if (err) throw err; archiveData.push(data); });
-
-        await Promise.all(archiveFiles.map(async (url) => {
-          const fileName = url.split('/').filter(p => p.trim()).pop();
-          const fileStream = new ZipPassThrough(fileName);
-          archive.add(fileStream);
-
-          const resp = await fetch(url);
-          const len = parseInt(resp.headers.get('Content-Length') || '0', 10);
-          if (!isNaN(len)) totalContentLength += len;
-
-          const reader = resp.body.getReader();
-          while (true) {
-            const { done, value } = await reader.read();
-            if (done) { fileStream.push(new Uint8Array(), true); break; }
-            fileStream.push(new Uint8Array(value));
-            totalReceivedLength += value.length;
-            const p1 = totalContentLength ? (totalReceivedLength / totalContentLength) : 0;
-            const p2 = this.downloadAllFilesCount ? (this.downloadAllFilesReceivedCount / this.downloadAllFilesCount) : 0;
-            this.downloadAllFilesProgress = (p1 + p2) / 2;
-          }
-          this.downloadAllFilesReceivedCount++;
-        })).then(() => archive.end());
-
-        const blob = new Blob(archiveData, { type: 'application/zip' });
-        const href = URL.createObjectURL(blob);
+      /* Download all (ZIP streamed by the server, /api/zip) */
+      downloadAllFiles() {
+        const prefix = this.bucketPrefix;
+        const absTrash = (config.rootPrefix || '') + (config.trashPrefix || '_trash/');
+        let url = BB.api.apiUrl(`/api/zip?prefix=${encodeURIComponent(prefix)}`);
+        if (absTrash.startsWith(prefix)) url += `&exclude=${encodeURIComponent(absTrash.slice(prefix.length))}`;
         const a = document.createElement('a');
-        a.href = href; a.download = `${archiveName || 'archive'}.zip`; a.click();
-        URL.revokeObjectURL(href);
-
-        this.downloadAllFilesCount = this.downloadAllFilesReceivedCount = this.downloadAllFilesProgress = null;
+        a.href = url; a.click();
       }
     },
     mounted() {
-      this.hasFflate = !!(window && window.fflate);
       window.addEventListener('hashchange', this.updatePathFromHash);
       window.addEventListener('resize', () => { this.windowWidth = window.innerWidth; });
       this.updatePathFromHash();
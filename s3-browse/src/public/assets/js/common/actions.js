@@ -16,6 +16,8 @@
     };
   }
   function getUI() { return (BB.ui ? BB.ui : nativeUI()); }
+  // FEATURES_DISABLED côté serveur (via /api/whoami)
+  function hasFeature(name) { return !(BB.cfg.disabledFeatures || []).includes(name); }
 
   const labels = {
     renameTitle: 'Rename',
@@ -26,7 +28,18 @@
     renameOk: 'Renamed.',
     moveTrashOk: 'Déplacé dans la corbeille.',
     unauthorized: 'Unauthorized',
-    copyDenied: 'Copie refusée (PUT) / proxy.'
+    copyDenied: 'Copie refusée (PUT) / proxy.',
+    shareTitle: 'Partager',
+    sharePrompt: 'Durée de validité du lien (heures) :',
+    shareOk: 'Lien copié.',
+    trashTitle: 'Corbeille',
+    trashEmpty: 'La corbeille est vide.',
+    trashRestored: 'Restauré.',
+    trashOverwrite: 'Le fichier existe déjà à son emplacement d’origine. Le remplacer ?',
+    trashPurgePrompt: 'Supprimer définitivement ?',
+    trashPurgeAllPrompt: 'Vider la corbeille ? Cette action est définitive.',
+    extractTitle: 'Extraire',
+    extractPrompt: 'Extraire dans le dossier :',
   };
 
   // --- utils de format ---
@@ -306,6 +319,30 @@
 
 
   // ----- DOSSIER (prefix) : copier / renommer / supprimer -----
+  // Les opérations lourdes tournent en job côté serveur : fermer l'onglet ne les interrompt pas.
+  async function runJob(body) {
+    const { id } = await BB.api.submitJob(body);
+    return followJob(id);
+  }
+
+  function followJob(id) {
+    const ui = getUI();
+    let last = 0;
+    return BB.api.waitJob(id, {
+      onProgress(j) {
+        if (j.status !== 'running' || !j.total || Date.now() - last < 3000) return;
+        last = Date.now();
+        ui.toast(`${j.done} / ${j.total} objets`);
+      }
+    });
+  }
+
+  function failedMessage(j, verb) {
+    const n = j.failedCount || 0;
+    const more = n > (j.failed || []).length ? `\n…` : '';
+    return `${j.done - n} objets ${verb}, ${n} en échec :\n` + (j.failed || []).map(f => `${f.key}: ${f.error}`).join('\n') + more;
+  }
+
   async function renamePrefix(prefixAbs) {
     const ui = getUI();
     const p = ensurePrefix(prefixAbs);
@@ -315,8 +352,12 @@
     if (!newName || newName === last) return false;
     const dst = ensurePrefix(parent + newName);
     try {
-      await BB.api.rename({ src: p, dst, isPrefix: true });
-      ui.toast(labels.renameOk);
+      const j = await runJob({ type: 'rename', src: p, dst });
+      if (j.failedCount) {
+        await ui.alert({ title: labels.renameTitle, message: failedMessage(j, 'déplacés') });
+      } else {
+        ui.toast(labels.renameOk);
+      }
       return dst;
     } catch (e) {
       await ui.alert({ title: labels.renameTitle, message: String(e) });
@@ -362,8 +403,19 @@
     const okc = await ui.confirm({ title: labels.deleteTitle, message: labels.folderDeletePrompt });
     if (!okc) return false;
     try {
-      const { deleted } = await BB.api.deletePrefix(ensurePrefix(prefixAbs));
-      ui.toast(`Supprimé (${deleted} objets)`);
+      if (!hasFeature('trash')) {
+        const j = await runJob({ type: 'delete-prefix', prefix: ensurePrefix(prefixAbs) });
+        if (j.failedCount) await ui.alert({ title: labels.deleteTitle, message: failedMessage(j, 'supprimés') });
+        else ui.toast(`${labels.deleteOk} (${j.done} objets)`);
+        return true;
+      }
+      const { body } = await BB.api.trashPrefix(ensurePrefix(prefixAbs));
+      const j = await followJob(body.id);
+      if (j.failedCount) {
+        await ui.alert({ title: labels.deleteTitle, message: failedMessage(j, 'déplacés') });
+      } else {
+        ui.toast(`${labels.moveTrashOk} (${j.done} objets)`);
+      }
       return true;
     } catch (e) {
       await ui.alert({ title: labels.deleteTitle, message: String(e) });
@@ -403,7 +455,15 @@
     if (!newName || newName === cur) return false;
     const dst = base + newName;
     try {
-      await BB.api.copy(absKey, dst);
+      try {
+        await BB.api.copy(absKey, dst, { ifNoneMatch: '*' });
+      } catch (e) {
+        if (e.status !== 412) throw e;
+        // dst existe déjà: on ne l’écrase que si on le confirme
+        const okc = await ui.confirm({ title: `Duplicate ${cur}`, message: `${newName} existe déjà. Le remplacer ?`, confirmText: 'Remplacer' });
+        if (!okc) return false;
+        await BB.api.copy(absKey, dst);
+      }
       ui.toast('Copie effectuée.');
       return dst;
     } catch (e) {
@@ -416,20 +476,127 @@
     const ui = getUI();
     const okc = await ui.confirm({ title: labels.deleteTitle, message: labels.deletePrompt, confirmText: 'Supprimer' });
     if (!okc) return false;
-    const ok = await BB.api.del(absKey);
-    if (!ok) {
+    try {
+      if (!hasFeature('trash')) {
+        if (!await BB.api.del(absKey)) throw new Error(labels.unauthorized);
+        ui.toast(labels.deleteOk);
+        return 'deleted';
+      }
       await moveToTrash(absKey);
       ui.toast(labels.moveTrashOk);
       return 'trash';
+    } catch (e) {
+      await ui.alert({ title: labels.deleteTitle, message: String(e) });
+      return false;
     }
-    ui.toast(labels.deleteOk);
-    return true;
   }
 
   async function moveToTrash(absKey) {
-    const ts = new Date().toISOString().replace(/[:.]/g,'-');
-    const dst = (BB.cfg.trashPrefix || '_trash/') + ts + '/' + absKey;
-    await BB.api.copy(absKey, dst);
+    await BB.api.trash(absKey);
+  }
+
+  // ----- Corbeille : lister / restaurer / purger -----
+  async function showTrash() {
+    const ui = getUI();
+    let list;
+    try {
+      list = await BB.api.trashList();
+    } catch (e) {
+      await ui.alert({ title: labels.trashTitle, message: String(e) });
+      return;
+    }
+    const rows = list.items.map(it => `
+      <div class="kv-row bb-trash-row">
+        <div class="kv-k" title="${escapeHTML(it.path)}">${escapeHTML(it.path)}</div>
+        <div class="kv-v">
+          <span class="kv-muted">${escapeHTML(fmtDate(it.deletedAt))} · ${fmtBytes(it.size || 0)}</span>
+          <a class="icon-btn" title="Restaurer" data-trash-restore="${escapeHTML(it.id)}"><i class="mdi mdi-restore small-icon"></i></a>
+          <a class="icon-btn" title="Supprimer définitivement" data-trash-purge="${escapeHTML(it.id)}"><i class="mdi mdi-delete-forever small-icon"></i></a>
+        </div>
+      </div>`).join('');
+    const html = `
+      <div class="bb-details">
+        <div class="bb-details-head">
+          <i class="mdi mdi-delete-outline"></i>
+          <div class="bb-details-titles">
+            <div class="bb-details-name">${labels.trashTitle} (${list.items.length})</div>
+            <div class="bb-details-subtitle kv-muted">${list.retentionDays ? `Purge automatique après ${list.retentionDays} jours` : 'Pas de purge automatique'}</div>
+          </div>
+          ${list.items.length ? '<a class="icon-btn" title="Vider la corbeille" data-trash-purge=""><i class="mdi mdi-delete-sweep small-icon"></i></a>' : ''}
+        </div>
+        <div class="bb-details-grid">${rows || `<div class="kv-muted">${labels.trashEmpty}</div>`}</div>
+      </div>`;
+
+    const onClick = async (ev) => {
+      const a = ev.target.closest('[data-trash-restore],[data-trash-purge]');
+      if (!a) return;
+      ev.preventDefault();
+      const row = a.closest('.bb-trash-row');
+      try {
+        if (a.hasAttribute('data-trash-restore')) {
+          const id = a.getAttribute('data-trash-restore');
+          try {
+            await BB.api.trashRestore(id);
+          } catch (e) {
+            if (!String(e).includes('409')) throw e;
+            if (!window.confirm(labels.trashOverwrite)) return;
+            await BB.api.trashRestore(id, true);
+          }
+          ui.toast(labels.trashRestored);
+        } else {
+          const id = a.getAttribute('data-trash-purge');
+          if (!window.confirm(id ? labels.trashPurgePrompt : labels.trashPurgeAllPrompt)) return;
+          await BB.api.trashPurge(id);
+          if (!id) document.querySelectorAll('.bb-trash-row').forEach(r => r.remove());
+        }
+        if (row) row.remove();
+      } catch (e) {
+        ui.toast(String(e));
+      }
+    };
+    document.addEventListener('click', onClick);
+    try {
+      await ui.alert({ html });
+    } finally {
+      document.removeEventListener('click', onClick);
+    }
+  }
+
+  async function shareObject(absKey) {
+    const ui = getUI();
+    const hours = await ui.prompt({ title: labels.shareTitle, message: labels.sharePrompt, defaultValue: '24' });
+    if (hours == null || hours === '') return false;
+    const ttl = Math.round(Number(hours) * 3600);
+    if (!Number.isFinite(ttl) || ttl <= 0) return false;
+    try {
+      const { url, expiresAt } = await BB.api.share(absKey, { ttl, mode: BB.cfg.shareMode || 'presigned' });
+      try { await navigator.clipboard.writeText(url); ui.toast(labels.shareOk); } catch {}
+      await ui.alert({ title: labels.shareTitle, message: `${url}\n\nExpire : ${fmtDate(expiresAt)}` });
+      return url;
+    } catch (e) {
+      await ui.alert({ title: labels.shareTitle, message: String(e) });
+      return false;
+    }
+  }
+
+  async function extractObject(absKey) {
+    const ui = getUI();
+    const base = absKey.replace(/\.(zip|tar|tar\.gz|tgz)$/i, '');
+    const dst = await ui.prompt({ title: labels.extractTitle, message: labels.extractPrompt, defaultValue: base + '/' });
+    if (!dst) return false;
+    try {
+      const { id } = await BB.api.extract(absKey, ensurePrefix(dst));
+      const j = await followJob(id);
+      if (j.failedCount) {
+        await ui.alert({ title: labels.extractTitle, message: failedMessage(j, 'extraits') });
+      } else {
+        ui.toast(`Extrait (${j.done} fichiers)`);
+      }
+      return ensurePrefix(dst);
+    } catch (e) {
+      await ui.alert({ title: labels.extractTitle, message: String(e) });
+      return false;
+    }
   }
 
   // NEW: Download helper
@@ -449,7 +616,7 @@
     showMetadata, 
     showFileDetails,
     showPrefixDetails, 
-    renameObject, copyObject, deleteObject, downloadObject, moveToTrash,
+    renameObject, copyObject, deleteObject, downloadObject, moveToTrash, shareObject, extractObject, showTrash,
     // Dossier
     renamePrefix, copyPrefix, deletePrefix
   };
@@ -6,7 +6,57 @@
 
   if (!BB.detect) throw new Error("BB.detect is required before BB.api");
 
+  // Erreur JSON du serveur { status, code, message, key, requestId, retryable } -> Error
+  async function failed(res, what) {
+    let body = null;
+    try { body = await res.json(); } catch {}
+    const msg = (body && body.message) || `${res.status} ${res.statusText}`;
+    const err = new Error(`${what}: ${msg}`);
+    err.status = res.status;
+    err.code = body && body.code;
+    err.key = body && body.key;
+    err.retryable = !!(body && body.retryable);
+    err.requestId = (body && body.requestId) || res.headers.get('X-Request-Id') || '';
+    return err;
+  }
+  BB.apiFailed = failed;
+
   const api = {
+    // --- Bucket courant (multi-bucket: /s3/{bucket}/..., ?bucket= sur /api/*) ---
+    // BB.base: préfixe public (BASE_PATH / X-Forwarded-Prefix), servi par assets/js/env.js
+    baseUrl(path) { return (BB.base || '') + path; },
+    apiUrl(path) {
+      path = this.baseUrl(path);
+      const b = BB.cfg.bucket;
+      if (!b) return path;
+      return path + (path.includes('?') ? '&' : '?') + 'bucket=' + encodeURIComponent(b);
+    },
+    useBucket(name) {
+      BB.cfg.bucket = name;
+      BB.cfg.bucketUrl = BB.cfg.bucketMaskUrl = this.baseUrl('/s3/' + encodeURIComponent(name));
+      try { localStorage.setItem('bb.bucket', name); } catch {}
+    },
+    async whoami() {
+      const res = await fetch(this.baseUrl('/api/whoami'));
+      if (!res.ok) throw await failed(res, 'WHOAMI');
+      return await res.json(); // { user, email, groups, method, logoutUrl }
+    },
+    async buckets() {
+      const res = await fetch(this.baseUrl('/api/buckets'));
+      if (!res.ok) throw await failed(res, 'BUCKETS');
+      return await res.json(); // { default, buckets: [{ name, creationDate }] }
+    },
+    // Choisit le bucket: ?bucket= de la page, puis le dernier utilisé, puis le défaut du serveur.
+    async initBucket() {
+      let wanted = new URLSearchParams(location.search).get('bucket');
+      if (!wanted) { try { wanted = localStorage.getItem('bb.bucket'); } catch {} }
+      let list = { default: wanted || '', buckets: [] };
+      try { list = await this.buckets(); } catch (e) { console.warn(e); }
+      const names = (list.buckets || []).map(b => b.name);
+      const name = (wanted && (!names.length || names.includes(wanted))) ? wanted : (list.default || names[0] || '');
+      if (name) this.useBucket(name);
+      return { bucket: name, buckets: names };
+    },
     urlForKey(key, { mask = false } = {}) {
       const base = (mask ? (BB.cfg.bucketMaskUrl || BB.cfg.bucketUrl) : BB.cfg.bucketUrl || '/s3').replace(/\/*$/, '');
       key = (key || '').replace(/^\//, '');
@@ -14,7 +64,7 @@
     },
     async head(key) {
       const res = await fetch(this.urlForKey(key), { method: 'HEAD' });
-      if (!res.ok) throw new Error(`HEAD ${res.status}`);
+      if (!res.ok) throw await failed(res, 'HEAD');
       const headers = {}; res.headers.forEach((v, k) => headers[k] = v);
       return {
         mime: res.headers.get('Content-Type') || '',
@@ -24,22 +74,26 @@
     },
     async getText(key) {
       const res = await fetch(this.urlForKey(key));
-      if (!res.ok) throw new Error(`GET ${res.status}`);
+      if (!res.ok) throw await failed(res, 'GET');
       return await res.text();
     },
     async getBlob(key) {
       const res = await fetch(this.urlForKey(key));
-      if (!res.ok) throw new Error(`GET ${res.status}`);
+      if (!res.ok) throw await failed(res, 'GET');
       return await res.blob();
     },
-    async putBlob(key, blob, mime) {
-      const res = await fetch(this.urlForKey(key), { method: 'PUT', headers: { 'Content-Type': mime || 'application/octet-stream' }, body: blob });
-      if (!res.ok) throw new Error(`PUT ${res.status}`);
+    async putBlob(key, blob, mime, { ifNoneMatch } = {}) {
+      // ifNoneMatch: '*' to create only, 412 when the key exists
+      const headers = { 'Content-Type': mime || 'application/octet-stream' };
+      if (ifNoneMatch) headers['If-None-Match'] = ifNoneMatch;
+      const res = await fetch(this.urlForKey(key), { method: 'PUT', headers, body: blob });
+      if (!res.ok) throw await failed(res, 'PUT');
+      return res.headers.get('ETag') || '';
     },
-    async copy(srcKey, dstKey) {
+    async copy(srcKey, dstKey, opts) {
       // Proxy sans “x-amz-copy-source” => fallback GET -> PUT
       const blob = await this.getBlob(srcKey);
-      await this.putBlob(dstKey, blob, blob.type || 'application/octet-stream');
+      await this.putBlob(dstKey, blob, blob.type || 'application/octet-stream', opts);
     },
     async del(key) {
       try {
@@ -65,27 +119,229 @@
       return out;
     },
     async rename({ src, dst, isPrefix }) {
-      const res = await fetch('/api/rename', {
+      const res = await fetch(this.apiUrl('/api/rename'), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ src, dst, isPrefix: !!isPrefix })
       });
-      if (!res.ok) throw new Error(`RENAME ${res.status}`);
-      return await res.json(); // { moved, tookMs }
+      if (!res.ok) throw await failed(res, 'RENAME');
+      return await res.json(); // { moved, tookMs, failed?: [{ key, error }] }
     },
     async deletePrefix(prefixAbs) {
-      const res = await fetch('/api/delete-prefix', {
+      const res = await fetch(this.apiUrl('/api/delete-prefix'), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ prefix: prefixAbs })
       });
-      if (!res.ok) throw new Error(`DELETE-PREFIX ${res.status}`);
-      return await res.json(); // { deleted, tookMs }
+      if (!res.ok) throw await failed(res, 'DELETE-PREFIX');
+      return await res.json(); // { deleted, tookMs, failed?: [{ key, error }] }
+    },
+    // --- Trash (server side: _trash/<ts>/<original key>) ---
+    async trashList() {
+      const res = await fetch(this.apiUrl('/api/trash'));
+      if (!res.ok) throw await failed(res, 'TRASH');
+      return await res.json(); // { prefix, retentionDays, items: [{ id, path, deletedAt, size }] }
+    },
+    async trashPost(path, body) {
+      const res = await fetch(this.apiUrl(path), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+      });
+      if (!res.ok) throw await failed(res, 'TRASH');
+      return { status: res.status, body: await res.json() }; // 202 = job for a folder
+    },
+    trash(key) { return this.trashPost('/api/trash', { key }); },
+    trashPrefix(prefix) { return this.trashPost('/api/trash', { prefix }); },
+    trashRestore(id, overwrite = false) { return this.trashPost('/api/trash/restore', { id, overwrite }); },
+    trashPurge(id) { return this.trashPost('/api/trash/purge', id ? { id } : { all: true }); },
+    // --- Background jobs (rename / delete-prefix / stats, survive a closed tab) ---
+    async submitJob(body) {
+      const res = await fetch(this.apiUrl('/api/jobs'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body) // { type: 'rename'|'delete-prefix'|'stats', src, dst, prefix }
+      });
+      if (!res.ok) throw await failed(res, 'JOBS');
+      return await res.json(); // { id, status, total, done, ... }
+    },
+    async extract(key, dst) {
+      const res = await fetch(this.apiUrl('/api/extract'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, dst })
+      });
+      if (!res.ok) throw await failed(res, 'EXTRACT');
+      return await res.json(); // job, follow it with waitJob
+    },
+    async job(id) {
+      const res = await fetch(this.baseUrl(`/api/jobs?id=${encodeURIComponent(id)}`));
+      if (!res.ok) throw await failed(res, 'JOBS');
+      return await res.json();
+    },
+    async cancelJob(id) {
+      const res = await fetch(this.baseUrl(`/api/jobs?id=${encodeURIComponent(id)}`), { method: 'DELETE' });
+      return res.ok;
+    },
+    async waitJob(id, { interval = 1000, onProgress } = {}) {
+      for (;;) {
+        const j = await this.job(id);
+        if (onProgress) onProgress(j);
+        if (j.status === 'done') return j;
+        if (j.status === 'failed' || j.status === 'canceled') throw new Error(j.error || j.status);
+        await new Promise(r => setTimeout(r, interval));
+      }
+    },
+    // --- Multipart (large files, resumable) ---
+    async mpCreate(key, contentType) {
+      const res = await fetch(this.apiUrl('/api/multipart/create'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, contentType })
+      });
+      if (!res.ok) throw await failed(res, 'MULTIPART-CREATE');
+      return await res.json(); // { key, uploadId }
+    },
+    async mpPart(key, uploadId, partNumber, blob) {
+      const q = `key=${encodeURIComponent(key)}&uploadId=${encodeURIComponent(uploadId)}&partNumber=${partNumber}`;
+      const res = await fetch(this.apiUrl(`/api/multipart/part?${q}`), { method: 'PUT', body: blob });
+      if (!res.ok) throw await failed(res, 'MULTIPART-PART');
+      return await res.json(); // { partNumber, etag }
+    },
+    async mpParts(key, uploadId) {
+      const q = `key=${encodeURIComponent(key)}&uploadId=${encodeURIComponent(uploadId)}`;
+      const res = await fetch(this.apiUrl(`/api/multipart/parts?${q}`));
+      if (!res.ok) throw await failed(res, 'MULTIPART-PARTS');
+      return await res.json(); // { key, uploadId, parts: [{ partNumber, etag, size }] }
+    },
+    async mpComplete(key, uploadId, parts) {
+      const res = await fetch(this.apiUrl('/api/multipart/complete'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, uploadId, parts })
+      });
+      if (!res.ok) throw await failed(res, 'MULTIPART-COMPLETE');
+      return await res.json(); // { key, etag, tookMs }
+    },
+    async mpAbort(key, uploadId) {
+      await fetch(this.apiUrl('/api/multipart/abort'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, uploadId })
+      }).catch(() => {});
+    },
+    // Upload un fichier en parties parallèles ; l’uploadId est gardé en localStorage
+    // pour reprendre après une coupure (mêmes clé, taille et date de modif).
+    async putMultipart(key, file, { partSize = 16 * 1024 * 1024, concurrency = 4, retries = 3, onProgress } = {}) {
+      partSize = Math.max(partSize, Math.ceil(file.size / 10000));
+      const total = Math.max(1, Math.ceil(file.size / partSize));
+      const resumeKey = `bb.mp:${BB.cfg.bucket || ''}:${key}:${file.size}:${file.lastModified || 0}`;
+      const done = new Map();
+      let uploadId = null;
+      try { uploadId = localStorage.getItem(resumeKey); } catch {}
+      if (uploadId) {
+        try {
+          const { parts } = await this.mpParts(key, uploadId);
+          for (const p of parts || []) {
+            const expected = p.partNumber < total ? partSize : file.size - (total - 1) * partSize;
+            if (p.size === expected) done.set(p.partNumber, p.etag);
+          }
+        } catch { uploadId = null; done.clear(); }
+      }
+      if (!uploadId) {
+        uploadId = (await this.mpCreate(key, file.type || 'application/octet-stream')).uploadId;
+        try { localStorage.setItem(resumeKey, uploadId); } catch {}
+      }
+
+      const queue = [];
+      for (let n = 1; n <= total; n++) if (!done.has(n)) queue.push(n);
+      let sent = done.size;
+      if (onProgress) onProgress(sent / total);
+      const runOne = async () => {
+        const n = queue.shift(); if (!n) return;
+        const blob = file.slice((n - 1) * partSize, Math.min(n * partSize, file.size));
+        for (let attempt = 0; ; attempt++) {
+          try {
+            const { etag } = await this.mpPart(key, uploadId, n, blob);
+            done.set(n, etag);
+            break;
+          } catch (e) {
+            if (attempt >= retries) throw e;
+            await new Promise(r => setTimeout(r, 500 * 2 ** attempt));
+          }
+        }
+        sent++;
+        if (onProgress) onProgress(sent / total);
+        if (queue.length) await runOne();
+      };
+      await Promise.all(Array.from({ length: Math.min(concurrency, queue.length) }, runOne));
+
+      const parts = [...done.entries()].map(([partNumber, etag]) => ({ partNumber, etag }));
+      const out = await this.mpComplete(key, uploadId, parts);
+      try { localStorage.removeItem(resumeKey); } catch {}
+      return out;
+    },
+    async share(key, { method = 'GET', mode = 'presigned', ttl = 0 } = {}) {
+      const res = await fetch(this.apiUrl('/api/share'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, method, mode, ttl })
+      });
+      if (!res.ok) throw await failed(res, 'SHARE');
+      const out = await res.json(); // { key, method, mode, url, expiresAt }
+      if (out.url && out.url.startsWith('/')) out.url = location.origin + out.url;
+      return out;
+    },
+    async search(params = {}) {
+      // { prefix, q, glob, regex, minSize, maxSize, after, before, limit }
+      const qs = new URLSearchParams(Object.entries(params).filter(([, v]) => v != null && v !== ''));
+      const res = await fetch(this.apiUrl(`/api/search?${qs}`));
+      if (!res.ok) throw await failed(res, 'SEARCH');
+      return await res.json(); // { items: [{ key, name, size, lastModified }], total, truncated, index }
+    },
+    async meta(key) {
+      const k = String(key || '').replace(/^\/+/, '');
+      const res = await fetch(this.apiUrl(`/api/meta?key=${encodeURIComponent(k)}`));
+      if (!res.ok) throw await failed(res, 'META');
+      return await res.json(); // { key, contentType, cacheControl, …, metadata: { name: value }, size, etag }
+    },
+    async setMeta(meta) {
+      // replaces everything: fields left out are removed (contentType is kept)
+      const res = await fetch(this.apiUrl('/api/meta'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(meta)
+      });
+      if (!res.ok) throw await failed(res, 'META');
+      return await res.json();
+    },
+    async tags(key) {
+      const k = String(key || '').replace(/^\/+/, '');
+      const res = await fetch(this.apiUrl(`/api/tags?key=${encodeURIComponent(k)}`));
+      if (!res.ok) throw await failed(res, 'TAGS');
+      return (await res.json()).tags; // { status: 'validated', … }
+    },
+    async setTags(key, tags) {
+      // replaces all the tags; {} removes them
+      const res = await fetch(this.apiUrl('/api/tags'), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ key, tags })
+      });
+      if (!res.ok) throw await failed(res, 'TAGS');
+      return (await res.json()).tags;
+    },
+    thumbUrl(key, { w = 256, h = w, fit = 'contain', etag = '' } = {}) {
+      // etag (from the listing) lets the browser cache the thumbnail for good
+      const k = String(key || '').replace(/^\/+/, '');
+      const q = new URLSearchParams({ key: k, w, h, fit });
+      if (etag) q.set('v', etag.replace(/"/g, ''));
+      return this.apiUrl(`/api/thumb?${q}`);
     },
     async stats(prefixAbs = '') {
       const p = String(prefixAbs || '').replace(/^\/+/, '');
-      const res = await fetch(`/api/stats?prefix=${encodeURIComponent(p)}`);
-      if (!res.ok) throw new Error(`STATS ${res.status}`);
+      const res = await fetch(this.apiUrl(`/api/stats?prefix=${encodeURIComponent(p)}`));
+      if (!res.ok) throw await failed(res, 'STATS');
       return await res.json();
     }
   };
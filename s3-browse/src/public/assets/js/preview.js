@@ -1,4 +1,4 @@
-const CONFIG = { bucketUrl: '/s3', bucketMaskUrl: '/s3', rootPrefix: '', trashPrefix: '_trash/' };
+const CONFIG = { bucketUrl: (window.BB?.base || '') + '/s3', bucketMaskUrl: (window.BB?.base || '') + '/s3', rootPrefix: '', trashPrefix: '_trash/' };
 window.BB = window.BB || {};
 BB.cfg = CONFIG;
 
@@ -37,7 +37,10 @@ function renderUnknownBinary() {
   return div;
 }
 
+let bucketReady;
 async function render() {
+  bucketReady = bucketReady || BB.api.initBucket();
+  await bucketReady;
   const key = currentKey();
   const { mime, size } = await BB.api.head(key);
   setDocMeta(key, size);
@@ -0,0 +1,198 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "io"
+        "net/http"
+        "strconv"
+        "strings"
+)
+
+/* ===== Ranges: multipart/byteranges and If-Range ===== */
+
+// A single Range goes to S3 as is, with the conditional headers. Garage
+// answers one range only and does not check If-Range, so a GET with several
+// ranges or with If-Range is served here: a HEAD gives the ETag, size and
+// dates, http.ServeContent does RFC 7233 (If-Range, coalescing, 416,
+// multipart/byteranges) and reads the object through ranged GETs pinned to
+// that ETag, one per range and bounded by it. Beyond maxRanges ranges the
+// Range is ignored and the whole object sent, as RFC 7233 allows.
+
+const maxRanges = 16
+
+// servedLocally reports whether the Range of r needs serveRanges.
+func servedLocally(r *http.Request) bool {
+        rg := r.Header.Get("Range")
+        return r.Method == http.MethodGet && r.URL.RawQuery == "" && rg != "" &&
+                (strings.Contains(rg, ",") || r.Header.Get("If-Range") != "")
+}
+
+// serveRanges answers a GET of key with http.ServeContent.
+func (p *proxy) serveRanges(w http.ResponseWriter, r *http.Request, bucket, key string) {
+        m, err := p.headObject(r.Context(), bucket, key)
+        if err != nil {
+                e := asAPIError("get", err)
+                e.Bucket, e.Key = bucket, key
+                writeError(w, e)
+                return
+        }
+        h := w.Header()
+        h.Set("ETag", m.ETag)
+        if m.ContentType != "" {
+                h.Set("Content-Type", m.ContentType)
+        }
+        for i, f := range m.fields() {
+                if *f != "" {
+                        h.Set(metaHeaders[i], *f)
+                }
+        }
+        md := http.Header{}
+        for k, v := range m.Metadata {
+                md.Set(amzMetaPrefix+k, v)
+                h.Set(amzMetaPrefix+k, v)
+        }
+        h.Set("Access-Control-Expose-Headers", exposedHeaders(md))
+        mtime, _ := http.ParseTime(m.LastModified)
+
+        rg := r.Header.Get("Range")
+        if strings.Count(rg, ",") >= maxRanges {
+                r.Header.Del("Range")
+                rg = ""
+        }
+        if ir := r.Header.Get("If-Range"); ir != "" && ir != m.ETag && ir != m.LastModified {
+                rg = "" // the whole object is sent, in one GET
+        }
+        body := &objectReader{p: p, ctx: r.Context(), bucket: bucket, key: key, etag: m.ETag, size: m.Size,
+                ranges: parseRanges(rg, m.Size)}
+        defer body.Close()
+        http.ServeContent(w, r, "", mtime, body)
+}
+
+// byteRange is one range of a Range header, both ends included.
+type byteRange struct{ start, end int64 }
+
+// parseRanges reads the ranges of a bytes= Range header for an object of
+// size bytes, dropping the unsatisfiable ones as http.ServeContent does.
+func parseRanges(s string, size int64) []byteRange {
+        spec, ok := strings.CutPrefix(s, "bytes=")
+        if !ok {
+                return nil
+        }
+        var out []byteRange
+        for _, ra := range strings.Split(spec, ",") {
+                first, last, ok := strings.Cut(strings.TrimSpace(ra), "-")
+                if !ok {
+                        return nil
+                }
+                first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+                var br byteRange
+                if first == "" {
+                        n, err := strconv.ParseInt(last, 10, 64)
+                        if err != nil || n < 0 {
+                                return nil
+                        }
+                        br = byteRange{max(size-n, 0), size - 1}
+                } else {
+                        i, err := strconv.ParseInt(first, 10, 64)
+                        if err != nil || i < 0 {
+                                return nil
+                        }
+                        br = byteRange{i, size - 1}
+                        if last != "" {
+                                j, err := strconv.ParseInt(last, 10, 64)
+                                if err != nil || j < i {
+                                        return nil
+                                }
+                                br.end = min(j, size-1)
+                        }
+                }
+                if br.start < size && br.start <= br.end {
+                        out = append(out, br)
+                }
+        }
+        return out
+}
+
+// objectReader is an io.ReadSeeker over an S3 object: a read after a seek
+// opens a GET from the offset to the end of the range it falls in (or of the
+// object), pinned with If-Match to the version the headers were built from.
+type objectReader struct {
+        p           *proxy
+        ctx         context.Context
+        bucket, key string
+        etag        string
+        size, off   int64
+        ranges      []byteRange
+        end         int64 // last byte of the open GET
+        body        io.ReadCloser
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+        switch whence {
+        case io.SeekCurrent:
+                offset += o.off
+        case io.SeekEnd:
+                offset += o.size
+        }
+        if offset < 0 {
+                return o.off, fmt.Errorf("seek before the start of %s", o.key)
+        }
+        if offset != o.off {
+                o.Close()
+                o.off = offset
+        }
+        return o.off, nil
+}
+
+func (o *objectReader) Read(b []byte) (int, error) {
+        if o.off >= o.size {
+                return 0, io.EOF
+        }
+        if o.body == nil {
+                req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, o.p.buildObjectURL(o.bucket, o.key, nil), nil)
+                if err != nil {
+                        return 0, err
+                }
+                o.end = o.size - 1
+                for _, br := range o.ranges {
+                        if o.off == br.start {
+                                o.end = br.end // overlapping ranges are all served
+                                break
+                        }
+                        if o.off > br.start && o.off <= br.end {
+                                o.end = br.end
+                        }
+                }
+                req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", o.off, o.end))
+                req.Header.Set("If-Match", o.etag)
+                resp, err := o.p.signAndDo(o.ctx, req)
+                if err != nil {
+                        return 0, err
+                }
+                if resp.StatusCode != http.StatusPartialContent {
+                        defer resp.Body.Close()
+                        return 0, parseS3Error("get range", resp)
+                }
+                o.body = resp.Body
+        }
+        n, err := o.body.Read(b)
+        o.off += int64(n)
+        if err == io.EOF && o.off < o.size {
+                if o.off <= o.end {
+                        return n, io.ErrUnexpectedEOF
+                }
+                o.Close() // end of the range, the next read opens another GET
+                err = nil
+        }
+        return n, err
+}
+
+func (o *objectReader) Close() error {
+        if o.body == nil {
+                return nil
+        }
+        err := o.body.Close()
+        o.body = nil
+        return err
+}
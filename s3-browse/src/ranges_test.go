@@ -0,0 +1,192 @@
+package main
+
+import (
+        "fmt"
+        "io"
+        "mime"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+)
+
+func TestParseRanges(t *testing.T) {
+        tests := []struct {
+                name string
+                in   string
+                want []byteRange
+        }{
+                {"single", "bytes=2-4", []byteRange{{2, 4}}},
+                {"suffix", "bytes=-3", []byteRange{{7, 9}}},
+                {"suffix longer than the object", "bytes=-20", []byteRange{{0, 9}}},
+                {"open-ended", "bytes=4-", []byteRange{{4, 9}}},
+                {"end past the object", "bytes=8-20", []byteRange{{8, 9}}},
+                {"overlapping", "bytes=0-4, 2-6", []byteRange{{0, 4}, {2, 6}}},
+                {"unsatisfiable", "bytes=10-", nil},
+                {"unsatisfiable dropped", "bytes=20-30,0-0", []byteRange{{0, 0}}},
+                {"reversed", "bytes=5-2", nil},
+                {"not a number", "bytes=a-", nil},
+                {"no dash", "bytes=5", nil},
+                {"other unit", "items=0-1", nil},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := parseRanges(tt.in, 10); !reflect.DeepEqual(got, tt.want) {
+                                t.Errorf("parseRanges(%q, 10) = %v, want %v", tt.in, got, tt.want)
+                        }
+                })
+        }
+}
+
+// rangeS3 serves default/obj the way Garage does: one range per GET, a
+// Range with several is ignored, If-Range is not checked.
+type rangeS3 struct {
+        data  []byte
+        etag  string
+        mtime time.Time
+
+        mu   sync.Mutex
+        gets []string // Range header of each GET
+}
+
+func (f *rangeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/default/obj" {
+                w.WriteHeader(http.StatusNotFound)
+                io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+                return
+        }
+        h := w.Header()
+        h.Set("ETag", f.etag)
+        h.Set("Last-Modified", f.mtime.Format(http.TimeFormat))
+        h.Set("Content-Type", "text/plain")
+        if im := r.Header.Get("If-Match"); im != "" && im != f.etag {
+                w.WriteHeader(http.StatusPreconditionFailed)
+                io.WriteString(w, "<Error><Code>PreconditionFailed</Code></Error>")
+                return
+        }
+        if r.Method == http.MethodHead {
+                h.Set("Content-Length", fmt.Sprint(len(f.data)))
+                return
+        }
+        rg := r.Header.Get("Range")
+        f.mu.Lock()
+        f.gets = append(f.gets, rg)
+        f.mu.Unlock()
+        var start, end int
+        if n, _ := fmt.Sscanf(rg, "bytes=%d-%d", &start, &end); n != 2 || strings.Contains(rg, ",") {
+                w.Write(f.data)
+                return
+        }
+        end = min(end, len(f.data)-1)
+        h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.data)))
+        w.WriteHeader(http.StatusPartialContent)
+        w.Write(f.data[start : end+1])
+}
+
+func newRangeProxy(t *testing.T, f *rangeS3) *httptest.Server {
+        s3 := httptest.NewServer(f)
+        t.Cleanup(s3.Close)
+        t.Setenv("S3_ENDPOINT", s3.URL)
+        t.Setenv("S3_REGION", "garage")
+        t.Setenv("S3_ACCESS_KEY_ID", "key")
+        t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+        t.Setenv("S3_BUCKET", "default")
+        t.Setenv("STATE_DIR", t.TempDir())
+        t.Setenv("AUTH_MODE", "none")
+        srv := httptest.NewServer(newProxy(loadCfg()).routes())
+        t.Cleanup(srv.Close)
+        return srv
+}
+
+func TestServeRanges(t *testing.T) {
+        f := &rangeS3{data: []byte("0123456789"), etag: `"v1"`, mtime: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+        srv := newRangeProxy(t, f)
+
+        tests := []struct {
+                name     string
+                rng      string
+                ifRange  string
+                status   int
+                parts    []string // bodies, in order
+                upstream []string // ranges asked to S3
+        }{
+                {"multi-range", "bytes=0-1,4-5", "", http.StatusPartialContent,
+                        []string{"01", "45"}, []string{"bytes=0-1", "bytes=4-5"}},
+                {"suffix and open-ended", "bytes=-2,3-", "", http.StatusPartialContent,
+                        []string{"89", "3456789"}, []string{"bytes=8-9", "bytes=3-9"}},
+                {"If-Range match", "bytes=2-4", `"v1"`, http.StatusPartialContent,
+                        []string{"234"}, []string{"bytes=2-4"}},
+                {"If-Range date match", "bytes=2-4", f.mtime.Format(http.TimeFormat), http.StatusPartialContent,
+                        []string{"234"}, []string{"bytes=2-4"}},
+                {"If-Range mismatch", "bytes=2-4", `"v0"`, http.StatusOK,
+                        []string{"0123456789"}, []string{"bytes=0-9"}},
+                {"unsatisfiable", "bytes=20-30,40-", "", http.StatusRequestedRangeNotSatisfiable,
+                        nil, nil},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        f.mu.Lock()
+                        f.gets = nil
+                        f.mu.Unlock()
+
+                        req, _ := http.NewRequest(http.MethodGet, srv.URL+"/s3/default/obj", nil)
+                        req.Header.Set("Range", tt.rng)
+                        if tt.ifRange != "" {
+                                req.Header.Set("If-Range", tt.ifRange)
+                        }
+                        resp, err := http.DefaultClient.Do(req)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        defer resp.Body.Close()
+                        if resp.StatusCode != tt.status {
+                                t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+                        }
+                        if tt.parts != nil {
+                                if got := readParts(t, resp); !reflect.DeepEqual(got, tt.parts) {
+                                        t.Errorf("parts = %q, want %q", got, tt.parts)
+                                }
+                        }
+                        f.mu.Lock()
+                        gets := f.gets
+                        f.mu.Unlock()
+                        if !reflect.DeepEqual(gets, tt.upstream) {
+                                t.Errorf("upstream GETs = %q, want %q", gets, tt.upstream)
+                        }
+                })
+        }
+}
+
+// readParts returns the bodies of a multipart/byteranges response, or its
+// whole body.
+func readParts(t *testing.T, resp *http.Response) []string {
+        t.Helper()
+        mt, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+        if mt != "multipart/byteranges" {
+                b, err := io.ReadAll(resp.Body)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                return []string{string(b)}
+        }
+        var out []string
+        mr := multipart.NewReader(resp.Body, params["boundary"])
+        for {
+                part, err := mr.NextPart()
+                if err == io.EOF {
+                        return out
+                }
+                if err != nil {
+                        t.Fatal(err)
+                }
+                b, err := io.ReadAll(part)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                out = append(out, string(b))
+        }
+}
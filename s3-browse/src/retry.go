@@ -0,0 +1,226 @@
+package main
+
+import (
+        "context"
+        "io"
+        "log"
+        "math/rand"
+        "net/http"
+        "strconv"
+        "sync"
+        "time"
+
+        v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+/* ===== Upstream retries and circuit breaker ===== */
+
+// A Garage node restarting, or a 503 SlowDown, should not fail a 10k-key
+// rename halfway through: idempotent requests are sent again after a
+// jittered exponential backoff (UPSTREAM_MAX_ATTEMPTS, UPSTREAM_RETRY_BASE,
+// UPSTREAM_RETRY_MAX), signed anew each time. When S3 keeps failing the
+// breaker opens and requests fail fast with a 503 for BREAKER_COOLDOWN,
+// after which a single request probes the backend.
+
+var errBreakerOpen = newAPIError(http.StatusServiceUnavailable, "UpstreamUnavailable",
+        "S3 is failing, requests are suspended for a while (circuit breaker open)")
+
+// retryableRequest reports whether req may be sent again: an idempotent
+// method, and a body that can be rewound. POST is only the DeleteObjects of
+// ?delete; creating or completing a multipart upload is never repeated.
+func retryableRequest(req *http.Request) bool {
+        switch req.Method {
+        case http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodPut: // PUT: copy or upload
+        case http.MethodPost:
+                if !req.URL.Query().Has("delete") {
+                        return false
+                }
+        default:
+                return false
+        }
+        return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewindable sets req.GetBody when body can seek, so that the upload can be
+// retried; http.NewRequest only does it for in-memory readers.
+func rewindable(req *http.Request, body io.Reader) {
+        s, ok := body.(io.ReadSeeker)
+        if !ok || req.GetBody != nil || req.Body == nil || req.Body == http.NoBody {
+                return
+        }
+        start, err := s.Seek(0, io.SeekCurrent)
+        if err != nil {
+                return
+        }
+        req.GetBody = func() (io.ReadCloser, error) {
+                if _, err := s.Seek(start, io.SeekStart); err != nil {
+                        return nil, err
+                }
+                return io.NopCloser(s), nil
+        }
+}
+
+// shouldRetry reports whether an attempt failed in a way worth retrying.
+// The client going away or the breaker refusing are final.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+        if err != nil {
+                return ctx.Err() == nil && err != errBreakerOpen
+        }
+        return retryableStatus(resp.StatusCode)
+}
+
+// backoff is the wait before attempt n+1: full jitter over base*2^(n-1),
+// capped, and at least what a Retry-After asks for (still capped).
+func (p *proxy) backoff(n int, resp *http.Response) time.Duration {
+        base, max := p.cfg.UpstreamRetryBase, p.cfg.UpstreamRetryMax
+        d := base << (n - 1)
+        if d <= 0 || d > max {
+                d = max
+        }
+        d = time.Duration(rand.Int63n(int64(d) + 1))
+        if resp != nil {
+                if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+                        if ra := time.Duration(s) * time.Second; ra > d {
+                                d = ra
+                        }
+                }
+        }
+        if d > max {
+                d = max
+        }
+        return d
+}
+
+// signAndDo signs req and sends it, retrying idempotent requests.
+func (p *proxy) signAndDo(ctx context.Context, req *http.Request) (*http.Response, error) {
+        req.Host = p.hostHdr
+        req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+        if id := requestID(ctx); id != "" {
+                req.Header.Set(requestIDHeader, id) // not signed, for correlation only
+        }
+        attempts := 1
+        if retryableRequest(req) {
+                attempts = p.cfg.UpstreamMaxAttempts
+        }
+        for n := 1; ; n++ {
+                resp, err := p.doOnce(ctx, req)
+                if n >= attempts || !shouldRetry(ctx, resp, err) {
+                        return resp, err
+                }
+                wait := p.backoff(n, resp)
+                if resp != nil {
+                        io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+                        resp.Body.Close()
+                }
+                p.metrics.upstreamRetries.WithLabelValues(req.Method).Inc()
+                t := time.NewTimer(wait)
+                select {
+                case <-t.C:
+                case <-ctx.Done():
+                        t.Stop()
+                        return nil, ctx.Err()
+                }
+
+                next := req.Clone(ctx)
+                if req.GetBody != nil {
+                        if next.Body, err = req.GetBody(); err != nil {
+                                return nil, err
+                        }
+                }
+                req = next
+        }
+}
+
+// doOnce is one signed round trip, through the breaker.
+func (p *proxy) doOnce(ctx context.Context, req *http.Request) (*http.Response, error) {
+        if !p.breaker.allow() {
+                p.metrics.breakerRejected.Inc()
+                return nil, errBreakerOpen
+        }
+        now := time.Now().UTC()
+        if err := p.signer.SignHTTP(
+                ctx, p.creds, req, "UNSIGNED-PAYLOAD", "s3", p.cfg.Region, now,
+                func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true },
+        ); err != nil {
+                p.breaker.release()
+                return nil, err
+        }
+        start := time.Now()
+        resp, err := p.client.Do(req)
+        p.metrics.observeUpstream(req.Method, resp, err, start)
+        switch {
+        case err != nil && ctx.Err() != nil:
+                p.breaker.release() // the client left, S3 did nothing wrong
+        case err != nil:
+                p.breaker.record(true)
+        default:
+                p.breaker.record(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented)
+        }
+        return resp, err
+}
+
+/* ----- circuit breaker ----- */
+
+// breaker opens after threshold consecutive failures (transport errors and
+// 5xx) and stays open for cooldown; then one request goes through as a
+// probe, which closes it on success or opens it again on failure.
+type breaker struct {
+        threshold int
+        cooldown  time.Duration
+        m         *metrics
+
+        mu        sync.Mutex
+        failures  int
+        openUntil time.Time // zero while closed
+        probing   bool
+}
+
+func newBreaker(c cfg, m *metrics) *breaker {
+        return &breaker{threshold: c.BreakerThreshold, cooldown: c.BreakerCooldown, m: m}
+}
+
+// allow reports whether a request may be sent now. Every allowed request
+// must be followed by record or release.
+func (b *breaker) allow() bool {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        if b.openUntil.IsZero() {
+                return true
+        }
+        if b.probing || time.Now().Before(b.openUntil) {
+                return false
+        }
+        b.probing = true
+        return true
+}
+
+// record reports the outcome of an allowed request.
+func (b *breaker) record(failed bool) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        b.probing = false
+        if !failed {
+                if !b.openUntil.IsZero() {
+                        log.Printf("upstream: S3 answers again, circuit breaker closed")
+                        b.m.breakerOpen.Set(0)
+                }
+                b.failures, b.openUntil = 0, time.Time{}
+                return
+        }
+        b.failures++
+        if b.failures < b.threshold && b.openUntil.IsZero() {
+                return
+        }
+        if b.openUntil.IsZero() {
+                log.Printf("upstream: %d failures in a row, circuit breaker open for %s", b.failures, b.cooldown)
+                b.m.breakerOpen.Set(1)
+        }
+        b.openUntil = time.Now().Add(b.cooldown)
+}
+
+// release gives back an allowed request that tells nothing about S3.
+func (b *breaker) release() {
+        b.mu.Lock()
+        b.probing = false
+        b.mu.Unlock()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "path"
+        "regexp"
+        "strconv"
+        "strings"
+        "time"
+)
+
+/* ===== Search: /api/search ===== */
+
+const (
+        searchDefaultLimit = 200
+        searchMaxLimit     = 5000
+)
+
+type searchItem struct {
+        Key          string    `json:"key"`
+        Name         string    `json:"name"`
+        Size         int64     `json:"size"`
+        LastModified time.Time `json:"lastModified"`
+}
+
+type searchResponse struct {
+        Items     []searchItem `json:"items"`
+        Total     int          `json:"total"` // matches before limit
+        Truncated bool         `json:"truncated"`
+        Index     indexStatus  `json:"index"`
+        TookMs    int64        `json:"tookMs"`
+}
+
+// globToRegexp compiles a glob where '*' and '?' stop at '/', '**' crosses
+// directories and "**/" also matches no directory at all. A pattern without
+// a '/' is matched against the base name only, like .gitignore does.
+// Matching ignores case: *.pdf finds REPORT.PDF.
+func globToRegexp(glob string) (*regexp.Regexp, bool, error) {
+        var b strings.Builder
+        b.WriteString("(?i)^")
+        for i := 0; i < len(glob); i++ {
+                c := glob[i]
+                switch c {
+                case '*':
+                        if i+1 < len(glob) && glob[i+1] == '*' {
+                                i++
+                                if i+1 < len(glob) && glob[i+1] == '/' {
+                                        i++
+                                        b.WriteString("(?:.*/)?")
+                                } else {
+                                        b.WriteString(".*")
+                                }
+                        } else {
+                                b.WriteString("[^/]*")
+                        }
+                case '?':
+                        b.WriteString("[^/]")
+                case '[':
+                        j := strings.IndexByte(glob[i:], ']')
+                        if j < 0 {
+                                return nil, false, fmt.Errorf("unterminated [ in glob")
+                        }
+                        class := glob[i+1 : i+j]
+                        if strings.HasPrefix(class, "!") {
+                                class = "^" + class[1:]
+                        }
+                        b.WriteString("[" + class + "]")
+                        i += j
+                case '\\':
+                        if i+1 < len(glob) {
+                                i++
+                                b.WriteString(regexp.QuoteMeta(string(glob[i])))
+                        }
+                default:
+                        b.WriteString(regexp.QuoteMeta(string(c)))
+                }
+        }
+        b.WriteString("$")
+        rx, err := regexp.Compile(b.String())
+        return rx, !strings.Contains(glob, "/"), err
+}
+
+// parseSearchTime accepts RFC 3339 or a plain date.
+func parseSearchTime(s string) (time.Time, error) {
+        if t, err := time.Parse(time.RFC3339, s); err == nil {
+                return t, nil
+        }
+        return time.Parse("2006-01-02", s)
+}
+
+// handleSearch filters the key index. Filters combine with AND:
+//
+//	prefix=  keys under this prefix (globs and names are relative to it)
+//	q=       case-insensitive substring of the key
+//	glob=    glob pattern, e.g. **/*.pdf or *.jpg
+//	regex=   Go regexp on the key
+//	minSize= maxSize=  bytes
+//	after= before=     last modification, RFC 3339 or YYYY-MM-DD
+//	trash=1  include the trash
+func (p *proxy) handleSearch(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        start := time.Now()
+        q := r.URL.Query()
+
+        prefix := strings.TrimLeft(q.Get("prefix"), "/")
+        sub := strings.ToLower(q.Get("q"))
+        withTrash := q.Get("trash") == "1"
+
+        var glob *regexp.Regexp
+        globBase := false
+        if g := q.Get("glob"); g != "" {
+                if glob, globBase, err = globToRegexp(g); err != nil {
+                        httpError(w, "bad glob: "+err.Error(), http.StatusBadRequest)
+                        return
+                }
+        }
+        var rx *regexp.Regexp
+        if s := q.Get("regex"); s != "" {
+                if rx, err = regexp.Compile(s); err != nil {
+                        httpError(w, "bad regex: "+err.Error(), http.StatusBadRequest)
+                        return
+                }
+        }
+        minSize, maxSize := int64(-1), int64(-1)
+        for name, dst := range map[string]*int64{"minSize": &minSize, "maxSize": &maxSize} {
+                if s := q.Get(name); s != "" {
+                        if *dst, err = strconv.ParseInt(s, 10, 64); err != nil {
+                                httpError(w, "bad "+name, http.StatusBadRequest)
+                                return
+                        }
+                }
+        }
+        var after, before time.Time
+        for name, dst := range map[string]*time.Time{"after": &after, "before": &before} {
+                if s := q.Get(name); s != "" {
+                        if *dst, err = parseSearchTime(s); err != nil {
+                                httpError(w, "bad "+name, http.StatusBadRequest)
+                                return
+                        }
+                }
+        }
+        limit := searchDefaultLimit
+        if s := q.Get("limit"); s != "" {
+                if v, err := strconv.Atoi(s); err == nil && v > 0 {
+                        limit = min(v, searchMaxLimit)
+                }
+        }
+
+        acl := p.access(r, bucket)
+        p.index.ensure(bucket)
+        matches, total := p.index.find(bucket, prefix, limit, func(o objectInfo) bool {
+                if strings.HasSuffix(o.Key, "/") || !acl.can(actRead, o.Key) {
+                        return false
+                }
+                if !withTrash && p.inTrash(o.Key) || p.inThumbs(o.Key) {
+                        return false
+                }
+                if minSize >= 0 && o.Size < minSize || maxSize >= 0 && o.Size > maxSize {
+                        return false
+                }
+                if !after.IsZero() && o.LastModified.Before(after) || !before.IsZero() && !o.LastModified.Before(before) {
+                        return false
+                }
+                if sub != "" && !strings.Contains(strings.ToLower(o.Key), sub) {
+                        return false
+                }
+                if glob != nil {
+                        rel := strings.TrimPrefix(o.Key, prefix)
+                        if globBase {
+                                rel = path.Base(rel)
+                        }
+                        if !glob.MatchString(rel) {
+                                return false
+                        }
+                }
+                return rx == nil || rx.MatchString(o.Key)
+        })
+
+        out := searchResponse{Items: []searchItem{}, Total: total, Truncated: total > limit, Index: p.index.status(bucket)}
+        for _, o := range matches {
+                out.Items = append(out.Items, searchItem{Key: o.Key, Name: path.Base(o.Key), Size: o.Size, LastModified: o.LastModified})
+        }
+        out.TookMs = time.Since(start).Milliseconds()
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+        "context"
+        "crypto/hmac"
+        "crypto/rand"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "time"
+
+        v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+/* ===== Share links: /api/share ===== */
+
+// Query parameters carried by proxy-relative share links (/s3/<key>?...).
+const (
+        shareExpiresParam   = "share-expires"
+        shareSignatureParam = "share-sig"
+)
+
+// SigV4 presigned URLs cannot live longer than 7 days.
+const maxPresignTTL = 7 * 24 * time.Hour
+
+type shareRequest struct {
+        Key    string `json:"key"`
+        Method string `json:"method"` // "GET" (default) | "PUT"
+        Mode   string `json:"mode"`   // "presigned" (default) | "proxy"
+        TTL    int64  `json:"ttl"`    // seconds, 0 = SHARE_DEFAULT_TTL
+}
+
+type shareResponse struct {
+        Key       string    `json:"key"`
+        Method    string    `json:"method"`
+        Mode      string    `json:"mode"`
+        URL       string    `json:"url"`
+        ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type shareCtxKey struct{}
+
+// loadShareKey returns the HMAC key for proxy links. Without SHARE_SECRET a
+// random key is used, so links stop working when the proxy restarts.
+func loadShareKey(secret string) []byte {
+        if secret != "" {
+                return []byte(secret)
+        }
+        b := make([]byte, 32)
+        if _, err := rand.Read(b); err != nil {
+                log.Fatalf("share key: %v", err)
+        }
+        log.Printf("SHARE_SECRET not set: proxy share links will not survive a restart")
+        return b
+}
+
+func (p *proxy) shareSignature(method, bucket, key string, exp int64) string {
+        m := hmac.New(sha256.New, p.shareKey)
+        fmt.Fprintf(m, "%s\n%s\n%s\n%d", method, bucket, srcToPath(key), exp)
+        return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (p *proxy) handleShare(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req shareRequest
+        if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        key := srcToPath(req.Key)
+        if key == "" || strings.HasSuffix(key, "/") {
+                httpError(w, "bad key", http.StatusBadRequest)
+                return
+        }
+        method := strings.ToUpper(req.Method)
+        if method == "" {
+                method = http.MethodGet
+        }
+        if method != http.MethodGet && method != http.MethodPut {
+                httpError(w, "method must be GET or PUT", http.StatusBadRequest)
+                return
+        }
+        // the link carries the rights of its creator
+        action := actRead
+        if method == http.MethodPut {
+                action = actWrite
+        }
+        if !p.authorizeKey(w, r, action, bucket, key) {
+                return
+        }
+        mode := req.Mode
+        if mode == "" {
+                mode = "presigned"
+        }
+
+        ttl := p.cfg.ShareDefaultTTL
+        if req.TTL > 0 {
+                ttl = time.Duration(req.TTL) * time.Second
+        }
+        if ttl > p.cfg.ShareMaxTTL {
+                ttl = p.cfg.ShareMaxTTL
+        }
+
+        now := time.Now().UTC()
+        out := shareResponse{Key: key, Method: method, Mode: mode}
+
+        switch mode {
+        case "presigned":
+                if ttl > maxPresignTTL {
+                        ttl = maxPresignTTL
+                }
+                u, err := p.presignObject(r.Context(), method, bucket, key, ttl, now)
+                if err != nil {
+                        httpError(w, fmt.Sprintf("presign: %v", err), http.StatusInternalServerError)
+                        return
+                }
+                out.URL = u
+        case "proxy":
+                exp := now.Add(ttl).Unix()
+                out.URL = prefixed(r, "/s3/"+url.PathEscape(bucket)+"/"+encodeKeyRaw(key)) +
+                        "?" + shareExpiresParam + "=" + strconv.FormatInt(exp, 10) +
+                        "&" + shareSignatureParam + "=" + p.shareSignature(method, bucket, key, exp)
+        default:
+                httpError(w, "mode must be presigned or proxy", http.StatusBadRequest)
+                return
+        }
+        out.ExpiresAt = now.Add(ttl).Truncate(time.Second)
+
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+// presignObject signs a URL against S3_PUBLIC_ENDPOINT (or S3_ENDPOINT), since
+// the Host header is part of the signature.
+func (p *proxy) presignObject(ctx context.Context, method, bucket, key string, ttl time.Duration, now time.Time) (string, error) {
+        u := *p.public
+        u.Path = strings.TrimRight(p.public.Path, "/") + "/" + bucket + "/" + srcToPath(key)
+        u.RawPath = strings.TrimRight(p.public.EscapedPath(), "/") + "/" + url.PathEscape(bucket) + "/" + encodeKeyRaw(key)
+        q := url.Values{}
+        q.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+        u.RawQuery = q.Encode()
+
+        req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+        if err != nil {
+                return "", err
+        }
+        signed, _, err := p.signer.PresignHTTP(
+                ctx, p.creds, req, "UNSIGNED-PAYLOAD", "s3", p.cfg.Region, now,
+                func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true },
+        )
+        return signed, err
+}
+
+// withShareToken checks the share-expires/share-sig pair of a proxy share
+// link, strips it before the request is forwarded to S3 and marks the request
+// context as shared. Requests without a token pass through untouched. The
+// signature covers the object alone, so a shared request carries no other
+// parameter (?tagging, ?uploadId=…): it would reach S3 unsigned.
+func (p *proxy) withShareToken(h http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                q := r.URL.Query()
+                sig := q.Get(shareSignatureParam)
+                if sig == "" {
+                        h(w, r)
+                        return
+                }
+                for k := range q {
+                        if k != shareSignatureParam && k != shareExpiresParam {
+                                httpError(w, "share link: unexpected parameter "+k, http.StatusForbidden)
+                                return
+                        }
+                }
+                exp, err := strconv.ParseInt(q.Get(shareExpiresParam), 10, 64)
+                if err != nil || time.Now().Unix() > exp {
+                        httpError(w, "share link expired", http.StatusForbidden)
+                        return
+                }
+                method := r.Method
+                if method == http.MethodHead {
+                        method = http.MethodGet
+                }
+                bucket, key, err := p.splitBucketKey(r)
+                if err != nil {
+                        pathError(w, err)
+                        return
+                }
+                want := p.shareSignature(method, bucket, key, exp)
+                if !hmac.Equal([]byte(sig), []byte(want)) {
+                        httpError(w, "bad share signature", http.StatusForbidden)
+                        return
+                }
+
+                q.Del(shareSignatureParam)
+                q.Del(shareExpiresParam)
+                r2 := r.Clone(context.WithValue(r.Context(), shareCtxKey{}, true))
+                r2.URL.RawQuery = q.Encode()
+                h(w, r2)
+        }
+}
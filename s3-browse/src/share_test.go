@@ -0,0 +1,78 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "strconv"
+        "testing"
+        "time"
+)
+
+func TestWithShareToken(t *testing.T) {
+        p := &proxy{cfg: cfg{Bucket: "default", Buckets: []string{"other"}}, shareKey: []byte("share-secret")}
+        exp := time.Now().Add(time.Hour).Unix()
+        link := func(method, bucket, key string, exp int64) string {
+                return "/s3/" + bucket + "/" + key + "?" + shareExpiresParam + "=" + strconv.FormatInt(exp, 10) +
+                        "&" + shareSignatureParam + "=" + p.shareSignature(method, bucket, key, exp)
+        }
+        get := link(http.MethodGet, "default", "dir/a.txt", exp)
+        token := get[len("/s3/default/dir/a.txt"):] // ?share-expires=…&share-sig=…
+
+        tests := []struct {
+                name   string
+                method string
+                url    string
+                status int
+        }{
+                {"valid", http.MethodGet, get, http.StatusOK},
+                {"HEAD of a GET link", http.MethodHead, get, http.StatusOK},
+                {"valid PUT", http.MethodPut, link(http.MethodPut, "default", "dir/a.txt", exp), http.StatusOK},
+                {"same key, other spelling", http.MethodGet, "/s3/default/dir//a.txt" + token, http.StatusOK},
+                {"PUT with a GET link", http.MethodPut, get, http.StatusForbidden},
+                {"GET with a PUT link", http.MethodGet, link(http.MethodPut, "default", "dir/a.txt", exp), http.StatusForbidden},
+                {"other key", http.MethodGet, "/s3/default/dir/b.txt" + token, http.StatusForbidden},
+                {"other bucket", http.MethodGet, "/s3/other/dir/a.txt" + token, http.StatusForbidden},
+                {"pushed expiry", http.MethodGet, "/s3/default/dir/a.txt?" + shareExpiresParam + "=" + strconv.FormatInt(exp+3600, 10) +
+                        "&" + shareSignatureParam + "=" + p.shareSignature(http.MethodGet, "default", "dir/a.txt", exp), http.StatusForbidden},
+                {"expired", http.MethodGet, link(http.MethodGet, "default", "dir/a.txt", time.Now().Add(-time.Second).Unix()), http.StatusForbidden},
+                {"no expiry", http.MethodGet, "/s3/default/dir/a.txt?" + shareSignatureParam + "=x", http.StatusForbidden},
+                {"extra parameter", http.MethodGet, get + "&versionId=1", http.StatusForbidden},
+                {"extra listing parameter", http.MethodGet, get + "&list-type=2", http.StatusForbidden},
+                {"forged signature", http.MethodGet, get + "x", http.StatusForbidden},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        var got *http.Request
+                        h := p.withShareToken(func(w http.ResponseWriter, r *http.Request) { got = r })
+                        w := httptest.NewRecorder()
+                        h(w, httptest.NewRequest(tt.method, tt.url, nil))
+                        if w.Code != tt.status {
+                                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+                        }
+                        if tt.status != http.StatusOK {
+                                if got != nil {
+                                        t.Error("handler called")
+                                }
+                                return
+                        }
+                        if got == nil {
+                                t.Fatal("handler not called")
+                        }
+                        if got.URL.RawQuery != "" {
+                                t.Errorf("query passed on: %q", got.URL.RawQuery)
+                        }
+                        if got.Context().Value(shareCtxKey{}) != true {
+                                t.Error("request not marked as shared")
+                        }
+                })
+        }
+
+        t.Run("no token", func(t *testing.T) {
+                var got *http.Request
+                h := p.withShareToken(func(w http.ResponseWriter, r *http.Request) { got = r })
+                h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/s3/default/dir/a.txt?versionId=1", nil))
+                if got == nil || got.URL.RawQuery != "versionId=1" || got.Context().Value(shareCtxKey{}) != nil {
+                        t.Errorf("request without a token was changed")
+                }
+        })
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+        "bytes"
+        "compress/gzip"
+        "crypto/sha256"
+        "embed"
+        "encoding/hex"
+        "io/fs"
+        "log"
+        "mime"
+        "net/http"
+        "os"
+        "path"
+        "regexp"
+        "strings"
+        "sync"
+        "time"
+
+        "github.com/andybalholm/brotli"
+)
+
+/* ===== Static site: embedded public/ tree ===== */
+
+// The UI is compiled into the binary. STATIC_DIR serves a directory instead,
+// read on every request, for working on the UI without rebuilding.
+//
+// Every file gets a strong ETag from its content. The pages reference their
+// assets as assets/…?v=<hash>: such URLs never change content and are cached
+// for a year, everything else is revalidated (no-cache + ETag). Text assets
+// are served brotli or gzip compressed, from a .br/.gz file shipped next to
+// them or compressed once on first use.
+
+//go:embed all:public
+var embeddedPublic embed.FS
+
+const immutableCache = "public, max-age=31536000, immutable"
+
+type staticAsset struct {
+        body  []byte
+        ctype string
+        hash  string // 16 hex digits of the SHA-256, the ?v= of the pages
+
+        variants [2]staticVariant // br, gzip
+}
+
+type staticVariant struct {
+        once sync.Once
+        body []byte // nil when compression does not pay
+}
+
+var staticEncodings = [2]string{"br", "gzip"}
+
+type staticSite struct {
+        assets map[string]*staticAsset // by URL path, "/assets/js/app.js"
+}
+
+// assetRef matches the asset references of the pages, to version them.
+var assetRef = regexp.MustCompile(`((?:src|href)=")(assets/[^"?#]+)(")`)
+
+func newStaticSite(fsys fs.FS) (*staticSite, error) {
+        s := &staticSite{assets: map[string]*staticAsset{}}
+        precompressed := map[string][]byte{}
+        err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+                if err != nil || d.IsDir() {
+                        return err
+                }
+                b, err := fs.ReadFile(fsys, name)
+                if err != nil {
+                        return err
+                }
+                if strings.HasSuffix(name, ".br") || strings.HasSuffix(name, ".gz") {
+                        precompressed[name] = b
+                        return nil
+                }
+                ctype := mime.TypeByExtension(path.Ext(name))
+                if ctype == "" {
+                        ctype = http.DetectContentType(b)
+                }
+                s.assets["/"+name] = &staticAsset{body: b, ctype: ctype}
+                return nil
+        })
+        if err != nil {
+                return nil, err
+        }
+        for _, a := range s.assets {
+                a.hash = contentHash(a.body)
+        }
+        // pages last: their hash covers the versioned references
+        for name, a := range s.assets {
+                if !strings.HasSuffix(name, ".html") {
+                        continue
+                }
+                a.body = assetRef.ReplaceAllFunc(a.body, func(m []byte) []byte {
+                        sub := assetRef.FindSubmatch(m)
+                        ref, ok := s.assets["/"+string(sub[2])]
+                        if !ok {
+                                return m // served by a handler (assets/js/env.js)
+                        }
+                        return []byte(string(sub[1]) + string(sub[2]) + "?v=" + ref.hash + string(sub[3]))
+                })
+                a.hash = contentHash(a.body)
+        }
+        for name, b := range precompressed {
+                for i, ext := range []string{".br", ".gz"} {
+                        if a, ok := s.assets["/"+strings.TrimSuffix(name, ext)]; ok && strings.HasSuffix(name, ext) {
+                                v := &a.variants[i]
+                                v.once.Do(func() { v.body = b })
+                        }
+                }
+        }
+        return s, nil
+}
+
+func contentHash(b []byte) string {
+        sum := sha256.Sum256(b)
+        return hex.EncodeToString(sum[:8])
+}
+
+func compressible(ctype string) bool {
+        ctype, _, _ = strings.Cut(ctype, ";")
+        switch {
+        case strings.HasPrefix(ctype, "text/"), strings.HasSuffix(ctype, "javascript"), strings.HasSuffix(ctype, "json"),
+                strings.HasSuffix(ctype, "xml"), ctype == "image/svg+xml", ctype == "font/ttf", ctype == "application/vnd.ms-fontobject":
+                return true
+        }
+        return false
+}
+
+// variant returns the body of a in encoding i, compressing it the first
+// time; nil when a is not worth compressing.
+func (a *staticAsset) variant(i int) []byte {
+        v := &a.variants[i]
+        v.once.Do(func() {
+                if !compressible(a.ctype) || len(a.body) < 512 {
+                        return
+                }
+                var buf bytes.Buffer
+                switch staticEncodings[i] {
+                case "br":
+                        bw := brotli.NewWriterLevel(&buf, 9)
+                        bw.Write(a.body)
+                        bw.Close()
+                case "gzip":
+                        gw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+                        gw.Write(a.body)
+                        gw.Close()
+                }
+                if buf.Len() < len(a.body)*9/10 {
+                        v.body = buf.Bytes()
+                }
+        })
+        return v.body
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+        for _, part := range strings.Split(header, ",") {
+                name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+                if !strings.EqualFold(strings.TrimSpace(name), enc) {
+                        continue
+                }
+                q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+                return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+        }
+        return false
+}
+
+// spaRoute reports whether a missing path should get index.html: a page
+// route of the UI, not an asset, an API or a file with an extension.
+func spaRoute(upath string) bool {
+        for _, pfx := range []string{"/api/", "/assets/", "/auth/", "/s3/"} {
+                if strings.HasPrefix(upath, pfx) {
+                        return false
+                }
+        }
+        return path.Ext(upath) == ""
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        upath := path.Clean("/" + r.URL.Path)
+        if upath == "/" {
+                upath = "/index.html"
+        }
+        a, ok := s.assets[upath]
+        if !ok && spaRoute(upath) {
+                a, ok = s.assets["/index.html"]
+        }
+        if !ok {
+                httpError(w, "not found", http.StatusNotFound)
+                return
+        }
+
+        h := w.Header()
+        h.Set("Content-Type", a.ctype)
+        h.Set("Vary", "Accept-Encoding")
+        if v := r.URL.Query().Get("v"); v != "" && v == a.hash {
+                h.Set("Cache-Control", immutableCache)
+        } else {
+                h.Set("Cache-Control", "no-cache")
+        }
+        body, etag := a.body, a.hash
+        for i, enc := range staticEncodings {
+                if !acceptsEncoding(r.Header.Get("Accept-Encoding"), enc) {
+                        continue
+                }
+                if b := a.variant(i); b != nil {
+                        body, etag = b, a.hash+"-"+enc
+                        h.Set("Content-Encoding", enc)
+                        break
+                }
+        }
+        h.Set("ETag", `"`+etag+`"`)
+        http.ServeContent(w, r, upath, time.Time{}, bytes.NewReader(body))
+}
+
+// staticHandler serves the embedded tree, or STATIC_DIR when set.
+func (p *proxy) staticHandler() http.Handler {
+        if dir := p.cfg.StaticDir; dir != "" {
+                files := http.FileServer(http.Dir(dir))
+                return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                        w.Header().Set("Cache-Control", "no-cache")
+                        upath := path.Clean("/" + r.URL.Path)
+                        if _, err := fs.Stat(os.DirFS(dir), strings.TrimPrefix(upath, "/")); err != nil && spaRoute(upath) {
+                                r = r.Clone(r.Context())
+                                r.URL.Path = "/"
+                        }
+                        files.ServeHTTP(w, r)
+                })
+        }
+        sub, err := fs.Sub(embeddedPublic, "public")
+        if err == nil {
+                var s *staticSite
+                if s, err = newStaticSite(sub); err == nil {
+                        return s
+                }
+        }
+        log.Fatalf("static site: %v", err)
+        return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/md5"
+        "encoding/base64"
+        "encoding/json"
+        "encoding/xml"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "net/url"
+        "sort"
+        "strings"
+        "sync"
+        "unicode"
+        "unicode/utf8"
+)
+
+/* ===== Object tags: /api/tags and tag filters of the listing ===== */
+
+// Tags are key/value labels S3 keeps next to an object (?tagging), changed
+// without rewriting it: status:validated marks a dataset where it lies.
+// A backend without tagging answers 501 NotImplemented.
+
+const maxObjectTags = 10
+
+type tagging struct {
+        XMLName xml.Name `xml:"Tagging"`
+        TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+        Key   string `xml:"Key"`
+        Value string `xml:"Value"`
+}
+
+func taggingQuery() url.Values { return url.Values{"tagging": {""}} }
+
+// getTags reads the tags of key.
+func (p *proxy) getTags(ctx context.Context, bucket, key string) (map[string]string, error) {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildObjectURL(bucket, key, taggingQuery()), nil)
+        if err != nil {
+                return nil, err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return nil, parseS3Error("get tags", resp)
+        }
+        var t tagging
+        if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&t); err != nil {
+                return nil, fmt.Errorf("get tags: %w", err)
+        }
+        tags := make(map[string]string, len(t.TagSet))
+        for _, tg := range t.TagSet {
+                tags[tg.Key] = tg.Value
+        }
+        return tags, nil
+}
+
+// putTags replaces the tags of key; no tags at all deletes them.
+func (p *proxy) putTags(ctx context.Context, bucket, key string, tags map[string]string) error {
+        if len(tags) == 0 {
+                return p.deleteTags(ctx, bucket, key)
+        }
+        t := tagging{}
+        for k, v := range tags {
+                t.TagSet = append(t.TagSet, s3Tag{Key: k, Value: v})
+        }
+        sort.Slice(t.TagSet, func(i, j int) bool { return t.TagSet[i].Key < t.TagSet[j].Key })
+        body, err := xml.Marshal(t)
+        if err != nil {
+                return err
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.buildObjectURL(bucket, key, taggingQuery()), bytes.NewReader(body))
+        if err != nil {
+                return err
+        }
+        sum := md5.Sum(body)
+        req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:])) // required by PutObjectTagging
+        req.Header.Set("Content-Type", "application/xml")
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+                return parseS3Error("put tags", resp)
+        }
+        return nil
+}
+
+func (p *proxy) deleteTags(ctx context.Context, bucket, key string) error {
+        req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.buildObjectURL(bucket, key, taggingQuery()), nil)
+        if err != nil {
+                return err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+                return parseS3Error("delete tags", resp)
+        }
+        return nil
+}
+
+// validTags checks the limits of S3: 10 tags, keys of 1-128 and values of
+// up to 256 characters, made of letters, digits, spaces and + - = . _ : / @.
+func validTags(tags map[string]string) error {
+        if len(tags) > maxObjectTags {
+                return fmt.Errorf("%d tags, %d at most", len(tags), maxObjectTags)
+        }
+        valid := func(s string) bool {
+                for _, c := range s {
+                        if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != ' ' && !strings.ContainsRune("+-=._:/@", c) {
+                                return false
+                        }
+                }
+                return true
+        }
+        for k, v := range tags {
+                if n := utf8.RuneCountInString(k); n == 0 || n > 128 || !valid(k) || strings.HasPrefix(k, "aws:") {
+                        return fmt.Errorf("tag key %q: 1 to 128 letters, digits, spaces or + - = . _ : / @", k)
+                }
+                if utf8.RuneCountInString(v) > 256 || !valid(v) {
+                        return fmt.Errorf("tag %q: value of up to 256 letters, digits, spaces or + - = . _ : / @", k)
+                }
+        }
+        return nil
+}
+
+// fetchTags reads the tags of keys, BULK_CONCURRENCY at a time. Keys gone
+// since they were listed are left out; any other failure is returned.
+func (p *proxy) fetchTags(ctx context.Context, bucket string, keys []string) (map[string]map[string]string, error) {
+        var (
+                mu    sync.Mutex
+                out   = make(map[string]map[string]string, len(keys))
+                first error
+        )
+        forEachKey(ctx, p.cfg.BulkConcurrency, keys, func(ctx context.Context, k string) error {
+                tags, err := p.getTags(ctx, bucket, k)
+                var e *apiError
+                if errors.As(err, &e) && e.Status == http.StatusNotFound {
+                        return nil
+                }
+                mu.Lock()
+                defer mu.Unlock()
+                if err != nil {
+                        if first == nil {
+                                first = err
+                        }
+                        return err
+                }
+                out[k] = tags
+                return nil
+        })
+        if first == nil {
+                first = ctx.Err()
+        }
+        return out, first
+}
+
+/* ----- filters: ?tag=status:validated ----- */
+
+// tagFilter is one ?tag= of the listing: key:value, or key alone for any
+// value. Several must all match.
+type tagFilter struct {
+        key, value string
+        anyValue   bool
+}
+
+func parseTagFilters(r *http.Request) []tagFilter {
+        var out []tagFilter
+        for _, s := range r.URL.Query()["tag"] {
+                if s = strings.TrimSpace(s); s == "" {
+                        continue
+                }
+                k, v, ok := strings.Cut(s, ":")
+                out = append(out, tagFilter{key: k, value: v, anyValue: !ok})
+        }
+        return out
+}
+
+func matchTags(tags map[string]string, filters []tagFilter) bool {
+        for _, f := range filters {
+                v, ok := tags[f.key]
+                if !ok || !f.anyValue && v != f.value {
+                        return false
+                }
+        }
+        return true
+}
+
+/* ----- /api/tags ----- */
+
+// handleTags reads (GET ?key=), replaces (PUT {key, tags}) or removes
+// (DELETE ?key=) the tags of an object.
+func (p *proxy) handleTags(w http.ResponseWriter, r *http.Request) {
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var in struct {
+                Key  string            `json:"key"`
+                Tags map[string]string `json:"tags"`
+        }
+        switch r.Method {
+        case http.MethodGet, http.MethodDelete:
+                in.Key = r.URL.Query().Get("key")
+        case http.MethodPut:
+                if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+                        httpError(w, "bad json", http.StatusBadRequest)
+                        return
+                }
+        default:
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        key := srcToPath(in.Key)
+        if key == "" || strings.HasSuffix(key, "/") {
+                httpError(w, "key required", http.StatusBadRequest)
+                return
+        }
+
+        ctx := r.Context()
+        if r.Method == http.MethodGet {
+                if !p.authorizeKey(w, r, actRead, bucket, key) {
+                        return
+                }
+                tags, err := p.getTags(ctx, bucket, key)
+                if err != nil {
+                        upstreamError(w, "", err)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(map[string]any{"key": key, "tags": tags})
+                return
+        }
+
+        auditOp(r, "tags", bucket, key)
+        if !p.authorizeKey(w, r, actWrite, bucket, key) {
+                return
+        }
+        if r.Method == http.MethodDelete {
+                in.Tags = nil
+        }
+        if err := validTags(in.Tags); err != nil {
+                httpError(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if err := p.putTags(ctx, bucket, key, in.Tags); err != nil {
+                upstreamError(w, "", err)
+                return
+        }
+        if in.Tags == nil {
+                in.Tags = map[string]string{}
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(map[string]any{"key": key, "tags": in.Tags})
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/binary"
+        "fmt"
+        "image"
+        "image/color"
+        _ "image/gif"
+        "image/jpeg"
+        _ "image/png"
+        "io"
+        "log"
+        "log/slog"
+        "math"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "golang.org/x/image/draw"
+        _ "golang.org/x/image/webp"
+)
+
+/* ===== Thumbnails: /api/thumb?key=&w=&h=&fit= ===== */
+
+// A thumbnail is a JPEG of at most w×h: "contain" (the default) fits the
+// whole image, "cover" fills the box and crops the overflow. Images are
+// never enlarged. JPEG, PNG, GIF and WebP are read; the output is always a
+// JPEG, the Go image packages having no WebP encoder.
+//
+// Thumbnails are cached in the bucket as THUMB_PREFIX<key>/<etag>-<w>x<h>-<fit>.jpg,
+// keyed by the ETag of the source so that an overwritten image gets new
+// ones. Deleting or renaming through the proxy drops the thumbnails of the
+// keys; older versions are pruned when a new one is made. Listings and the
+// search hide the prefix, like the trash, and the policy treats a thumbnail
+// as its image (access.source).
+
+var (
+        errNotImage   = newAPIError(http.StatusUnsupportedMediaType, "NotAnImage", "not a JPEG, PNG, GIF or WebP image")
+        errImageLarge = newAPIError(http.StatusRequestEntityTooLarge, "ImageTooLarge", "image too large for a thumbnail")
+)
+
+type thumbSpec struct {
+        w, h int
+        fit  string // "contain" | "cover"
+}
+
+func (s thumbSpec) String() string { return fmt.Sprintf("%dx%d-%s", s.w, s.h, s.fit) }
+
+// parseThumbSpec reads w, h and fit; a missing side takes the other's
+// value, both default to 256.
+func (p *proxy) parseThumbSpec(q map[string][]string) (thumbSpec, error) {
+        get := func(k string) string {
+                if v := q[k]; len(v) > 0 {
+                        return v[0]
+                }
+                return ""
+        }
+        s := thumbSpec{fit: get("fit")}
+        for _, side := range []struct {
+                name string
+                v    *int
+        }{{"w", &s.w}, {"h", &s.h}} {
+                if v := get(side.name); v != "" {
+                        n, err := strconv.Atoi(v)
+                        if err != nil || n < 1 || n > p.cfg.ThumbMaxSize {
+                                return s, fmt.Errorf("%s: 1 to %d pixels", side.name, p.cfg.ThumbMaxSize)
+                        }
+                        *side.v = n
+                }
+        }
+        switch {
+        case s.w == 0 && s.h == 0:
+                s.w, s.h = 256, 256
+        case s.w == 0:
+                s.w = s.h
+        case s.h == 0:
+                s.h = s.w
+        }
+        switch s.fit {
+        case "":
+                s.fit = "contain"
+        case "contain", "cover":
+        default:
+                return s, fmt.Errorf("fit: contain or cover")
+        }
+        return s, nil
+}
+
+func (p *proxy) inThumbs(key string) bool {
+        return strings.HasPrefix(key, p.cfg.ThumbPrefix)
+}
+
+// thumbKey is where the thumbnail of key at version etag is cached.
+func (p *proxy) thumbKey(key, etag string, s thumbSpec) string {
+        return p.cfg.ThumbPrefix + key + "/" + strings.Trim(etag, `"`) + "-" + s.String() + ".jpg"
+}
+
+// thumbsRel returns the thumbnail prefix relative to prefix when it lives
+// below it, so listings can hide it.
+func (p *proxy) thumbsRel(prefix string) (string, bool) {
+        if !strings.HasPrefix(p.cfg.ThumbPrefix, prefix) || p.cfg.ThumbPrefix == prefix {
+                return "", false
+        }
+        return strings.TrimPrefix(p.cfg.ThumbPrefix, prefix), true
+}
+
+// handleThumb answers the thumbnail of an image, from the cache or made
+// now. With v=<etag of the source>, as the listing gives it, the response
+// is cached by the browser for good.
+func (p *proxy) handleThumb(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        q := r.URL.Query()
+        key := srcToPath(q.Get("key"))
+        if key == "" || strings.HasSuffix(key, "/") {
+                httpError(w, "key required", http.StatusBadRequest)
+                return
+        }
+        spec, err := p.parseThumbSpec(q)
+        if err != nil {
+                httpError(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if !p.authorizeKey(w, r, actRead, bucket, key) {
+                return
+        }
+
+        ctx := r.Context()
+        src, err := p.headObject(ctx, bucket, key)
+        if err != nil {
+                upstreamError(w, "", err)
+                return
+        }
+        version := strings.Trim(src.ETag, `"`)
+        h := w.Header()
+        h.Set("ETag", `"`+version+"-"+spec.String()+`"`)
+        if v := q.Get("v"); v != "" && strings.Trim(v, `"`) == version {
+                h.Set("Cache-Control", "private, "+strings.TrimPrefix(immutableCache, "public, "))
+        } else {
+                h.Set("Cache-Control", "private, no-cache")
+        }
+        h.Set("Content-Type", "image/jpeg")
+        if etagListMatches(r.Header.Get("If-None-Match"), h.Get("ETag")) {
+                w.WriteHeader(http.StatusNotModified)
+                return
+        }
+
+        tk := p.thumbKey(key, src.ETag, spec)
+        body, err := p.getObjectBytes(ctx, bucket, tk, int64(p.cfg.ThumbMaxSource))
+        if err != nil {
+                body, err = p.makeThumb(ctx, bucket, key, src, spec, tk)
+        }
+        if err != nil {
+                h.Del("ETag")
+                h.Del("Cache-Control")
+                upstreamError(w, "thumb", err)
+                return
+        }
+        http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// makeThumb makes the thumbnail of key and caches it at tk. One request
+// makes a given thumbnail, the others wait for it; THUMB_CONCURRENCY bounds
+// the images decoded at once.
+func (p *proxy) makeThumb(ctx context.Context, bucket, key string, src *objectMeta, spec thumbSpec, tk string) ([]byte, error) {
+        if src.Size > int64(p.cfg.ThumbMaxSource) {
+                return nil, errImageLarge
+        }
+        unlock := p.writeLocks.lock(bucket, tk)
+        defer unlock()
+        if body, err := p.getObjectBytes(ctx, bucket, tk, int64(p.cfg.ThumbMaxSource)); err == nil {
+                return body, nil // made while we waited
+        }
+        select {
+        case p.thumbSem <- struct{}{}:
+                defer func() { <-p.thumbSem }()
+        case <-ctx.Done():
+                return nil, ctx.Err()
+        }
+
+        start := time.Now()
+        img, err := p.getObjectBytes(ctx, bucket, key, int64(p.cfg.ThumbMaxSource))
+        if err != nil {
+                return nil, err
+        }
+        out, err := thumbnail(img, spec, p.cfg.ThumbMaxPixels, p.cfg.ThumbQuality)
+        if err != nil {
+                return nil, err
+        }
+        if err := p.putObject(ctx, bucket, tk, bytes.NewReader(out), int64(len(out)), "image/jpeg"); err != nil {
+                log.Printf("thumb: cache %s: %v", tk, err) // served anyway
+        } else {
+                go p.pruneThumbs(bucket, key, src.ETag)
+        }
+        slog.DebugContext(ctx, "thumbnail made", "id", requestID(ctx), "key", key, "spec", spec.String(), "durationMs", time.Since(start).Milliseconds())
+        return out, nil
+}
+
+// getObjectBytes reads key whole, failing beyond max bytes.
+func (p *proxy) getObjectBytes(ctx context.Context, bucket, key string, max int64) ([]byte, error) {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildObjectURL(bucket, key, nil), nil)
+        if err != nil {
+                return nil, err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return nil, parseS3Error("get", resp)
+        }
+        b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+        if err != nil {
+                return nil, err
+        }
+        if int64(len(b)) > max {
+                return nil, errImageLarge
+        }
+        return b, nil
+}
+
+/* ----- invalidation ----- */
+
+// dropThumbs removes, in the background, the thumbnails of keys that were
+// deleted or moved away.
+func (p *proxy) dropThumbs(bucket string, keys ...string) {
+        if !p.cfg.enabled("thumbs") {
+                return
+        }
+        var gone []string
+        for _, k := range keys {
+                if !p.inThumbs(k) && !p.inTrash(k) && !strings.HasSuffix(k, "/") {
+                        gone = append(gone, k)
+                }
+        }
+        if len(gone) == 0 {
+                return
+        }
+        go func() {
+                ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+                defer cancel()
+                // one listing below the directory the keys share
+                common := gone[0][:strings.LastIndexByte(gone[0], '/')+1]
+                set := make(map[string]bool, len(gone))
+                for _, k := range gone {
+                        for !strings.HasPrefix(k, common) {
+                                common = common[:strings.LastIndexByte(strings.TrimSuffix(common, "/"), '/')+1]
+                        }
+                        set[k] = true
+                }
+                objs, err := p.listAllObjects(ctx, bucket, p.cfg.ThumbPrefix+common)
+                if err != nil {
+                        log.Printf("thumb: drop below %s: %v", common, err)
+                        return
+                }
+                var stale []string
+                for _, o := range objs {
+                        rel := strings.TrimPrefix(o.Key, p.cfg.ThumbPrefix)
+                        if i := strings.LastIndexByte(rel, '/'); i > 0 && set[rel[:i]] {
+                                stale = append(stale, o.Key)
+                        }
+                }
+                p.deleteThumbs(ctx, bucket, stale)
+        }()
+}
+
+// pruneThumbs removes the thumbnails of key made for a version other than
+// etag.
+func (p *proxy) pruneThumbs(bucket, key, etag string) {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        dir := p.cfg.ThumbPrefix + key + "/"
+        lb, err := p.s3ListPage(ctx, bucket, dir, "/", "", 1000)
+        if err != nil {
+                log.Printf("thumb: prune %s: %v", key, err)
+                return
+        }
+        var stale []string
+        for _, c := range lb.Contents {
+                if !strings.HasPrefix(c.Key, dir+strings.Trim(etag, `"`)+"-") {
+                        stale = append(stale, c.Key)
+                }
+        }
+        p.deleteThumbs(ctx, bucket, stale)
+}
+
+func (p *proxy) deleteThumbs(ctx context.Context, bucket string, keys []string) {
+        if len(keys) == 0 {
+                return
+        }
+        if _, failed := p.deleteKeys(ctx, bucket, keys, nil); len(failed) > 0 {
+                log.Printf("thumb: %d of %d stale thumbnails not deleted, first: %s: %s", len(failed), len(keys), failed[0].Key, failed[0].Error)
+        }
+}
+
+/* ----- image processing ----- */
+
+// thumbnail decodes src, scales it into spec and encodes it as a JPEG.
+// Images of more than maxPixels are refused before being decoded.
+func thumbnail(src []byte, spec thumbSpec, maxPixels, quality int) ([]byte, error) {
+        cfg, format, err := image.DecodeConfig(bytes.NewReader(src))
+        if err != nil {
+                return nil, errNotImage
+        }
+        if cfg.Width*cfg.Height > maxPixels {
+                return nil, errImageLarge
+        }
+        img, _, err := image.Decode(bytes.NewReader(src))
+        if err != nil {
+                return nil, errNotImage
+        }
+        orient := 1
+        if format == "jpeg" {
+                orient = jpegOrientation(src)
+        }
+        bw, bh := spec.w, spec.h
+        if orient >= 5 {
+                bw, bh = bh, bw // scaled before being turned a quarter
+        }
+
+        sr := img.Bounds()
+        sw, sh := float64(sr.Dx()), float64(sr.Dy())
+        scale := math.Min(float64(bw)/sw, float64(bh)/sh)
+        if spec.fit == "cover" {
+                scale = math.Max(float64(bw)/sw, float64(bh)/sh)
+                // crop the source to the aspect of the box, centred
+                cw, ch := math.Min(sw, float64(bw)/scale), math.Min(sh, float64(bh)/scale)
+                x0, y0 := sr.Min.X+int((sw-cw)/2), sr.Min.Y+int((sh-ch)/2)
+                sr = image.Rect(x0, y0, x0+int(math.Round(cw)), y0+int(math.Round(ch)))
+                sw, sh = float64(sr.Dx()), float64(sr.Dy())
+        }
+        scale = math.Min(scale, 1)
+        dw, dh := max(1, int(math.Round(sw*scale))), max(1, int(math.Round(sh*scale)))
+
+        dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+        draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src) // JPEG has no alpha
+        if sw > 4*float64(dw) {
+                // CatmullRom over a huge source is slow: halve the way bilinearly first
+                mid := image.NewRGBA(image.Rect(0, 0, 2*dw, 2*dh))
+                draw.ApproxBiLinear.Scale(mid, mid.Bounds(), img, sr, draw.Src, nil)
+                img, sr = mid, mid.Bounds()
+        }
+        draw.CatmullRom.Scale(dst, dst.Bounds(), img, sr, draw.Over, nil)
+        dst = orientRGBA(dst, orient)
+
+        var buf bytes.Buffer
+        if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+                return nil, err
+        }
+        return buf.Bytes(), nil
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG, 1 when absent.
+func jpegOrientation(b []byte) int {
+        if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+                return 1
+        }
+        for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+                marker, n := b[i+1], int(binary.BigEndian.Uint16(b[i+2:]))
+                if marker == 0xDA || i+2+n > len(b) { // start of scan: no EXIF before it
+                        return 1
+                }
+                seg := b[i+4 : i+2+n]
+                if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+                        return exifOrientation(seg[6:])
+                }
+                i += 2 + n
+        }
+        return 1
+}
+
+// exifOrientation finds tag 0x0112 in IFD0 of a TIFF header.
+func exifOrientation(t []byte) int {
+        if len(t) < 8 {
+                return 1
+        }
+        var bo binary.ByteOrder
+        switch string(t[:2]) {
+        case "II":
+                bo = binary.LittleEndian
+        case "MM":
+                bo = binary.BigEndian
+        default:
+                return 1
+        }
+        ifd := int(bo.Uint32(t[4:]))
+        if ifd < 8 || ifd+2 > len(t) {
+                return 1
+        }
+        for i, n := 0, int(bo.Uint16(t[ifd:])); i < n; i++ {
+                e := ifd + 2 + 12*i
+                if e+12 > len(t) {
+                        break
+                }
+                if bo.Uint16(t[e:]) == 0x0112 {
+                        if o := int(bo.Uint16(t[e+8:])); o >= 1 && o <= 8 {
+                                return o
+                        }
+                        break
+                }
+        }
+        return 1
+}
+
+// orientRGBA turns and flips img as EXIF orientation o says.
+func orientRGBA(img *image.RGBA, o int) *image.RGBA {
+        if o <= 1 || o > 8 {
+                return img
+        }
+        w, h := img.Bounds().Dx(), img.Bounds().Dy()
+        dw, dh := w, h
+        if o >= 5 {
+                dw, dh = h, w
+        }
+        dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+        for y := 0; y < h; y++ {
+                for x := 0; x < w; x++ {
+                        var dx, dy int
+                        switch o {
+                        case 2:
+                                dx, dy = w-1-x, y
+                        case 3:
+                                dx, dy = w-1-x, h-1-y
+                        case 4:
+                                dx, dy = x, h-1-y
+                        case 5:
+                                dx, dy = y, x
+                        case 6:
+                                dx, dy = h-1-y, x
+                        case 7:
+                                dx, dy = h-1-y, w-1-x
+                        case 8:
+                                dx, dy = y, w-1-x
+                        }
+                        copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+                }
+        }
+        return dst
+}
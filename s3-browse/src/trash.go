@@ -0,0 +1,378 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "sort"
+        "strconv"
+        "strings"
+        "time"
+)
+
+/* ===== Trash: /api/trash, /api/trash/restore, /api/trash/purge ===== */
+
+// Deleted objects are moved to TRASH_PREFIX<ts>/<original key>, ts being the
+// deletion time. The layout is the one the browser used before (ISO date
+// with ':' and '.' replaced by '-') so older trash entries are still listed.
+const trashTimeLayout = "2006-01-02T15-04-05"
+
+func formatTrashTime(t time.Time) string {
+        t = t.UTC()
+        return fmt.Sprintf("%s-%03dZ", t.Format(trashTimeLayout), t.Nanosecond()/int(time.Millisecond))
+}
+
+// parseTrashTime reads "2006-01-02T15-04-05-000Z".
+func parseTrashTime(s string) (time.Time, error) {
+        i := strings.LastIndexByte(s, '-')
+        if i < 0 || len(s)-i != 5 || !strings.HasSuffix(s, "Z") {
+                return time.Time{}, errBadTrashID
+        }
+        t, err := time.Parse(trashTimeLayout, s[:i])
+        if err != nil {
+                return time.Time{}, errBadTrashID
+        }
+        ms, err := strconv.Atoi(s[i+1 : len(s)-1])
+        if err != nil {
+                return time.Time{}, errBadTrashID
+        }
+        return t.Add(time.Duration(ms) * time.Millisecond), nil
+}
+
+var errBadTrashID = errors.New("bad trash id")
+
+type trashRequest struct {
+        Key       string `json:"key,omitempty"`    // one object
+        Prefix    string `json:"prefix,omitempty"` // a folder, moved by a rename job
+        ID        string `json:"id,omitempty"`     // restore / purge: "<ts>/<original key>" or "<ts>/<original prefix>/"
+        All       bool   `json:"all,omitempty"`    // purge everything
+        Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+type trashItem struct {
+        ID        string    `json:"id"`
+        Path      string    `json:"path"`
+        DeletedAt time.Time `json:"deletedAt"`
+        Size      int64     `json:"size,omitempty"`
+}
+
+type trashResponse struct {
+        Prefix        string      `json:"prefix"`
+        RetentionDays int         `json:"retentionDays"`
+        Items         []trashItem `json:"items"`
+}
+
+// parseTrashID splits "<ts>/<original path>" and checks the timestamp.
+func parseTrashID(id string) (time.Time, string, error) {
+        ts, orig, ok := strings.Cut(strings.TrimLeft(id, "/"), "/")
+        if !ok || orig == "" {
+                return time.Time{}, "", errBadTrashID
+        }
+        t, err := parseTrashTime(ts)
+        if err != nil {
+                return time.Time{}, "", errBadTrashID
+        }
+        if _, ok := safeEntryName(orig); !ok {
+                return time.Time{}, "", errBadTrashID
+        }
+        return t, orig, nil
+}
+
+func (p *proxy) trashKey(now time.Time, orig string) string {
+        return p.cfg.TrashPrefix + formatTrashTime(now) + "/" + orig
+}
+
+func (p *proxy) inTrash(key string) bool {
+        return strings.HasPrefix(key, p.cfg.TrashPrefix)
+}
+
+func (p *proxy) listTrash(ctx context.Context, bucket string) ([]trashItem, error) {
+        objs, err := p.listAllObjects(ctx, bucket, p.cfg.TrashPrefix)
+        if err != nil {
+                return nil, err
+        }
+        items := make([]trashItem, 0, len(objs))
+        for _, o := range objs {
+                id := strings.TrimPrefix(o.Key, p.cfg.TrashPrefix)
+                t, orig, err := parseTrashID(id)
+                if err != nil {
+                        continue
+                }
+                items = append(items, trashItem{ID: id, Path: orig, DeletedAt: t, Size: o.Size})
+        }
+        sort.Slice(items, func(i, j int) bool {
+                if !items[i].DeletedAt.Equal(items[j].DeletedAt) {
+                        return items[i].DeletedAt.After(items[j].DeletedAt)
+                }
+                return items[i].Path < items[j].Path
+        })
+        return items, nil
+}
+
+// handleTrash lists the trash (GET) or moves a key or prefix into it (POST).
+func (p *proxy) handleTrash(w http.ResponseWriter, r *http.Request) {
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        switch r.Method {
+        case http.MethodGet:
+                items, err := p.listTrash(ctx, bucket)
+                if err != nil {
+                        upstreamError(w, "list", err)
+                        return
+                }
+                acl := p.access(r, bucket)
+                visible := items[:0]
+                for _, it := range items {
+                        ok := acl.can(actRead, it.Path)
+                        if strings.HasSuffix(it.Path, "/") {
+                                ok = acl.canSee(it.Path)
+                        }
+                        if ok {
+                                visible = append(visible, it)
+                        }
+                }
+                out := trashResponse{Prefix: p.cfg.TrashPrefix, RetentionDays: p.cfg.TrashRetentionDays, Items: visible}
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(out)
+
+        case http.MethodPost:
+                var req trashRequest
+                if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                        httpError(w, "bad json", http.StatusBadRequest)
+                        return
+                }
+                now := time.Now()
+                switch {
+                case req.Key != "":
+                        key := srcToPath(req.Key)
+                        if p.inTrash(key) || strings.HasSuffix(key, "/") {
+                                httpError(w, "bad key", http.StatusBadRequest)
+                                return
+                        }
+                        auditOp(r, "trash", bucket, key)
+                        if !p.authorizeKey(w, r, actDelete, bucket, key) {
+                                return
+                        }
+                        id := strings.TrimPrefix(p.trashKey(now, key), p.cfg.TrashPrefix)
+                        if err := p.moveObject(ctx, bucket, key, p.cfg.TrashPrefix+id); err != nil {
+                                upstreamError(w, "trash "+key, err)
+                                return
+                        }
+                        w.Header().Set("Content-Type", "application/json")
+                        _ = json.NewEncoder(w).Encode(trashItem{ID: id, Path: key, DeletedAt: now.UTC().Truncate(time.Millisecond)})
+                case req.Prefix != "":
+                        pfx := normPrefix(req.Prefix)
+                        if p.inTrash(pfx) || strings.HasPrefix(p.cfg.TrashPrefix, pfx) {
+                                httpError(w, "bad prefix", http.StatusBadRequest)
+                                return
+                        }
+                        auditOp(r, "trash", bucket, pfx)
+                        if !p.authorizeKey(w, r, actDelete, bucket, pfx) {
+                                return
+                        }
+                        p.submitMove(w, r, bucket, pfx, p.trashKey(now, pfx))
+                default:
+                        httpError(w, "key or prefix required", http.StatusBadRequest)
+                }
+
+        default:
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// handleTrashRestore moves an entry back to its original path.
+func (p *proxy) handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req trashRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+        _, orig, err := parseTrashID(req.ID)
+        if err != nil {
+                httpError(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        auditOp(r, "restore", bucket, orig)
+        if !p.authorizeKey(w, r, actWrite, bucket, orig) {
+                return
+        }
+        src := p.cfg.TrashPrefix + strings.TrimLeft(req.ID, "/")
+        if strings.HasSuffix(orig, "/") {
+                p.submitMove(w, r, bucket, src, orig)
+                return
+        }
+
+        if !req.Overwrite {
+                if _, err := p.objectSize(ctx, bucket, orig); err == nil {
+                        httpError(w, "original path exists: "+orig, http.StatusConflict)
+                        return
+                }
+        }
+        if err := p.moveObject(ctx, bucket, src, orig); err != nil {
+                upstreamError(w, "restore "+orig, err)
+                return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(map[string]string{"path": orig})
+}
+
+// handleTrashPurge deletes an entry (or a whole deletion batch "<ts>/", or
+// everything with all=true) for good.
+func (p *proxy) handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        var req trashRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                httpError(w, "bad json", http.StatusBadRequest)
+                return
+        }
+
+        start := time.Now()
+        target := p.cfg.TrashPrefix
+        orig := "" // the whole trash or a batch: may hold anything
+        if !req.All {
+                id := strings.TrimLeft(req.ID, "/")
+                if !strings.Contains(id, "/") {
+                        id += "/" // a whole batch
+                }
+                ts, _, _ := strings.Cut(id, "/")
+                if _, err := parseTrashTime(ts); err != nil || strings.Contains(id, "..") {
+                        httpError(w, errBadTrashID.Error(), http.StatusBadRequest)
+                        return
+                }
+                target += id
+                if _, o, err := parseTrashID(id); err == nil {
+                        orig = o
+                }
+        }
+        ae := auditOp(r, "purge", bucket, target)
+        if !p.authorizeKey(w, r, actDelete, bucket, orig) {
+                return
+        }
+        if !strings.HasSuffix(target, "/") {
+                if err := p.deleteObject(ctx, bucket, target); err != nil {
+                        upstreamError(w, "delete", err)
+                        return
+                }
+                ae.Count = 1
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(deletePrefixResponse{Deleted: 1, Took: time.Since(start).Milliseconds()})
+                return
+        }
+        deleted, failed, err := p.deletePrefix(ctx, bucket, target, nil)
+        if err != nil {
+                upstreamError(w, "list", err)
+                return
+        }
+        ae.Count = deleted
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(deletePrefixResponse{Deleted: deleted, Took: time.Since(start).Milliseconds(), Failed: failed})
+}
+
+// moveObject is a copy followed by a delete of the source.
+func (p *proxy) moveObject(ctx context.Context, bucket, src, dst string) error {
+        if err := p.copyObject(ctx, bucket, src, dst); err != nil {
+                return err
+        }
+        return p.deleteObject(ctx, bucket, src)
+}
+
+// submitMove answers with a rename job moving prefix src to dst.
+func (p *proxy) submitMove(w http.ResponseWriter, r *http.Request, bucket, src, dst string) {
+        j := &job{Type: jobRename, Bucket: bucket, Src: src, Dst: dst, User: principalFrom(r).User}
+        p.jobs.submit(j)
+        auditFrom(r).Job = j.ID
+        out, _ := p.jobs.get(j.ID)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", prefixed(r, "/api/jobs?id="+j.ID))
+        w.WriteHeader(http.StatusAccepted)
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+// sweepBuckets are the buckets the retention sweeper knows by name: the
+// default one and the S3_BUCKETS entries that are not patterns.
+func (p *proxy) sweepBuckets() []string {
+        out := []string{p.cfg.Bucket}
+        for _, b := range p.cfg.Buckets {
+                if !strings.ContainsAny(b, "*?[\\") && b != p.cfg.Bucket {
+                        out = append(out, b)
+                }
+        }
+        return out
+}
+
+// sweepTrash purges deletion batches older than TRASH_RETENTION_DAYS.
+func (p *proxy) sweepTrash(ctx context.Context) {
+        cutoff := time.Now().AddDate(0, 0, -p.cfg.TrashRetentionDays)
+        for _, bucket := range p.sweepBuckets() {
+                after := ""
+                for {
+                        lb, err := p.s3ListPage(ctx, bucket, p.cfg.TrashPrefix, "/", after, 1000)
+                        if err != nil {
+                                log.Printf("trash sweep %s: %v", bucket, err)
+                                break
+                        }
+                        for _, cp := range lb.CommonPrefixes {
+                                ts := strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, p.cfg.TrashPrefix), "/")
+                                t, err := parseTrashTime(ts)
+                                if err != nil || t.After(cutoff) {
+                                        continue
+                                }
+                                deleted, failed, err := p.deletePrefix(ctx, bucket, cp.Prefix, nil)
+                                if err != nil {
+                                        log.Printf("trash sweep %s/%s: %v", bucket, cp.Prefix, err)
+                                        continue
+                                }
+                                log.Printf("trash sweep %s/%s: %d purged, %d failed", bucket, cp.Prefix, deleted, len(failed))
+                        }
+                        if !lb.IsTruncated || len(lb.CommonPrefixes) == 0 {
+                                break
+                        }
+                        // skip the last batch's keys: '0' sorts right after '/'
+                        after = strings.TrimSuffix(lb.CommonPrefixes[len(lb.CommonPrefixes)-1].Prefix, "/") + "0"
+                }
+        }
+}
+
+func (p *proxy) runTrashSweeper() {
+        for {
+                ctx, cancel := context.WithTimeout(context.Background(), p.cfg.TrashSweepInterval)
+                p.sweepTrash(ctx)
+                cancel()
+                time.Sleep(p.cfg.TrashSweepInterval)
+        }
+}
+
+// trashRel returns the trash prefix relative to prefix when the trash lives
+// below it, so listings can hide it.
+func (p *proxy) trashRel(prefix string) (string, bool) {
+        if !strings.HasPrefix(p.cfg.TrashPrefix, prefix) || p.cfg.TrashPrefix == prefix {
+                return "", false
+        }
+        return strings.TrimPrefix(p.cfg.TrashPrefix, prefix), true
+}
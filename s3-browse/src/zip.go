@@ -0,0 +1,126 @@
+package main
+
+import (
+        "archive/zip"
+        "context"
+        "fmt"
+        "io"
+        "log"
+        "mime"
+        "net/http"
+        "path"
+        "strings"
+)
+
+/* ===== Server-side ZIP: /api/zip ===== */
+
+// zipMethod stores media and archives as-is, deflating is only worth it for text.
+func zipMethod(key string) uint16 {
+        switch detectKind(key) {
+        case "doc", "code", "other":
+                return zip.Deflate
+        default:
+                return zip.Store
+        }
+}
+
+// handleZip streams every object under ?prefix= as a ZIP archive. Entries are
+// written one by one straight from S3, nothing is buffered; archive/zip
+// switches to ZIP64 on its own for large entries or archives.
+func (p *proxy) handleZip(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+                return
+        }
+        ctx := r.Context()
+        bucket, err := p.queryBucket(r)
+        if err != nil {
+                pathError(w, err)
+                return
+        }
+        prefix := normPrefix(r.URL.Query().Get("prefix"))
+        excludes := parseExcludes(r)
+        acl := p.access(r, bucket)
+        if !acl.canSee(prefix) {
+                forbidden(w, r, actRead, bucket, prefix)
+                return
+        }
+
+        objs, err := p.listAllObjects(ctx, bucket, prefix)
+        if err != nil {
+                upstreamError(w, "list", err)
+                return
+        }
+        files := objs[:0]
+        var total int64
+        for _, o := range objs {
+                rel := strings.TrimPrefix(o.Key, prefix)
+                if rel == "" || strings.HasSuffix(rel, "/") || isExcluded(rel, excludes) || !acl.can(actRead, o.Key) {
+                        continue
+                }
+                files = append(files, o)
+                total += o.Size
+        }
+        if len(files) == 0 {
+                httpError(w, "nothing to archive", http.StatusNotFound)
+                return
+        }
+        if total > int64(p.cfg.ZipMaxBytes) {
+                httpError(w, fmt.Sprintf("archive too large: %d bytes (max %d)", total, p.cfg.ZipMaxBytes), http.StatusRequestEntityTooLarge)
+                return
+        }
+
+        name := path.Base(strings.TrimSuffix(prefix, "/"))
+        if prefix == "" {
+                name = bucket
+        }
+        w.Header().Set("Content-Type", "application/zip")
+        w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+        w.Header().Set("Cache-Control", "no-store")
+
+        zw := zip.NewWriter(w)
+        for _, o := range files {
+                if err := p.zipObject(ctx, zw, bucket, prefix, o); err != nil {
+                        // the status line is long gone: drop the connection so the
+                        // client sees a failed download, not a truncated archive
+                        log.Printf("zip %s/%s: %v", bucket, o.Key, err)
+                        panic(http.ErrAbortHandler)
+                }
+        }
+        if err := zw.Close(); err != nil {
+                log.Printf("zip %s/%s: %v", bucket, prefix, err)
+                panic(http.ErrAbortHandler)
+        }
+}
+
+func (p *proxy) zipObject(ctx context.Context, zw *zip.Writer, bucket, prefix string, o objectInfo) error {
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.buildObjectURL(bucket, o.Key, nil), nil)
+        if err != nil {
+                return err
+        }
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode == http.StatusNotFound {
+                // deleted since the listing
+                return nil
+        }
+        if resp.StatusCode != http.StatusOK {
+                return parseS3Error("get", resp)
+        }
+
+        fh := &zip.FileHeader{
+                Name:               strings.TrimPrefix(o.Key, prefix),
+                Method:             zipMethod(o.Key),
+                Modified:           o.LastModified,
+                UncompressedSize64: uint64(o.Size),
+        }
+        fw, err := zw.CreateHeader(fh)
+        if err != nil {
+                return err
+        }
+        _, err = io.Copy(fw, resp.Body)
+        return err
+}